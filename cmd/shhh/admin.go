@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"github.com/en9inerd/shhh/internal/config"
+	"github.com/en9inerd/shhh/internal/crypto"
+	"github.com/en9inerd/shhh/internal/memstore"
+)
+
+// adminTimeout bounds an admin connection, so a stuck client can't hold one open.
+const adminTimeout = time.Minute
+
+// rekeyRequest is sent over the admin socket by shhh rekey. Without keys, the server
+// reloads its master key file.
+type rekeyRequest struct {
+	Keys string `json:"keys,omitempty"`
+}
+
+type rekeyResponse struct {
+	Rekeyed    int    `json:"rekeyed"`
+	KeyVersion uint32 `json:"key_version,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// listenAdmin listens on the admin socket, replacing a stale one left by an earlier
+// run. The socket is only accessible to the server's user, which is what authorizes
+// a rekey.
+func listenAdmin(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// serveAdmin answers rekey requests on ln until ctx is done.
+func serveAdmin(ctx context.Context, logger *slog.Logger, ln net.Listener, cfg *config.Config, memStore *memstore.MemoryStore) {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error("admin socket failed", "error", err)
+			}
+			return
+		}
+		handleAdmin(conn, logger, cfg, memStore)
+	}
+}
+
+// handleAdmin serves one rekey request. Requests are handled one at a time, so
+// rekeys don't interleave.
+func handleAdmin(conn net.Conn, logger *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(adminTimeout))
+
+	var req rekeyRequest
+	var resp rekeyResponse
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		resp.Error = "can't decode request: " + err.Error()
+	} else if resp.Rekeyed, resp.KeyVersion, err = rekey(memStore, cfg, req.Keys); err != nil {
+		resp.Error = err.Error()
+	}
+	if resp.Error != "" {
+		logger.Error("failed to rekey secrets", "error", resp.Error)
+	} else {
+		logger.Info("rekeyed secrets", "count", resp.Rekeyed, "key_version", resp.KeyVersion)
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// rekey rewraps all stored secrets with the newest of keys, or of the reloaded master
+// key file if keys is empty.
+func rekey(memStore *memstore.MemoryStore, cfg *config.Config, keys string) (int, uint32, error) {
+	var keyring *crypto.Keyring
+	var err error
+	switch {
+	case keys != "":
+		keyring, err = crypto.ParseKeyring(keys)
+	case cfg.MasterKeyFile != "":
+		keyring, err = loadKeyring(cfg)
+	default:
+		err = errors.New("no master keys given, and the server has no master key file to reload")
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("can't load master keys: %w", err)
+	}
+	n, err := memStore.Rekey(keyring)
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, keyring.Current(), nil
+}
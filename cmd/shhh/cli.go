@@ -0,0 +1,648 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/en9inerd/shhh/internal/crypto"
+	"github.com/en9inerd/shhh/internal/memstore"
+)
+
+// runKeygen generates a recipient identity. The identity is written to the output
+// file (or stdout) and the public key to stderr, so it can be shared with senders.
+func runKeygen(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	output := fs.String("o", "", "Write the identity to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	identity, err := crypto.GenerateIdentity()
+	if err != nil {
+		return err
+	}
+	recipient := identity.Recipient().String()
+	content := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), recipient, identity)
+
+	if *output == "" {
+		_, err = io.WriteString(stdout, content)
+		return err
+	}
+	if err := writeKeyFile(*output, content); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "Public key: %s\n", recipient)
+	return nil
+}
+
+// runSignkey generates a sender signing key. The key, after the sender name, is written
+// to the output file (or stdout) and the matching trust store line to stderr. With
+// -server-side a senders file line is printed instead, with a new API token the
+// sender uses to have the server sign for them.
+func runSignkey(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("signkey", flag.ContinueOnError)
+	name := fs.String("name", "", "Sender name shown to recipients")
+	output := fs.String("o", "", "Write the signing key to this file instead of stdout")
+	serverSide := fs.Bool("server-side", false, "Print a senders file line and API token for a key the server holds")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !crypto.ValidSenderName(*name) {
+		return errors.New("usage: shhh signkey -name NAME [-o FILE] [-server-side]")
+	}
+
+	key, err := crypto.GenerateSigningKey()
+	if err != nil {
+		return err
+	}
+	trustLine := *name + " " + key.Public().String()
+
+	if *serverSide {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		token := base64.RawURLEncoding.EncodeToString(b)
+		hash := sha256.Sum256([]byte(token))
+		if _, err := fmt.Fprintf(stdout, "%s %x %s\n", *name, hash, key); err != nil {
+			return err
+		}
+		fmt.Fprintf(stderr, "API token for %s, shown only once: %s\n", *name, token)
+		return nil
+	}
+
+	content := fmt.Sprintf("# created: %s\n# trust store line: %s\n%s %s\n", time.Now().Format(time.RFC3339), trustLine, *name, key)
+	if *output == "" {
+		_, err = io.WriteString(stdout, content)
+		return err
+	}
+	if err := writeKeyFile(*output, content); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "Trust store line: %s\n", trustLine)
+	return nil
+}
+
+// writeKeyFile writes a private key file readable only by the user. It never
+// overwrites an existing file.
+func writeKeyFile(path, content string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runSend creates a secret from a file or stdin and prints its link. Without a passphrase
+// (from -passphrase-file or SHHH_PASSPHRASE) it is created in link mode. With -sign the
+// content is signed locally; with SHHH_SENDER_TOKEN set the server signs it instead.
+func runSend(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer, getenv func(string) string) error {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	server := fs.String("server", "http://localhost:8000", "Server URL")
+	exp := fs.Int("exp", 3600, "Expiration in seconds")
+	file := fs.String("file", "", "Send this file instead of text from stdin")
+	signKey := fs.String("sign", "", "Sign with the key in this file, created by signkey")
+	passphraseFile := fs.String("passphrase-file", "", "Read the passphrase from this file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("usage: shhh send [-server URL] [-exp SECONDS] [-file FILE] [-sign KEYFILE] [-passphrase-file FILE]")
+	}
+
+	var data []byte
+	var err error
+	if *file != "" {
+		data, err = os.ReadFile(*file)
+	} else {
+		data, err = io.ReadAll(stdin)
+	}
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := readPassphrase(*passphraseFile, getenv)
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]string{"exp": strconv.Itoa(*exp)}
+	if passphrase != "" {
+		fields["passphrase"] = passphrase
+	} else {
+		fields["mode"] = "link"
+	}
+	if *signKey != "" {
+		name, key, err := readSigningKey(*signKey)
+		if err != nil {
+			return fmt.Errorf("can't read signing key: %w", err)
+		}
+		sig, err := json.Marshal(memstore.Signature{Sender: name, PublicKey: key.Public().String(), Value: key.Sign(name, data)})
+		if err != nil {
+			return err
+		}
+		fields["signature"] = string(sig)
+	}
+
+	baseURL := strings.TrimSuffix(*server, "/")
+	link, err := createSecret(ctx, baseURL, data, *file, fields, getenv("SHHH_SENDER_TOKEN"))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(stdout, link)
+	return err
+}
+
+// readSigningKey reads the "name key" line from a signkey file, skipping comments.
+func readSigningKey(path string) (string, *crypto.SigningKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	for line := range strings.Lines(string(b)) {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			name, k, ok := strings.Cut(line, " ")
+			if !ok {
+				return "", nil, errors.New("signing key line must be in name key form")
+			}
+			key, err := crypto.ParseSigningKey(k)
+			return name, key, err
+		}
+	}
+	return "", nil, errors.New("no signing key found")
+}
+
+// createSecret posts a text secret as JSON, or a file as a multipart upload when
+// filename is set, and returns the new secret's link. Servers that don't return one get
+// a link built from baseURL.
+func createSecret(ctx context.Context, baseURL string, data []byte, filename string, fields map[string]string, senderToken string) (string, error) {
+	var body bytes.Buffer
+	var contentType, path string
+	if filename == "" {
+		req := map[string]any{"secret": string(data)}
+		for k, v := range fields {
+			req[k] = v
+		}
+		req["exp"] = json.Number(fields["exp"])
+		if sig, ok := fields["signature"]; ok {
+			req["signature"] = json.RawMessage(sig)
+		}
+		if err := json.NewEncoder(&body).Encode(req); err != nil {
+			return "", err
+		}
+		contentType, path = "application/json", "/api/v1/secret"
+	} else {
+		mw := multipart.NewWriter(&body)
+		for k, v := range fields {
+			if err := mw.WriteField(k, v); err != nil {
+				return "", err
+			}
+		}
+		fw, err := mw.CreateFormFile("file", filepath.Base(filename))
+		if err != nil {
+			return "", err
+		}
+		if _, err := fw.Write(data); err != nil {
+			return "", err
+		}
+		if err := mw.Close(); err != nil {
+			return "", err
+		}
+		contentType, path = mw.FormDataContentType(), "/api/v1/file"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+path, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if senderToken != "" {
+		req.Header.Set("Authorization", "Bearer "+senderToken)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", responseError(resp)
+	}
+	var out struct {
+		Key   string `json:"key"`
+		Token string `json:"token"`
+		URL   string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("can't decode response: %w", err)
+	}
+	if out.URL != "" {
+		return out.URL, nil
+	}
+	link := baseURL + "/secret/" + out.Key
+	if out.Token != "" {
+		link += "#" + out.Token
+	}
+	return link, nil
+}
+
+// serverError is a failed v1 API response.
+type serverError struct {
+	status string
+	code   string
+	msg    string
+}
+
+func (e *serverError) Error() string {
+	if e.code == "" {
+		return "server returned " + e.status
+	}
+	return fmt.Sprintf("server returned %s: %s (%s)", e.status, e.msg, e.code)
+}
+
+// responseError reads the error body of a failed v1 API response.
+func responseError(resp *http.Response) error {
+	var body struct {
+		Error struct {
+			Code    string              `json:"code"`
+			Message string              `json:"message"`
+			Fields  map[string][]string `json:"fields"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error.Code == "" {
+		return &serverError{status: resp.Status}
+	}
+	msg := body.Error.Message
+	for field, errs := range body.Error.Fields {
+		msg += fmt.Sprintf("; %s: %s", field, strings.Join(errs, ", "))
+	}
+	return &serverError{status: resp.Status, code: body.Error.Code, msg: msg}
+}
+
+// isServerError reports whether err is a server response with the given error code.
+func isServerError(err error, code string) bool {
+	var se *serverError
+	return errors.As(err, &se) && se.code == code
+}
+
+// runReceive fetches a secret and decrypts it locally. A secret sealed to the user's
+// public key is opened with -identity; the server hands out the envelope once and never
+// sees the private key. A passphrase secret is retrieved with a PAKE exchange, so the
+// passphrase (from -passphrase-file or SHHH_PASSPHRASE) is never sent to the server.
+func runReceive(ctx context.Context, args []string, stdout, stderr io.Writer, getenv func(string) string) error {
+	fs := flag.NewFlagSet("receive", flag.ContinueOnError)
+	identityFile := fs.String("identity", "", "File with the identity created by keygen")
+	passphraseFile := fs.String("passphrase-file", "", "Read the passphrase from this file")
+	server := fs.String("server", "http://localhost:8000", "Server URL, used when a bare secret ID is given")
+	output := fs.String("o", "", "Write the secret to this file instead of stdout")
+	trustFile := fs.String("trust", "", "Trust store to verify sender signatures against")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	passphrase, err := readPassphrase(*passphraseFile, getenv)
+	if err != nil {
+		return err
+	}
+	if (*identityFile == "") == (passphrase == "") || fs.NArg() != 1 {
+		return errors.New("usage: shhh receive -identity FILE | -passphrase-file FILE [-server URL] [-trust FILE] [-o FILE] <link or id>")
+	}
+
+	var trust *crypto.TrustStore
+	if *trustFile != "" {
+		b, err := os.ReadFile(*trustFile)
+		if err != nil {
+			return err
+		}
+		if trust, err = crypto.ParseTrustStore(string(b)); err != nil {
+			return fmt.Errorf("can't read trust store: %w", err)
+		}
+	}
+
+	baseURL, id, err := parseSecretRef(fs.Arg(0), *server)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	var meta memstore.Metadata
+	if passphrase != "" {
+		if data, meta, err = retrievePAKE(ctx, baseURL, id, passphrase); err != nil {
+			return pakeError(err)
+		}
+	} else {
+		identity, err := readIdentity(*identityFile)
+		if err != nil {
+			return fmt.Errorf("can't read identity: %w", err)
+		}
+		envelope, ad, err := fetchEnvelope(ctx, baseURL, id)
+		if err != nil {
+			return err
+		}
+		if data, meta, err = memstore.OpenSealed(crypto.NewCryptoService(), envelope, ad, identity); err != nil {
+			return fmt.Errorf("can't decrypt secret: %w", err)
+		}
+	}
+
+	fmt.Fprintf(stderr, "SHA-256: %s\n", crypto.ContentFingerprint(data))
+	if meta.Signature != nil {
+		fmt.Fprintln(stderr, describeSignature(meta.Signature, data, trust))
+	}
+
+	if meta.IsFile() && *output == "" {
+		fmt.Fprintf(stderr, "Secret is a file named %q, use -o to save it\n", meta.Filename)
+	}
+	if meta.IsBundle() {
+		return writeBundle(meta, data, *output, stdout, stderr)
+	}
+	if *output != "" {
+		return os.WriteFile(*output, data, 0o600)
+	}
+	_, err = stdout.Write(data)
+	return err
+}
+
+// pakeError explains a failed PAKE retrieval. Secrets with several passphrases or a
+// duress passphrase can't be retrieved this way, and neither can any secret from a FIPS
+// mode server, but the server answers for them like for a wrong passphrase, so the
+// command can only say which cases are possible and point to the browser.
+func pakeError(err error) error {
+	switch {
+	case isServerError(err, "not_approved"):
+		return errors.New("the server runs in FIPS mode and doesn't allow retrieving a secret without sending its passphrase, open the link in a browser instead")
+	case isServerError(err, "secret_not_found"):
+		return errors.New("secret not found, or the passphrase is wrong; secrets with several passphrases " +
+			"or a duress passphrase can't be received with this command, open the link in a browser instead")
+	}
+	return err
+}
+
+// writeBundle saves a message with attachments as a zip archive, or without an output
+// file prints the message and lists the attachments.
+func writeBundle(meta memstore.Metadata, data []byte, output string, stdout, stderr io.Writer) error {
+	if output != "" {
+		archive, err := meta.BundleZip(data)
+		if err != nil {
+			return fmt.Errorf("can't read bundle: %w", err)
+		}
+		return os.WriteFile(output, archive, 0o600)
+	}
+	message, files, err := meta.Bundle(data)
+	if err != nil {
+		return fmt.Errorf("can't read bundle: %w", err)
+	}
+	fmt.Fprintf(stderr, "Secret has %d attachments, use -o to save them as a zip:\n", len(files))
+	for _, f := range files {
+		fmt.Fprintf(stderr, "  %s (%d bytes)\n", f.Name, f.Size)
+	}
+	_, err = stdout.Write(message)
+	return err
+}
+
+// runCombine reconstructs a split secret locally from share texts given as arguments,
+// or one per line on stdin, so the combined secret never goes back to the server.
+func runCombine(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("combine", flag.ContinueOnError)
+	output := fs.String("o", "", "Write the secret to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	shares := fs.Args()
+	if len(shares) == 0 {
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		for line := range strings.Lines(string(b)) {
+			if line = strings.TrimSpace(line); line != "" {
+				shares = append(shares, line)
+			}
+		}
+	}
+	if len(shares) == 0 {
+		return errors.New("usage: shhh combine [-o FILE] [share...]")
+	}
+
+	data, meta, err := memstore.CombineShares(shares)
+	if err != nil {
+		return fmt.Errorf("can't combine shares: %w", err)
+	}
+
+	if meta.IsFile() && *output == "" {
+		fmt.Fprintf(stderr, "Secret is a file named %q, use -o to save it\n", meta.Filename)
+	}
+	if *output != "" {
+		return os.WriteFile(*output, data, 0o600)
+	}
+	_, err = stdout.Write(data)
+	return err
+}
+
+// runRekey rotates the running server's master keys through its admin socket: all
+// stored secrets are rewrapped with the newest key of -master-key-file, or of
+// SHHH_MASTER_KEYS if no file is given. Without either, the server reloads its own
+// key file. This is the only way to rotate inline keys, since restarting the server
+// loses every stored secret.
+func runRekey(args []string, stdout io.Writer, getenv func(string) string) error {
+	fs := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	socket := fs.String("socket", getenv("SHHH_ADMIN_SOCKET"), "The server's admin socket")
+	keyFile := fs.String("master-key-file", "", "File with the new versioned master keys, every version in use included")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *socket == "" || fs.NArg() != 0 {
+		return errors.New("usage: shhh rekey -socket PATH [-master-key-file FILE]")
+	}
+
+	keys := getenv("SHHH_MASTER_KEYS")
+	if *keyFile != "" {
+		b, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		keys = string(b)
+	}
+	if keys != "" {
+		if _, err := crypto.ParseKeyring(keys); err != nil {
+			return fmt.Errorf("can't read master keys: %w", err)
+		}
+	}
+
+	conn, err := net.DialTimeout("unix", *socket, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("can't connect to the server: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(adminTimeout))
+	if err := json.NewEncoder(conn).Encode(rekeyRequest{Keys: keys}); err != nil {
+		return err
+	}
+	var resp rekeyResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("can't decode response: %w", err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("server can't rekey: %s", resp.Error)
+	}
+	fmt.Fprintf(stdout, "Rewrapped %d secrets with master key version %d\n", resp.Rekeyed, resp.KeyVersion)
+	return nil
+}
+
+// readIdentity reads the first identity line from a keygen file, skipping comments.
+func readIdentity(path string) (*crypto.Identity, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for line := range strings.Lines(string(b)) {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			return crypto.ParseIdentity(line)
+		}
+	}
+	return nil, errors.New("no identity found")
+}
+
+// parseSecretRef accepts either a share link or a bare secret ID.
+func parseSecretRef(ref, server string) (baseURL, id string, err error) {
+	if !strings.Contains(ref, "/") {
+		return strings.TrimSuffix(server, "/"), ref, nil
+	}
+	u, err := url.Parse(ref)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", "", fmt.Errorf("invalid secret link %q", ref)
+	}
+	prefix, id, ok := strings.Cut(u.Path, "/secret/")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return "", "", fmt.Errorf("invalid secret link %q", ref)
+	}
+	return u.Scheme + "://" + u.Host + prefix, id, nil
+}
+
+func fetchEnvelope(ctx context.Context, baseURL, id string) (envelope, ad []byte, err error) {
+	var body struct {
+		Envelope []byte `json:"envelope"`
+		AAD      []byte `json:"aad"`
+	}
+	if err := postJSON(ctx, baseURL+"/api/v1/secret/"+url.PathEscape(id)+"/envelope", nil, &body); err != nil {
+		return nil, nil, err
+	}
+	return body.Envelope, body.AAD, nil
+}
+
+// retrievePAKE retrieves a passphrase secret through a PAKE exchange: the passphrase
+// only proves to the server that the client knows it, and the envelope is decrypted locally.
+func retrievePAKE(ctx context.Context, baseURL, id, passphrase string) ([]byte, memstore.Metadata, error) {
+	endpoint := baseURL + "/api/v1/secret/" + url.PathEscape(id) + "/pake"
+	var start struct {
+		Session string `json:"session"`
+		Salt    []byte `json:"salt"`
+		Share   []byte `json:"share"`
+	}
+	if err := postJSON(ctx, endpoint, nil, &start); err != nil {
+		return nil, memstore.Metadata{}, err
+	}
+
+	client, err := crypto.NewCryptoService().NewPAKEClient(start.Salt, passphrase, []byte(id))
+	if err != nil {
+		return nil, memstore.Metadata{}, err
+	}
+	confirm, err := client.Confirm(start.Share)
+	if err != nil {
+		return nil, memstore.Metadata{}, err
+	}
+
+	var finish struct {
+		Confirm  []byte `json:"confirm"`
+		Envelope []byte `json:"envelope"`
+		AAD      []byte `json:"aad"`
+	}
+	req := map[string]any{"session": start.Session, "share": client.Share(), "confirm": confirm}
+	if err := postJSON(ctx, endpoint+"/finish", req, &finish); err != nil {
+		return nil, memstore.Metadata{}, err
+	}
+
+	data, meta, err := memstore.OpenPAKE(client, finish.Confirm, finish.Envelope, finish.AAD)
+	if err != nil {
+		return nil, memstore.Metadata{}, fmt.Errorf("can't decrypt secret: %w", err)
+	}
+	return data, meta, nil
+}
+
+// postJSON posts in as JSON, or an empty body if in is nil, and decodes the response into out.
+func postJSON(ctx context.Context, endpoint string, in, out any) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("can't decode response: %w", err)
+	}
+	return nil
+}
+
+// readPassphrase reads a passphrase from file, or from SHHH_PASSPHRASE if no file is given.
+func readPassphrase(file string, getenv func(string) string) (string, error) {
+	if file == "" {
+		return getenv("SHHH_PASSPHRASE"), nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// describeSignature says who signed a received secret, and whether that can be trusted.
+func describeSignature(sig *memstore.Signature, data []byte, trust *crypto.TrustStore) string {
+	key, err := crypto.ParseVerifyingKey(sig.PublicKey)
+	switch {
+	case err != nil || !key.Verify(sig.Sender, data, sig.Value):
+		return fmt.Sprintf("WARNING: claims to be signed by %s, but the signature is invalid", sig.Sender)
+	case !trust.Trusts(sig.Sender, key):
+		return fmt.Sprintf("WARNING: signed by %s with untrusted key %s", sig.Sender, key.Fingerprint())
+	default:
+		return fmt.Sprintf("Signed by %s, fingerprint %s", sig.Sender, key.Fingerprint())
+	}
+}
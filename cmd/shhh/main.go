@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/fips140"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,8 +14,10 @@ import (
 	"time"
 
 	"github.com/en9inerd/shhh/internal/config"
+	"github.com/en9inerd/shhh/internal/crypto"
 	"github.com/en9inerd/shhh/internal/log"
 	"github.com/en9inerd/shhh/internal/memstore"
+	"github.com/en9inerd/shhh/internal/notify"
 	"github.com/en9inerd/shhh/internal/server"
 )
 
@@ -22,6 +27,23 @@ func run(ctx context.Context, args []string, getenv func(string) string) error {
 	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	if len(args) > 1 {
+		switch args[1] {
+		case "keygen":
+			return runKeygen(args[2:], os.Stdout, os.Stderr)
+		case "signkey":
+			return runSignkey(args[2:], os.Stdout, os.Stderr)
+		case "send":
+			return runSend(ctx, args[2:], os.Stdin, os.Stdout, getenv)
+		case "receive":
+			return runReceive(ctx, args[2:], os.Stdout, os.Stderr, getenv)
+		case "combine":
+			return runCombine(args[2:], os.Stdin, os.Stdout, os.Stderr)
+		case "rekey":
+			return runRekey(args[2:], os.Stdout, getenv)
+		}
+	}
+
 	cleanedArgs, verbose := cleanArgs(args)
 
 	cfg, err := config.ParseConfig(cleanedArgs, getenv)
@@ -31,10 +53,52 @@ func run(ctx context.Context, args []string, getenv func(string) string) error {
 
 	logger := log.NewLogger(verbose)
 	logger.Info("starting server", "version", version, "port", cfg.Port)
+	if cfg.PublicURL == "" {
+		// printed rather than logged, since logging is off without -v
+		fmt.Fprintln(os.Stderr, "warning: SHHH_PUBLIC_URL is not set, share links are built from the Host header of each request; set it for a public deployment")
+	}
+
+	cs := crypto.NewCryptoService()
+	cs.Padding = cfg.Padding
+	if cfg.FIPS {
+		if !fips140.Enabled() {
+			return errors.New("FIPS mode requires the Go FIPS 140-3 module, run with GODEBUG=fips140=on")
+		}
+		cs.FIPS = true
+		logger.Info("running in FIPS mode", "kdf", "pbkdf2-hmac-sha256", "iterations", cs.PBKDF2Iterations)
+	}
+
+	storeOpts := []memstore.Option{memstore.WithCrypto(cs), memstore.WithKeySlots(cfg.MaxKeySlots), memstore.WithMaxAttempts(cfg.MaxAttempts)}
+	keyring, err := loadKeyring(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to load master keys: %w", err)
+	}
+	if keyring != nil {
+		logger.Info("wrapping secrets with server master key", "key_version", keyring.Current())
+		storeOpts = append(storeOpts, memstore.WithKeyring(keyring))
+	}
+
+	if cfg.AlertWebhook != "" {
+		webhook := notify.NewWebhook(cfg.AlertWebhook, logger)
+		storeOpts = append(storeOpts, memstore.WithDuressAlert(func(id string) {
+			webhook.Send(notify.Event{Type: notify.EventDuress, ID: id, Time: time.Now()})
+		}))
+	}
 
-	memStore := memstore.NewMemoryStore(cfg.MaxRetention, cfg.MaxItems, cfg.MaxFileSize)
+	memStore := memstore.NewMemoryStore(cfg.MaxRetention, cfg.MaxItems, cfg.MaxFileSize, storeOpts...)
 	defer memStore.Stop()
 
+	if cfg.MasterKeyFile != "" {
+		go rekeyOnHangup(ctx, logger, cfg, memStore)
+	}
+	if cfg.AdminSocket != "" {
+		ln, err := listenAdmin(cfg.AdminSocket)
+		if err != nil {
+			return fmt.Errorf("failed to listen on admin socket: %w", err)
+		}
+		go serveAdmin(ctx, logger, ln, cfg, memStore)
+	}
+
 	handler, err := server.NewServer(logger, cfg, memStore)
 	if err != nil {
 		return fmt.Errorf("failed to create server: %w", err)
@@ -81,6 +145,45 @@ func main() {
 	}
 }
 
+// loadKeyring reads the server master keys from the key file or, failing that,
+// the inline setting. It returns nil if neither is configured.
+func loadKeyring(cfg *config.Config) (*crypto.Keyring, error) {
+	if cfg.MasterKeyFile != "" {
+		b, err := os.ReadFile(cfg.MasterKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return crypto.ParseKeyring(string(b))
+	}
+	if cfg.MasterKeys != "" {
+		return crypto.ParseKeyring(cfg.MasterKeys)
+	}
+	return nil, nil
+}
+
+// rekeyOnHangup reloads the master key file on SIGHUP and rewraps all stored
+// secrets with its newest key. Inline keys can't be reloaded this way, since the
+// environment can't change; they are rotated with shhh rekey.
+func rekeyOnHangup(ctx context.Context, logger *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			n, version, err := rekey(memStore, cfg, "")
+			if err != nil {
+				logger.Error("failed to rekey secrets", "error", err)
+				continue
+			}
+			logger.Info("rekeyed secrets", "count", n, "key_version", version)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func cleanArgs(args []string) (cleanArgs []string, verbose bool) {
 	for _, arg := range args {
 		if arg == "--verbose" || arg == "-v" {
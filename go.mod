@@ -4,6 +4,15 @@ go 1.25.1
 
 require golang.org/x/crypto v0.45.0
 
-require github.com/en9inerd/go-pkgs v0.1.2
+require (
+	filippo.io/age v1.2.1
+	filippo.io/bigmod v0.1.0
+	filippo.io/nistec v0.0.4
+	github.com/en9inerd/go-pkgs v0.1.2
+	golang.org/x/text v0.31.0
+)
 
-require golang.org/x/sys v0.38.0 // indirect
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
+)
@@ -1,18 +1,39 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/en9inerd/shhh/internal/crypto"
 )
 
 type Config struct {
-	Port          string
-	MinPhraseSize int
-	MaxPhraseSize int
-	MaxItems      int
-	MaxFileSize   int64
-	MaxRetention  time.Duration
+	Port                 string
+	PublicURL            string // base URL of share links, e.g. https://shhh.example.com, empty uses the request's host
+	MinPhraseSize        int
+	MaxPhraseSize        int
+	MinPassphraseEntropy float64 // estimated bits, 0 disables the check
+	MaxItems             int
+	MaxKeySlots          int // key slots per multi-passphrase secret
+	MaxAttempts          int // failed retrievals before a secret is destroyed, 0 disables the limit
+	MaxFileSize          int64
+	MaxRetention         time.Duration
+	IdempotencyWindow    time.Duration // how long Idempotency-Key responses are kept, 0 disables them
+	IdempotencyMaxKeys   int           // Idempotency-Key responses kept at once, the oldest are dropped past it
+	Padding              crypto.Padding
+	MasterKeyFile        string
+	MasterKeys           string
+	AdminSocket          string // unix socket shhh rekey connects to, empty disables it
+	AgeIdentityFile      string
+	FIPS                 bool   // only FIPS 140-3 approved algorithms, needs GODEBUG=fips140=on
+	AlertWebhook         string // URL lifecycle alerts are posted to, empty disables them
+	TrustStoreFile       string // sender public keys signatures are verified against
+	SendersFile          string // per-sender API token hashes and signing keys
 }
 
 func ParseConfig(args []string, getenv func(string) string) (*Config, error) {
@@ -41,6 +62,24 @@ func ParseConfig(args []string, getenv func(string) string) (*Config, error) {
 		return fallback
 	}
 
+	getEnvBool := func(key string, fallback bool) bool {
+		if v := getenv(key); v != "" {
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b
+			}
+		}
+		return fallback
+	}
+
+	getEnvFloat := func(key string, fallback float64) float64 {
+		if v := getenv(key); v != "" {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return f
+			}
+		}
+		return fallback
+	}
+
 	getEnvDuration := func(key string, fallback time.Duration) time.Duration {
 		if v := getenv(key); v != "" {
 			if d, err := time.ParseDuration(v); err == nil {
@@ -53,22 +92,92 @@ func ParseConfig(args []string, getenv func(string) string) (*Config, error) {
 	fs := flag.NewFlagSet("shhh", flag.ContinueOnError)
 
 	port := fs.String("port", getEnv("SHHH_PORT", "8000"), "Port to listen on")
+	publicURL := fs.String("public-url", getEnv("SHHH_PUBLIC_URL", ""), "Base URL of share links, e.g. https://shhh.example.com (default: the host requests are sent to)")
 	minPhraseSize := fs.Int("min-phrase-size", getEnvInt("SHHH_MIN_PHRASE_SIZE", 5), "Min passphrase size")
 	maxPhraseSize := fs.Int("max-phrase-size", getEnvInt("SHHH_MAX_PHRASE_SIZE", 128), "Max passphrase size")
+	minEntropy := fs.Float64("min-passphrase-entropy", getEnvFloat("SHHH_MIN_PASSPHRASE_ENTROPY", 0), "Min estimated passphrase entropy in bits (0 disables)")
 	maxItems := fs.Int("max-items", getEnvInt("SHHH_MAX_ITEMS", 100), "Max number of items in memory")
+	maxKeySlots := fs.Int("max-key-slots", getEnvInt("SHHH_MAX_KEY_SLOTS", 8), "Max passphrases per secret, every multi-passphrase secret is padded to this many key slots")
+	maxAttempts := fs.Int("max-attempts", getEnvInt("SHHH_MAX_ATTEMPTS", 0), "Failed retrievals after which a secret is destroyed (0 disables)")
 	maxFileSize := fs.Int64("max-file-size", getEnvInt64("SHHH_MAX_FILE_SIZE", 2*1024*1024), "Max file size in bytes")
 	maxRetention := fs.Duration("max-retention", getEnvDuration("SHHH_MAX_RETENTION", 24*time.Hour), "Max retention time")
+	idempotencyWindow := fs.Duration("idempotency-window", getEnvDuration("SHHH_IDEMPOTENCY_WINDOW", 24*time.Hour), "How long create responses are kept for retries with the same Idempotency-Key (0 disables)")
+	idempotencyMaxKeys := fs.Int("idempotency-max-keys", getEnvInt("SHHH_IDEMPOTENCY_MAX_KEYS", 10000), "Max Idempotency-Key responses kept at once, the oldest are dropped first")
+	masterKeyFile := fs.String("master-key-file", getEnv("SHHH_MASTER_KEY_FILE", ""), "File with versioned server master keys (version:base64key per line), reloaded on SIGHUP")
+	masterKeys := fs.String("master-keys", getEnv("SHHH_MASTER_KEYS", ""), "Comma separated versioned server master keys, used if no key file is set. Inline keys can only be rotated with shhh rekey, which needs -admin-socket")
+	adminSocket := fs.String("admin-socket", getEnv("SHHH_ADMIN_SOCKET", ""), "Unix socket for shhh rekey, only accessible to the server's user (empty disables it)")
+	ageIdentity := fs.String("age-identity-file", getEnv("SHHH_AGE_IDENTITY_FILE", ""), "age identity file for decrypting age uploads server-side")
+	fips := fs.Bool("fips", getEnvBool("SHHH_FIPS", false), "Use only FIPS 140-3 approved algorithms (requires GODEBUG=fips140=on)")
+	alertWebhook := fs.String("alert-webhook", getEnv("SHHH_ALERT_WEBHOOK", ""), "URL to post lifecycle alerts (e.g. duress passphrase used) to")
+	trustStore := fs.String("trust-store-file", getEnv("SHHH_TRUST_STORE_FILE", ""), "File with trusted sender public keys (name shhhsig1:... per line)")
+	senders := fs.String("senders-file", getEnv("SHHH_SENDERS_FILE", ""), "File with senders the server signs for (name token-sha256 signing-key per line)")
+	padding := fs.String("padding", getEnv("SHHH_PADDING", string(crypto.PaddingPadme)), "Ciphertext padding scheme (none, padme, pow2)")
 
 	if err := fs.Parse(args[1:]); err != nil {
 		return nil, err
 	}
 
+	paddingScheme, err := crypto.ParsePadding(*padding)
+	if err != nil {
+		return nil, err
+	}
+
+	if *maxKeySlots < 1 || *maxKeySlots > crypto.MaxKeySlots {
+		return nil, fmt.Errorf("max key slots must be between 1 and %d", crypto.MaxKeySlots)
+	}
+
+	if *idempotencyWindow < 0 {
+		return nil, errors.New("idempotency window can't be negative")
+	}
+
+	if *idempotencyMaxKeys < 1 {
+		return nil, errors.New("idempotency max keys must be at least 1")
+	}
+
+	if *maxAttempts < 0 {
+		return nil, errors.New("max attempts can't be negative")
+	}
+
+	if *publicURL != "" {
+		u, err := url.Parse(*publicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return nil, errors.New("public URL must be an http or https URL without a query or fragment")
+		}
+		*publicURL = strings.TrimRight(*publicURL, "/")
+	}
+
+	if *alertWebhook != "" {
+		u, err := url.Parse(*alertWebhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("alert webhook must be an http or https URL")
+		}
+	}
+
+	if *fips && *ageIdentity != "" {
+		return nil, errors.New("age decryption is not FIPS approved, unset the age identity file to run in FIPS mode")
+	}
+
 	return &Config{
-		Port:          *port,
-		MinPhraseSize: *minPhraseSize,
-		MaxPhraseSize: *maxPhraseSize,
-		MaxItems:      *maxItems,
-		MaxFileSize:   *maxFileSize,
-		MaxRetention:  *maxRetention,
+		Port:                 *port,
+		PublicURL:            *publicURL,
+		MinPhraseSize:        *minPhraseSize,
+		MaxPhraseSize:        *maxPhraseSize,
+		MinPassphraseEntropy: *minEntropy,
+		MaxItems:             *maxItems,
+		MaxKeySlots:          *maxKeySlots,
+		MaxAttempts:          *maxAttempts,
+		MaxFileSize:          *maxFileSize,
+		MaxRetention:         *maxRetention,
+		IdempotencyWindow:    *idempotencyWindow,
+		IdempotencyMaxKeys:   *idempotencyMaxKeys,
+		Padding:              paddingScheme,
+		MasterKeyFile:        *masterKeyFile,
+		MasterKeys:           *masterKeys,
+		AdminSocket:          *adminSocket,
+		AgeIdentityFile:      *ageIdentity,
+		FIPS:                 *fips,
+		AlertWebhook:         *alertWebhook,
+		TrustStoreFile:       *trustStore,
+		SendersFile:          *senders,
 	}, nil
 }
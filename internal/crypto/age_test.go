@@ -0,0 +1,86 @@
+package crypto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+func TestAgeRoundTrip(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("GenerateX25519Identity failed: %v", err)
+	}
+	recipient, err := ParseAgeRecipient(identity.Recipient().String())
+	if err != nil {
+		t.Fatalf("ParseAgeRecipient failed: %v", err)
+	}
+	identities, err := ParseAgeIdentities([]byte("# test key\n" + identity.String() + "\n"))
+	if err != nil {
+		t.Fatalf("ParseAgeIdentities failed: %v", err)
+	}
+
+	plaintext := []byte("interoperable secret")
+	file, err := EncryptAge(plaintext, recipient)
+	if err != nil {
+		t.Fatalf("EncryptAge failed: %v", err)
+	}
+	if !IsAgeFile(file) {
+		t.Error("expected EncryptAge output to be detected as an age file")
+	}
+
+	decrypted, err := DecryptAge(file, identities, 1024)
+	if err != nil {
+		t.Fatalf("DecryptAge failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("expected %q, got %q", plaintext, decrypted)
+	}
+
+	if _, err := DecryptAge(file, identities, 4); err == nil {
+		t.Error("expected DecryptAge to enforce the size limit")
+	}
+}
+
+func TestDecryptArmoredAge(t *testing.T) {
+	identity, _ := age.GenerateX25519Identity()
+
+	var buf bytes.Buffer
+	aw := armor.NewWriter(&buf)
+	w, err := age.Encrypt(aw, identity.Recipient())
+	if err != nil {
+		t.Fatalf("age.Encrypt failed: %v", err)
+	}
+	w.Write([]byte("armored"))
+	w.Close()
+	aw.Close()
+
+	if !IsAgeFile(buf.Bytes()) {
+		t.Error("expected armored file to be detected as an age file")
+	}
+	decrypted, err := DecryptAge(buf.Bytes(), []age.Identity{identity}, 1024)
+	if err != nil {
+		t.Fatalf("DecryptAge failed: %v", err)
+	}
+	if string(decrypted) != "armored" {
+		t.Errorf("expected %q, got %q", "armored", decrypted)
+	}
+}
+
+func TestParseAgeRecipient(t *testing.T) {
+	for _, s := range []string{
+		"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHsKLqeplhpW+uObz5dvMgjz1OxfM/XXUB+VHtZ6isGN alice@example.com",
+	} {
+		if _, err := ParseAgeRecipient(s); err != nil {
+			t.Errorf("ParseAgeRecipient(%q) failed: %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "age1invalid", "ssh-rsa AAAA", strings.Repeat("x", 10)} {
+		if _, err := ParseAgeRecipient(s); err == nil {
+			t.Errorf("ParseAgeRecipient(%q) should fail", s)
+		}
+	}
+}
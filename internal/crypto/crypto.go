@@ -3,86 +3,381 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
 	"errors"
 
 	"golang.org/x/crypto/argon2"
 )
 
+// envelopeVersion is the first byte of every envelope produced by CryptoService.
+// Since version 4 passphrases are normalized with NormalizePassphrase before key derivation,
+// and since version 5 the nonce is generated by the AEAD and left out of the associated data.
+const envelopeVersion byte = 5
+
+// Envelope modes, stored in the second byte of the envelope. The mode decides
+// what key material follows it and how the encryption key is derived from it.
+const (
+	modePassphrase byte = 1 // salt, key derived with Argon2id
+	modeRecipient  byte = 2 // hybrid X25519 + ML-KEM-768 ciphertexts
+	modeKey        byte = 3 // no key material, random key used directly
+	modePBKDF2     byte = 4 // salt and iteration count, key derived with PBKDF2-HMAC-SHA256
+	modeSlots      byte = 5 // KDF, its material and key slots wrapping a random data key
+	modePAKE       byte = 6 // salt and SPAKE2+ verifier, key derived with Argon2id
+)
+
+// maxPBKDF2Iterations bounds the iteration count read from an envelope, so a
+// crafted envelope can't make the server spin.
+const maxPBKDF2Iterations = 10_000_000
+
+// checkSize is the length of the key check value stored in the envelope header.
+const checkSize = 16
+
+var (
+	// ErrWrongPassphrase is returned when the passphrase does not match the envelope's key check.
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	// ErrWrongIdentity is returned when an envelope was not encrypted to the given identity.
+	ErrWrongIdentity = errors.New("envelope not encrypted to this identity")
+	// ErrWrongKey is returned when a random key does not match the envelope's key check.
+	ErrWrongKey = errors.New("wrong key")
+	// ErrTampered is returned when the key is correct but the ciphertext
+	// or its associated data fails authentication.
+	ErrTampered = errors.New("envelope failed authentication")
+	// ErrNotApproved is returned in FIPS mode for envelopes and operations that
+	// need an algorithm outside the FIPS 140-3 approved set.
+	ErrNotApproved = errors.New("not a FIPS approved algorithm")
+)
+
 type CryptoService struct {
-	SaltSize   int
-	NonceSize  int
-	KeyLength  uint32
-	Memory     uint32 // in KB (e.g., 64*1024 = 64MB)
-	Iterations uint32
-	Threads    uint8
+	SaltSize         int
+	KeyLength        uint32
+	Memory           uint32 // in KB (e.g., 64*1024 = 64MB)
+	Iterations       uint32
+	Threads          uint8
+	PBKDF2Iterations uint32
+	Padding          Padding
+	// FIPS restricts the service to approved algorithms: passphrase keys are derived
+	// with PBKDF2 instead of Argon2id, and recipient envelopes are refused.
+	FIPS bool
 }
 
 func NewCryptoService() *CryptoService {
 	return &CryptoService{
-		SaltSize:   16,
-		NonceSize:  12,
-		KeyLength:  32,        // AES-256
-		Memory:     64 * 1024, // 64MB
-		Iterations: 3,
-		Threads:    4,
+		SaltSize:         16,
+		KeyLength:        32,        // AES-256
+		Memory:           64 * 1024, // 64MB
+		Iterations:       3,
+		Threads:          4,
+		PBKDF2Iterations: 600_000,
+		Padding:          PaddingPadme,
 	}
 }
 
-func (cs *CryptoService) deriveKey(passphrase string, salt []byte) []byte {
-	return argon2.IDKey([]byte(passphrase), salt, cs.Iterations, cs.Memory, cs.Threads, cs.KeyLength)
-}
-
-func (cs *CryptoService) Encrypt(data []byte, passphrase string) ([]byte, error) {
+// newKDF picks the passphrase KDF of the active mode and returns it with fresh
+// material for it: a salt, and for PBKDF2 the iteration count.
+func (cs *CryptoService) newKDF() (mode byte, material []byte, err error) {
 	salt := make([]byte, cs.SaltSize)
 	if _, err := rand.Read(salt); err != nil {
-		return nil, err
+		return 0, nil, err
 	}
+	if !cs.FIPS {
+		return modePassphrase, salt, nil
+	}
+	return modePBKDF2, binary.BigEndian.AppendUint32(salt, cs.PBKDF2Iterations), nil
+}
+
+// newPassphraseKey derives a key for a new envelope with the KDF of the active mode,
+// returning the envelope mode and the key material to store with it.
+func (cs *CryptoService) newPassphraseKey(passphrase string) (mode byte, material, key []byte, err error) {
+	mode, material, err = cs.newKDF()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	key, err = cs.passphraseKey(mode, material, passphrase)
+	return mode, material, key, err
+}
+
+// passphraseKey derives the key of a passphrase envelope from its key material.
+func (cs *CryptoService) passphraseKey(mode byte, material []byte, passphrase string) ([]byte, error) {
+	passphrase = NormalizePassphrase(passphrase)
+	if mode == modePBKDF2 {
+		salt, iterations := material[:cs.SaltSize], binary.BigEndian.Uint32(material[cs.SaltSize:])
+		return pbkdf2.Key(sha256.New, passphrase, salt, int(iterations), int(cs.KeyLength))
+	}
+	return argon2.IDKey([]byte(passphrase), material, cs.Iterations, cs.Memory, cs.Threads, cs.KeyLength), nil
+}
+
+// splitKey expands the derived key into an encryption key and a key check value.
+// The check value lets Decrypt tell a wrong key apart from a tampered envelope.
+func (cs *CryptoService) splitKey(master []byte) (encKey, check []byte, err error) {
+	encKey, err = hkdf.Key(sha256.New, master, nil, "shhh encryption key", int(cs.KeyLength))
+	if err != nil {
+		return nil, nil, err
+	}
+	check, err = hkdf.Key(sha256.New, master, nil, "shhh key check", checkSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encKey, check, nil
+}
 
-	key := cs.deriveKey(passphrase, salt)
+// keyMaterialSize returns the length of the mode specific key material at the start of rest.
+func (cs *CryptoService) keyMaterialSize(mode byte, rest []byte) (int, error) {
+	switch mode {
+	case modePassphrase:
+		return cs.SaltSize, nil
+	case modePBKDF2:
+		return cs.SaltSize + 4, nil
+	case modeRecipient:
+		return recipientCiphertextSize, nil
+	case modeKey:
+		return 0, nil
+	case modeSlots:
+		return cs.slotsMaterialSize(rest)
+	case modePAKE:
+		return cs.SaltSize + pakeScalarSize + pakePointSize, nil
+	default:
+		return 0, errors.New("unsupported envelope mode")
+	}
+}
 
+func newGCM(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
+	return cipher.NewGCMWithRandomNonce(block)
+}
 
-	gcm, err := cipher.NewGCM(block)
+// Encrypt pads data and seals it under a key derived from passphrase. The envelope header
+// and aad are authenticated but not encrypted; the same aad must be passed to Decrypt.
+func (cs *CryptoService) Encrypt(data []byte, passphrase string, aad []byte) ([]byte, error) {
+	mode, material, key, err := cs.newPassphraseKey(passphrase)
 	if err != nil {
 		return nil, err
 	}
+	return cs.seal(mode, material, key, data, aad)
+}
 
-	nonce := make([]byte, cs.NonceSize)
-	if _, err := rand.Read(nonce); err != nil {
+// Decrypt opens an envelope produced by Encrypt, EncryptPAKE or EncryptSlots. It returns ErrWrongPassphrase
+// if the passphrase does not match, ErrDuress if it is a duress passphrase, and ErrTampered
+// if the envelope or aad was modified.
+func (cs *CryptoService) Decrypt(data []byte, passphrase string, aad []byte) ([]byte, error) {
+	env, err := cs.parse(data)
+	if err != nil {
 		return nil, err
 	}
+	var key []byte
+	switch env.mode {
+	case modePassphrase, modePBKDF2:
+		key, err = cs.passphraseKey(env.mode, env.keyMaterial, passphrase)
+	case modePAKE:
+		key, err = cs.passphraseKey(modePassphrase, env.keyMaterial[:cs.SaltSize], passphrase)
+	case modeSlots:
+		key, err = cs.openSlots(env.keyMaterial, passphrase)
+	default:
+		// derive anyway, so the mismatch takes as long as a wrong passphrase
+		if _, _, _, err := cs.newPassphraseKey(passphrase); err != nil {
+			return nil, err
+		}
+		return nil, ErrWrongPassphrase
+	}
+	if errors.Is(err, errKeyCheck) {
+		return nil, ErrWrongPassphrase
+	}
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := cs.open(env, key, aad)
+	if errors.Is(err, errKeyCheck) {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, err
+}
 
-	ciphertext := gcm.Seal(nil, nonce, data, nil)
+// EncryptTo pads data and seals it to a recipient's public key, so only the holder
+// of the matching identity can open it. It returns ErrNotApproved in FIPS mode.
+func (cs *CryptoService) EncryptTo(data []byte, recipient *Recipient, aad []byte) ([]byte, error) {
+	if cs.FIPS {
+		return nil, ErrNotApproved
+	}
+	ciphertext, shared, err := recipient.encapsulate()
+	if err != nil {
+		return nil, err
+	}
+	return cs.seal(modeRecipient, ciphertext, shared, data, aad)
+}
 
-	result := append(salt, nonce...)
-	result = append(result, ciphertext...)
-	return result, nil
+// DecryptWith opens an envelope produced by EncryptTo. It returns ErrWrongIdentity if
+// the envelope was sealed to another recipient and ErrTampered if it was modified.
+func (cs *CryptoService) DecryptWith(data []byte, identity *Identity, aad []byte) ([]byte, error) {
+	env, err := cs.parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if env.mode != modeRecipient {
+		return nil, ErrWrongIdentity
+	}
+	shared, err := identity.decapsulate(env.keyMaterial)
+	if err != nil {
+		return nil, ErrWrongIdentity
+	}
+	plaintext, err := cs.open(env, shared, aad)
+	if errors.Is(err, errKeyCheck) {
+		return nil, ErrWrongIdentity
+	}
+	return plaintext, err
 }
 
-func (cs *CryptoService) Decrypt(data []byte, passphrase string) ([]byte, error) {
-	if len(data) < cs.SaltSize+cs.NonceSize {
+// GenerateKey returns a random key for EncryptWithKey.
+func (cs *CryptoService) GenerateKey() ([]byte, error) {
+	key := make([]byte, cs.KeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// EncryptWithKey pads data and seals it under a random key from GenerateKey. The key
+// has full entropy, so it is used without a password hash.
+func (cs *CryptoService) EncryptWithKey(data, key, aad []byte) ([]byte, error) {
+	if len(key) != int(cs.KeyLength) {
+		return nil, errors.New("invalid key length")
+	}
+	return cs.seal(modeKey, nil, key, data, aad)
+}
+
+// DecryptWithKey opens an envelope produced by EncryptWithKey. It returns ErrWrongKey if
+// the key does not match and ErrTampered if the envelope or aad was modified.
+func (cs *CryptoService) DecryptWithKey(data, key, aad []byte) ([]byte, error) {
+	env, err := cs.parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if env.mode != modeKey || len(key) != int(cs.KeyLength) {
+		return nil, ErrWrongKey
+	}
+	plaintext, err := cs.open(env, key, aad)
+	if errors.Is(err, errKeyCheck) {
+		return nil, ErrWrongKey
+	}
+	return plaintext, err
+}
+
+// IsRecipientEnvelope reports whether data was sealed to a recipient public key.
+func IsRecipientEnvelope(data []byte) bool {
+	return len(data) > 1 && data[0] == envelopeVersion && data[1] == modeRecipient
+}
+
+// errKeyCheck is returned by open when the key check value doesn't match.
+var errKeyCheck = errors.New("key check mismatch")
+
+// envelope is a parsed envelope:
+// version | mode | key material | key check | nonce | ciphertext.
+type envelope struct {
+	mode        byte
+	keyMaterial []byte
+	check       []byte
+	ciphertext  []byte // nonce and sealed data, as produced by the AEAD
+	header      []byte // everything before the nonce, authenticated as associated data
+}
+
+// seal builds the envelope header and encrypts the padded data with a key derived from master.
+func (cs *CryptoService) seal(mode byte, keyMaterial, master, data, aad []byte) ([]byte, error) {
+	encKey, check, err := cs.splitKey(master)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	padded := cs.Padding.pad(data)
+	header := make([]byte, 0, 2+len(keyMaterial)+checkSize+len(padded)+gcm.Overhead())
+	header = append(header, envelopeVersion, mode)
+	header = append(header, keyMaterial...)
+	header = append(header, check...)
+
+	// the AEAD picks the nonce and writes it in front of the sealed data
+	return gcm.Seal(header, nil, padded, associatedData(header, aad)), nil
+}
+
+// parse splits an envelope into its parts without decrypting it.
+func (cs *CryptoService) parse(data []byte) (*envelope, error) {
+	if len(data) < 2 {
+		return nil, errors.New("ciphertext too short")
+	}
+	if data[0] != envelopeVersion {
+		return nil, errors.New("unsupported envelope version")
+	}
+	mode := data[1]
+	if cs.FIPS && mode != modePBKDF2 && mode != modeKey && (mode != modeSlots || len(data) < 3 || data[2] != modePBKDF2) {
+		return nil, ErrNotApproved
+	}
+	materialSize, err := cs.keyMaterialSize(mode, data[2:])
+	if err != nil {
+		return nil, err
+	}
+	headerSize := 2 + materialSize + checkSize
+	if len(data) < headerSize {
 		return nil, errors.New("ciphertext too short")
 	}
 
-	salt := data[:cs.SaltSize]
-	nonce := data[cs.SaltSize : cs.SaltSize+cs.NonceSize]
-	ciphertext := data[cs.SaltSize+cs.NonceSize:]
+	env := &envelope{mode: mode, header: data[:headerSize], ciphertext: data[headerSize:]}
+	env.keyMaterial, env.check = data[2:2+materialSize], data[2+materialSize:headerSize]
+	if err := cs.checkKDF(mode, env.keyMaterial); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
 
-	key := cs.deriveKey(passphrase, salt)
+// checkKDF rejects PBKDF2 material with an iteration count outside sane bounds.
+func (cs *CryptoService) checkKDF(mode byte, material []byte) error {
+	if mode == modeSlots {
+		mode, material = material[0], material[1:]
+	}
+	if mode == modePBKDF2 {
+		if n := binary.BigEndian.Uint32(material[cs.SaltSize:]); n == 0 || n > maxPBKDF2Iterations {
+			return errors.New("invalid PBKDF2 iteration count")
+		}
+	}
+	return nil
+}
 
-	block, err := aes.NewCipher(key)
+// open verifies the key check value and decrypts the envelope with a key derived from master.
+func (cs *CryptoService) open(env *envelope, master, aad []byte) ([]byte, error) {
+	encKey, check, err := cs.splitKey(master)
 	if err != nil {
 		return nil, err
 	}
+	if subtle.ConstantTimeCompare(check, env.check) != 1 {
+		return nil, errKeyCheck
+	}
 
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := newGCM(encKey)
 	if err != nil {
 		return nil, err
 	}
 
-	return gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := gcm.Open(nil, nil, env.ciphertext, associatedData(env.header, aad))
+	if err != nil {
+		return nil, ErrTampered
+	}
+	if plaintext, err = unpad(plaintext); err != nil {
+		return nil, ErrTampered
+	}
+	return plaintext, nil
+}
+
+// associatedData binds the envelope header to the caller supplied aad.
+func associatedData(header, aad []byte) []byte {
+	ad := make([]byte, 0, len(header)+len(aad))
+	ad = append(ad, header...)
+	return append(ad, aad...)
 }
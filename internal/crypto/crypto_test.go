@@ -2,6 +2,7 @@ package crypto
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 )
 
@@ -12,7 +13,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	plaintext := []byte("This is a top-secret message.")
 
 	// Encrypt
-	ciphertext, err := cs.Encrypt(plaintext, passphrase)
+	ciphertext, err := cs.Encrypt(plaintext, passphrase, nil)
 	if err != nil {
 		t.Fatalf("encryption failed: %v", err)
 	}
@@ -23,7 +24,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	}
 
 	// Decrypt
-	decrypted, err := cs.Decrypt(ciphertext, passphrase)
+	decrypted, err := cs.Decrypt(ciphertext, passphrase, nil)
 	if err != nil {
 		t.Fatalf("decryption failed: %v", err)
 	}
@@ -42,15 +43,15 @@ func TestDecryptWithWrongPassphrase(t *testing.T) {
 	data := []byte("Secret Message")
 
 	// Encrypt
-	ciphertext, err := cs.Encrypt(data, passphrase)
+	ciphertext, err := cs.Encrypt(data, passphrase, nil)
 	if err != nil {
 		t.Fatalf("encryption failed: %v", err)
 	}
 
 	// Attempt decryption with wrong passphrase
-	_, err = cs.Decrypt(ciphertext, wrongPass)
-	if err == nil {
-		t.Fatal("decryption should fail with wrong passphrase")
+	_, err = cs.Decrypt(ciphertext, wrongPass, nil)
+	if !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected ErrWrongPassphrase, got %v", err)
 	}
 }
 
@@ -58,12 +59,12 @@ func TestEncryptEmptyData(t *testing.T) {
 	cs := NewCryptoService()
 	passphrase := "any"
 
-	ciphertext, err := cs.Encrypt([]byte{}, passphrase)
+	ciphertext, err := cs.Encrypt([]byte{}, passphrase, nil)
 	if err != nil {
 		t.Fatalf("encrypting empty data failed: %v", err)
 	}
 
-	plaintext, err := cs.Decrypt(ciphertext, passphrase)
+	plaintext, err := cs.Decrypt(ciphertext, passphrase, nil)
 	if err != nil {
 		t.Fatalf("decrypting empty data failed: %v", err)
 	}
@@ -78,7 +79,7 @@ func TestDecryptWithCorruptedCiphertext(t *testing.T) {
 	passphrase := "secret"
 
 	plaintext := []byte("normal input")
-	ciphertext, err := cs.Encrypt(plaintext, passphrase)
+	ciphertext, err := cs.Encrypt(plaintext, passphrase, nil)
 	if err != nil {
 		t.Fatalf("encryption failed: %v", err)
 	}
@@ -86,8 +87,233 @@ func TestDecryptWithCorruptedCiphertext(t *testing.T) {
 	// Corrupt the ciphertext (flip a byte)
 	ciphertext[len(ciphertext)-1] ^= 0xFF
 
-	_, err = cs.Decrypt(ciphertext, passphrase)
-	if err == nil {
-		t.Fatal("decryption should fail with corrupted ciphertext")
+	_, err = cs.Decrypt(ciphertext, passphrase, nil)
+	if !errors.Is(err, ErrTampered) {
+		t.Fatalf("expected ErrTampered for corrupted ciphertext, got %v", err)
+	}
+}
+
+func TestDecryptWithMismatchedAssociatedData(t *testing.T) {
+	cs := NewCryptoService()
+	passphrase := "secret"
+
+	ciphertext, err := cs.Encrypt([]byte("bound payload"), passphrase, []byte("id-1|report.pdf"))
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+
+	_, err = cs.Decrypt(ciphertext, passphrase, []byte("id-2|report.pdf"))
+	if !errors.Is(err, ErrTampered) {
+		t.Fatalf("expected ErrTampered for mismatched associated data, got %v", err)
+	}
+
+	if _, err := cs.Decrypt(ciphertext, passphrase, []byte("id-1|report.pdf")); err != nil {
+		t.Fatalf("decryption with matching associated data failed: %v", err)
+	}
+}
+
+func TestEncryptDecryptWithKey(t *testing.T) {
+	cs := NewCryptoService()
+
+	key, err := cs.GenerateKey()
+	if err != nil {
+		t.Fatalf("key generation failed: %v", err)
+	}
+	ciphertext, err := cs.EncryptWithKey([]byte("link secret"), key, nil)
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+
+	plaintext, err := cs.DecryptWithKey(ciphertext, key, nil)
+	if err != nil {
+		t.Fatalf("decryption failed: %v", err)
+	}
+	if string(plaintext) != "link secret" {
+		t.Fatalf("expected %q, got %q", "link secret", plaintext)
+	}
+
+	otherKey, _ := cs.GenerateKey()
+	if _, err := cs.DecryptWithKey(ciphertext, otherKey, nil); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("expected ErrWrongKey, got %v", err)
+	}
+	if _, err := cs.Decrypt(ciphertext, "passphrase", nil); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected ErrWrongPassphrase for a key envelope, got %v", err)
+	}
+}
+
+func TestDecryptWithNormalizedPassphrase(t *testing.T) {
+	cs := NewCryptoService()
+
+	// "café" with a precomposed é (NFC), as typed on Windows
+	ciphertext, err := cs.Encrypt([]byte("data"), "caf\u00e9  au lait", nil)
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+
+	// e followed by a combining acute accent (NFD), as typed on macOS, with other whitespace
+	for _, passphrase := range []string{"cafe\u0301 au lait", " cafe\u0301 au\u00a0lait\n"} {
+		if _, err := cs.Decrypt(ciphertext, passphrase, nil); err != nil {
+			t.Errorf("decryption with %q failed: %v", passphrase, err)
+		}
+	}
+
+	if _, err := cs.Decrypt(ciphertext, "cafe au lait", nil); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("expected ErrWrongPassphrase without the accent, got %v", err)
+	}
+}
+
+func TestFIPSMode(t *testing.T) {
+	fips := NewCryptoService()
+	fips.FIPS = true
+	fips.PBKDF2Iterations = 1000
+
+	ciphertext, err := fips.Encrypt([]byte("approved"), "secure-passphrase", nil)
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+	if ciphertext[1] != modePBKDF2 {
+		t.Fatalf("expected PBKDF2 envelope, got mode %d", ciphertext[1])
+	}
+	if _, err := fips.Decrypt(ciphertext, "wrong-passphrase", nil); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("expected ErrWrongPassphrase, got %v", err)
+	}
+
+	// the KDF is recorded in the envelope, so a standard service can still open it
+	decrypted, err := NewCryptoService().Decrypt(ciphertext, "secure-passphrase", nil)
+	if err != nil {
+		t.Fatalf("decryption failed: %v", err)
+	}
+	if string(decrypted) != "approved" {
+		t.Errorf("got %q", decrypted)
+	}
+
+	argon, err := NewCryptoService().Encrypt([]byte("not approved"), "secure-passphrase", nil)
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+	if _, err := fips.Decrypt(argon, "secure-passphrase", nil); !errors.Is(err, ErrNotApproved) {
+		t.Errorf("expected ErrNotApproved for Argon2id envelope, got %v", err)
+	}
+
+	identity, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fips.EncryptTo([]byte("not approved"), identity.Recipient(), nil); !errors.Is(err, ErrNotApproved) {
+		t.Errorf("expected ErrNotApproved for recipient envelope, got %v", err)
+	}
+}
+
+func TestEncryptDecryptSlots(t *testing.T) {
+	cs := NewCryptoService()
+	passphrases := []string{"alice-passphrase", "bob-passphrase", "carol-passphrase"}
+	plaintext := []byte("team secret")
+
+	ciphertext, err := cs.EncryptSlots(plaintext, passphrases, nil, 8, []byte("aad"))
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+	for _, p := range passphrases {
+		decrypted, err := cs.Decrypt(ciphertext, p, []byte("aad"))
+		if err != nil {
+			t.Fatalf("decryption with %q failed: %v", p, err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("got %q, want %q", decrypted, plaintext)
+		}
+	}
+	if _, err := cs.Decrypt(ciphertext, "mallory-passphrase", []byte("aad")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("expected ErrWrongPassphrase, got %v", err)
+	}
+	if _, err := cs.Decrypt(ciphertext, "alice-passphrase", []byte("other")); !errors.Is(err, ErrTampered) {
+		t.Errorf("expected ErrTampered, got %v", err)
+	}
+
+	// the envelope size depends on the slot cap, not the number of passphrases
+	single, err := cs.EncryptSlots(plaintext, passphrases[:1], nil, 8, nil)
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+	if len(single) != len(ciphertext) {
+		t.Errorf("envelope sizes differ: %d and %d", len(single), len(ciphertext))
+	}
+
+	if _, err := cs.EncryptSlots(plaintext, passphrases, nil, 2, nil); err == nil {
+		t.Error("expected an error for more passphrases than slots")
+	}
+}
+
+func TestDecryptDuress(t *testing.T) {
+	cs := NewCryptoService()
+	passphrases := []string{"alice-passphrase", "bob-passphrase"}
+
+	quiet, err := cs.EncryptSlots([]byte("secret"), passphrases, &Duress{Passphrase: "duress-passphrase"}, 4, nil)
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+	if _, err := cs.Decrypt(quiet, "duress-passphrase", nil); !errors.Is(err, ErrDuress) || errors.Is(err, ErrDuressAlert) {
+		t.Errorf("expected ErrDuress without alert, got %v", err)
+	}
+	if _, err := cs.Decrypt(quiet, "alice-passphrase", nil); err != nil {
+		t.Errorf("decryption failed: %v", err)
+	}
+
+	alert, err := cs.EncryptSlots([]byte("secret"), passphrases, &Duress{Passphrase: "duress-passphrase", Alert: true}, 4, nil)
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+	if _, err := cs.Decrypt(alert, "duress-passphrase", nil); !errors.Is(err, ErrDuressAlert) {
+		t.Errorf("expected ErrDuressAlert, got %v", err)
+	}
+	if len(alert) != len(quiet) {
+		t.Errorf("envelope sizes differ: %d and %d", len(alert), len(quiet))
+	}
+
+	if _, err := cs.EncryptSlots([]byte("secret"), passphrases, &Duress{Passphrase: " bob-passphrase"}, 4, nil); err == nil {
+		t.Error("expected an error for a duress passphrase equal to a passphrase")
+	}
+	if _, err := cs.EncryptSlots([]byte("secret"), passphrases, &Duress{Passphrase: "duress-passphrase"}, 2, nil); err == nil {
+		t.Error("expected an error when the duress slot doesn't fit")
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	key, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseSigningKey(key.String())
+	if err != nil {
+		t.Fatalf("can't parse signing key: %v", err)
+	}
+	pub, err := ParseVerifyingKey(parsed.Public().String())
+	if err != nil {
+		t.Fatalf("can't parse verifying key: %v", err)
+	}
+
+	data := []byte("wire the funds")
+	sig := parsed.Sign("alice", data)
+	if !pub.Verify("alice", data, sig) {
+		t.Error("valid signature didn't verify")
+	}
+	if pub.Verify("mallory", data, sig) {
+		t.Error("signature verified for another sender")
+	}
+	if pub.Verify("alice", []byte("wire the funds to me"), sig) {
+		t.Error("signature verified for other content")
+	}
+
+	ts, err := ParseTrustStore("# team\nalice " + pub.String() + "\n")
+	if err != nil {
+		t.Fatalf("can't parse trust store: %v", err)
+	}
+	if !ts.Trusts("alice", pub) {
+		t.Error("trust store doesn't trust alice's key")
+	}
+	if ts.Trusts("bob", pub) {
+		t.Error("trust store trusts alice's key for bob")
+	}
+	if _, err := ParseTrustStore("not a valid line"); err == nil {
+		t.Error("expected an error for a malformed trust store")
 	}
 }
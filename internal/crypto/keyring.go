@@ -0,0 +1,123 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// wrapVersion is the first byte of every envelope wrapped by a Keyring.
+// Since version 2 the nonce is generated by the AEAD and left out of the associated data.
+const wrapVersion byte = 2
+
+// ErrUnknownKeyVersion is returned when an envelope was wrapped with a master key
+// that is not in the keyring.
+var ErrUnknownKeyVersion = errors.New("unknown master key version")
+
+// Keyring holds versioned server master keys. Envelopes are wrapped with the newest
+// key, and every key in the ring can unwrap, so keys can be rotated by adding a new
+// version and rekeying stored envelopes before the old one is removed.
+type Keyring struct {
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// ParseKeyring parses master keys in "version:base64key" form, separated by newlines
+// or commas. Blank lines and lines starting with # are ignored. Keys must be 32 bytes.
+func ParseKeyring(s string) (*Keyring, error) {
+	kr := &Keyring{keys: make(map[uint32][]byte)}
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		v, k, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, errors.New("master key must be in version:base64key form")
+		}
+		version, err := strconv.ParseUint(strings.TrimSpace(v), 10, 32)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("invalid master key version %q", v)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(k))
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key %d: %w", version, err)
+		}
+		if err := kr.add(uint32(version), key); err != nil {
+			return nil, err
+		}
+	}
+	if len(kr.keys) == 0 {
+		return nil, errors.New("no master keys found")
+	}
+	return kr, nil
+}
+
+func (kr *Keyring) add(version uint32, key []byte) error {
+	if len(key) != 32 {
+		return fmt.Errorf("master key %d must be 32 bytes, got %d", version, len(key))
+	}
+	if _, ok := kr.keys[version]; ok {
+		return fmt.Errorf("duplicate master key version %d", version)
+	}
+	kr.keys[version] = key
+	kr.current = max(kr.current, version)
+	return nil
+}
+
+// Current returns the version of the key new envelopes are wrapped with.
+func (kr *Keyring) Current() uint32 {
+	return kr.current
+}
+
+// Wrap encrypts an envelope with the current master key. The result is
+// version | key version | nonce | ciphertext, with aad bound to it.
+func (kr *Keyring) Wrap(envelope, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(kr.keys[kr.current])
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, 5+len(envelope)+gcm.Overhead())
+	header = append(header, wrapVersion)
+	header = binary.BigEndian.AppendUint32(header, kr.current)
+
+	return gcm.Seal(header, nil, envelope, associatedData(header, aad)), nil
+}
+
+// Unwrap reverses Wrap with whichever key version the envelope was wrapped with.
+func (kr *Keyring) Unwrap(wrapped, aad []byte) ([]byte, error) {
+	version, err := WrappedKeyVersion(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := kr.keys[version]
+	if !ok {
+		return nil, ErrUnknownKeyVersion
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := wrapped[:5]
+	envelope, err := gcm.Open(nil, nil, wrapped[5:], associatedData(header, aad))
+	if err != nil {
+		return nil, ErrTampered
+	}
+	return envelope, nil
+}
+
+// WrappedKeyVersion returns the master key version a wrapped envelope was sealed with.
+func WrappedKeyVersion(wrapped []byte) (uint32, error) {
+	if len(wrapped) < 5 {
+		return 0, errors.New("wrapped envelope too short")
+	}
+	if wrapped[0] != wrapVersion {
+		return 0, errors.New("unsupported wrapped envelope version")
+	}
+	return binary.BigEndian.Uint32(wrapped[1:5]), nil
+}
@@ -0,0 +1,72 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestParseKeyring(t *testing.T) {
+	kr, err := ParseKeyring(fmt.Sprintf("# master keys\n1:%s\n3:%s\n", testKey(1), testKey(3)))
+	if err != nil {
+		t.Fatalf("ParseKeyring failed: %v", err)
+	}
+	if kr.Current() != 3 {
+		t.Errorf("expected current version 3, got %d", kr.Current())
+	}
+
+	for _, bad := range []string{"", "1:" + testKey(1) + ",1:" + testKey(2), "0:" + testKey(1), "1:c2hvcnQ=", "nokey"} {
+		if _, err := ParseKeyring(bad); err == nil {
+			t.Errorf("ParseKeyring(%q) should fail", bad)
+		}
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	oldRing, err := ParseKeyring("1:" + testKey(1))
+	if err != nil {
+		t.Fatalf("ParseKeyring failed: %v", err)
+	}
+	newRing, err := ParseKeyring("1:" + testKey(1) + ",2:" + testKey(2))
+	if err != nil {
+		t.Fatalf("ParseKeyring failed: %v", err)
+	}
+
+	envelope := []byte("envelope bytes")
+	aad := []byte("item-id")
+
+	wrapped, err := oldRing.Wrap(envelope, aad)
+	if err != nil {
+		t.Fatalf("Wrap failed: %v", err)
+	}
+
+	// the rotated ring still opens envelopes wrapped with the old key
+	got, err := newRing.Unwrap(wrapped, aad)
+	if err != nil {
+		t.Fatalf("Unwrap with rotated keyring failed: %v", err)
+	}
+	if !bytes.Equal(got, envelope) {
+		t.Errorf("expected %q, got %q", envelope, got)
+	}
+
+	rewrapped, err := newRing.Wrap(got, aad)
+	if err != nil {
+		t.Fatalf("Wrap failed: %v", err)
+	}
+	if v, _ := WrappedKeyVersion(rewrapped); v != 2 {
+		t.Errorf("expected key version 2, got %d", v)
+	}
+
+	if _, err := oldRing.Unwrap(rewrapped, aad); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Errorf("expected ErrUnknownKeyVersion, got %v", err)
+	}
+	if _, err := newRing.Unwrap(rewrapped, []byte("other-id")); !errors.Is(err, ErrTampered) {
+		t.Errorf("expected ErrTampered for mismatched aad, got %v", err)
+	}
+}
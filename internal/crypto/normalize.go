@@ -0,0 +1,16 @@
+package crypto
+
+import (
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizePassphrase returns the form of a passphrase that keys are derived from since
+// envelope version 4: NFKC normalized, without leading or trailing whitespace, and with
+// inner runs of whitespace collapsed to a single space. The same passphrase typed on
+// different systems (NFD on macOS, NFC on Windows, full-width forms, non-breaking
+// spaces) then derives the same key.
+func NormalizePassphrase(passphrase string) string {
+	return strings.Join(strings.Fields(norm.NFKC.String(passphrase)), " ")
+}
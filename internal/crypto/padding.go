@@ -0,0 +1,85 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Padding selects the size buckets plaintexts are padded to before encryption,
+// so that ciphertext lengths don't reveal exact secret lengths.
+type Padding string
+
+const (
+	// PaddingNone only adds the one byte padding marker.
+	PaddingNone Padding = "none"
+	// PaddingPadme pads to Padmé buckets, leaking O(log log n) bits of the length
+	// with at most ~12% overhead.
+	PaddingPadme Padding = "padme"
+	// PaddingPowerOfTwo pads to the next power of two.
+	PaddingPowerOfTwo Padding = "pow2"
+)
+
+// minPaddedSize is the smallest bucket, so all short secrets look the same.
+const minPaddedSize = 256
+
+// ParsePadding returns the padding scheme with the given name.
+func ParsePadding(name string) (Padding, error) {
+	switch p := Padding(name); p {
+	case PaddingNone, PaddingPadme, PaddingPowerOfTwo:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown padding scheme %q", name)
+	}
+}
+
+// Size returns the padded size for n bytes of content.
+func (p Padding) Size(n int) int {
+	switch p {
+	case PaddingPadme:
+		return max(padme(n), minPaddedSize)
+	case PaddingPowerOfTwo:
+		if n <= minPaddedSize {
+			return minPaddedSize
+		}
+		return 1 << bits.Len(uint(n-1))
+	default:
+		return n
+	}
+}
+
+// padme implements the Padmé function from "Reducing Metadata Leakage from
+// Encrypted Files and Communication with PURBs".
+func padme(n int) int {
+	if n < 2 {
+		return n
+	}
+	e := bits.Len(uint(n)) - 1
+	s := bits.Len(uint(e))
+	mask := 1<<(e-s) - 1
+	return (n + mask) &^ mask
+}
+
+// pad appends an 0x80 marker followed by zeros up to the bucket size (ISO/IEC 7816-4),
+// so it can be stripped unambiguously.
+func (p Padding) pad(data []byte) []byte {
+	size := p.Size(len(data) + 1)
+	padded := make([]byte, size)
+	copy(padded, data)
+	padded[len(data)] = 0x80
+	return padded
+}
+
+// unpad strips the padding added by pad.
+func unpad(data []byte) ([]byte, error) {
+	for i := len(data) - 1; i >= 0; i-- {
+		switch data[i] {
+		case 0x00:
+			continue
+		case 0x80:
+			return data[:i], nil
+		}
+		break
+	}
+	return nil, errors.New("invalid padding")
+}
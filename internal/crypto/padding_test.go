@@ -0,0 +1,62 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPaddingSize(t *testing.T) {
+	tests := []struct {
+		padding Padding
+		in      int
+		want    int
+	}{
+		{PaddingNone, 9, 9},
+		{PaddingPadme, 9, 256},
+		{PaddingPadme, 1000, 1024},
+		{PaddingPadme, 1025, 1088},
+		{PaddingPowerOfTwo, 9, 256},
+		{PaddingPowerOfTwo, 257, 512},
+		{PaddingPowerOfTwo, 1024, 1024},
+	}
+
+	for _, tt := range tests {
+		if got := tt.padding.Size(tt.in); got != tt.want {
+			t.Errorf("%s.Size(%d) = %d, want %d", tt.padding, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPadUnpad(t *testing.T) {
+	for _, data := range [][]byte{{}, []byte("pass"), {0x80, 0x00}, bytes.Repeat([]byte{0x00}, 300)} {
+		padded := PaddingPadme.pad(data)
+		got, err := unpad(padded)
+		if err != nil {
+			t.Fatalf("unpad failed: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("unpad(pad(%x)) = %x", data, got)
+		}
+	}
+
+	if _, err := unpad([]byte{0x01, 0x00}); err == nil {
+		t.Error("unpad should fail without a padding marker")
+	}
+}
+
+func TestEncryptHidesLength(t *testing.T) {
+	cs := NewCryptoService()
+
+	short, err := cs.Encrypt([]byte("12345678"), "passphrase", nil)
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+	long, err := cs.Encrypt([]byte("a somewhat longer secret of forty bytes!"), "passphrase", nil)
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+
+	if len(short) != len(long) {
+		t.Errorf("expected equal ciphertext lengths, got %d and %d", len(short), len(long))
+	}
+}
@@ -0,0 +1,460 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+
+	"filippo.io/bigmod"
+	"filippo.io/nistec"
+)
+
+// PAKE envelopes can be opened through a SPAKE2+ exchange on P-256, following RFC 9383.
+// The client derives the scalars w0 and w1 from the passphrase; the envelope header holds
+// the verifier, w0 and L = w1·G, which lets the server check that the client knows the
+// passphrase without ever learning it. Once both sides have confirmed the exchange, the
+// server hands out the envelope sealed with the shared key and the client opens it locally.
+
+// Encoded sizes of P-256 scalars and uncompressed points.
+const (
+	pakeScalarSize = 32
+	pakePointSize  = 65
+)
+
+// pakeContext is the protocol context bound into every exchange's transcript.
+const pakeContext = "shhh pake v1"
+
+var (
+	// pakeM and pakeN are the P-256 constants of RFC 9383, points with no known discrete logarithm.
+	pakeM = mustDecodeCompressed("02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f")
+	pakeN = mustDecodeCompressed("03d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b49")
+
+	// pakeOrder is the order of the P-256 group, and pakeR is 2^256 modulo it, used to
+	// reduce values wider than a scalar.
+	pakeOrder = mustModulus("ffffffff00000000ffffffffffffffffbce6faada7179e84f3b9cac2fc632551")
+	pakeR     = mustNat("00000000ffffffff00000000000000004319055258e8617b0c46353d039cdaaf")
+)
+
+// ErrServerProof is returned by PAKEClient.Open when the server didn't prove it holds
+// the passphrase verifier, so what it sent can't be trusted.
+var ErrServerProof = errors.New("server failed to confirm the exchange")
+
+// point is a P-256 point. Its arithmetic is constant time, and so is the scalar
+// arithmetic below, since the scalars derive from the passphrase.
+type point struct {
+	p *nistec.P256Point
+}
+
+func mustDecodeCompressed(s string) point {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	p, err := nistec.NewP256Point().SetBytes(b)
+	if err != nil {
+		panic("invalid point " + s)
+	}
+	return point{p}
+}
+
+func mustModulus(s string) *bigmod.Modulus {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	m, err := bigmod.NewModulus(b)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func mustNat(s string) *bigmod.Nat {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	n, err := bigmod.NewNat().SetBytes(b, pakeOrder)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// decodePoint parses an uncompressed point, rejecting points off the curve.
+func decodePoint(b []byte) (point, error) {
+	if len(b) != pakePointSize {
+		return point{}, errors.New("invalid point")
+	}
+	p, err := nistec.NewP256Point().SetBytes(b)
+	if err != nil {
+		return point{}, errors.New("invalid point")
+	}
+	return point{p}, nil
+}
+
+func (p point) bytes() []byte {
+	return p.p.Bytes()
+}
+
+func (p point) isIdentity() bool {
+	// the identity is the only point encoded as a single byte
+	return len(p.p.Bytes()) == 1
+}
+
+func (p point) add(q point) point {
+	return point{nistec.NewP256Point().Add(p.p, q.p)}
+}
+
+// mul returns k·p. Scalars are always 32 bytes here, the only length ScalarMult rejects.
+func (p point) mul(k []byte) point {
+	r, err := nistec.NewP256Point().ScalarMult(p.p, k)
+	if err != nil {
+		panic(err)
+	}
+	return point{r}
+}
+
+func baseMul(k []byte) point {
+	r, err := nistec.NewP256Point().ScalarBaseMult(k)
+	if err != nil {
+		panic(err)
+	}
+	return point{r}
+}
+
+// negateScalar returns -k modulo the group order, so that p - k·q is p + (-k)·q.
+func negateScalar(k []byte) ([]byte, error) {
+	x, err := bigmod.NewNat().SetBytes(k, pakeOrder)
+	if err != nil {
+		return nil, err
+	}
+	return bigmod.NewNat().ExpandFor(pakeOrder).Sub(x, pakeOrder).Bytes(pakeOrder), nil
+}
+
+// randomScalar returns a random nonzero scalar k and k·G.
+func randomScalar() ([]byte, point, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, point{}, err
+	}
+	p, err := decodePoint(key.PublicKey().Bytes())
+	return key.Bytes(), p, err
+}
+
+// pakeScalars derives w0 and w1 from the passphrase key. Extra bytes are reduced
+// modulo the group order, so the result is close to uniform.
+func pakeScalars(master []byte) (w0, w1 []byte, err error) {
+	derive := func(label string) ([]byte, error) {
+		b, err := hkdf.Key(sha256.New, master, nil, label, pakeScalarSize+8)
+		if err != nil {
+			return nil, err
+		}
+		return reduceScalar(b)
+	}
+	if w0, err = derive("shhh pake w0"); err != nil {
+		return nil, nil, err
+	}
+	if w1, err = derive("shhh pake w1"); err != nil {
+		return nil, nil, err
+	}
+	return w0, w1, nil
+}
+
+// reduceScalar reduces a value of up to 64 bytes modulo the group order, as
+// hi·2^256 + lo with lo its last 32 bytes.
+func reduceScalar(b []byte) ([]byte, error) {
+	split := max(len(b)-pakeScalarSize, 0)
+	hi, err := bigmod.NewNat().SetOverflowingBytes(b[:split], pakeOrder)
+	if err != nil {
+		return nil, err
+	}
+	lo, err := bigmod.NewNat().SetOverflowingBytes(b[split:], pakeOrder)
+	if err != nil {
+		return nil, err
+	}
+	return hi.Mul(pakeR, pakeOrder).Add(lo, pakeOrder).Bytes(pakeOrder), nil
+}
+
+// pakeKeys hashes the exchange transcript into the confirmation MACs of both sides
+// and the shared key.
+func pakeKeys(context, shareP, shareV []byte, z, v point, w0 []byte) (confirmP, confirmV, key []byte, err error) {
+	var tt []byte
+	for _, b := range [][]byte{context, nil, nil, pakeM.bytes(), pakeN.bytes(), shareP, shareV, z.bytes(), v.bytes(), w0} {
+		tt = binary.LittleEndian.AppendUint64(tt, uint64(len(b)))
+		tt = append(tt, b...)
+	}
+	main := sha256.Sum256(tt)
+	confirmKeys, err := hkdf.Key(sha256.New, main[:], nil, "ConfirmationKeys", 2*sha256.Size)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if key, err = hkdf.Key(sha256.New, main[:], nil, "SharedKey", sha256.Size); err != nil {
+		return nil, nil, nil, err
+	}
+	mac := hmac.New(sha256.New, confirmKeys[:sha256.Size])
+	mac.Write(shareV)
+	confirmP = mac.Sum(nil)
+	mac = hmac.New(sha256.New, confirmKeys[sha256.Size:])
+	mac.Write(shareP)
+	return confirmP, mac.Sum(nil), key, nil
+}
+
+// pakeTranscriptContext binds an exchange to the protocol and to what the caller is
+// retrieving, so a transcript can't be replayed for another secret.
+func pakeTranscriptContext(context []byte) []byte {
+	return append([]byte(pakeContext+"\x00"), context...)
+}
+
+// EncryptPAKE pads data and seals it like Encrypt, and also stores a SPAKE2+ verifier of
+// the passphrase in the envelope header. Such an envelope can still be opened with Decrypt,
+// and also through PAKEServer and PAKEClient without the passphrase leaving the client.
+// The verifier is no more use to an attacker than the envelope itself: testing a guess
+// against it costs the same Argon2id derivation. It returns ErrNotApproved in FIPS mode.
+func (cs *CryptoService) EncryptPAKE(data []byte, passphrase string, aad []byte) ([]byte, error) {
+	if cs.FIPS {
+		return nil, ErrNotApproved
+	}
+	salt := make([]byte, cs.SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	master, err := cs.passphraseKey(modePassphrase, salt, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	w0, w1, err := pakeScalars(master)
+	if err != nil {
+		return nil, err
+	}
+
+	material := make([]byte, 0, len(salt)+pakeScalarSize+pakePointSize)
+	material = append(material, salt...)
+	material = append(material, w0...)
+	material = append(material, baseMul(w1).bytes()...)
+	return cs.seal(modePAKE, material, master, data, aad)
+}
+
+// PAKEServer is the server side of one SPAKE2+ exchange for a PAKE envelope. It must
+// not be reused: every exchange allows the client a single passphrase guess.
+type PAKEServer struct {
+	salt    []byte
+	context []byte
+	w0      []byte
+	l       point
+	y       []byte
+	share   []byte
+	key     []byte // shared key, set once Finish succeeded
+}
+
+// NewPAKEServer starts an exchange for an envelope produced by EncryptPAKE. The context
+// must be the one the client uses, typically the ID of what is being retrieved.
+func (cs *CryptoService) NewPAKEServer(envelope, context []byte) (*PAKEServer, error) {
+	env, err := cs.parse(envelope)
+	if err != nil {
+		return nil, err
+	}
+	if env.mode != modePAKE {
+		return nil, errors.New("envelope can't be opened with PAKE")
+	}
+	salt, verifier := env.keyMaterial[:cs.SaltSize], env.keyMaterial[cs.SaltSize:]
+	l, err := decodePoint(verifier[pakeScalarSize:])
+	if err != nil {
+		return nil, err
+	}
+	return newPAKEServer(salt, verifier[:pakeScalarSize], l, context)
+}
+
+// NewDecoyPAKEServer starts an exchange against a random verifier, which no passphrase
+// confirms. It lets a server answer for secrets it doesn't have exactly like for those
+// it does, with salt standing in for the envelope's.
+func (cs *CryptoService) NewDecoyPAKEServer(salt, context []byte) (*PAKEServer, error) {
+	if cs.FIPS {
+		return nil, ErrNotApproved
+	}
+	w0, _, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+	_, l, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+	return newPAKEServer(salt, w0, l, context)
+}
+
+func newPAKEServer(salt, w0 []byte, l point, context []byte) (*PAKEServer, error) {
+	y, yG, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+	return &PAKEServer{
+		salt:    salt,
+		context: pakeTranscriptContext(context),
+		w0:      w0,
+		l:       l,
+		y:       y,
+		share:   yG.add(pakeN.mul(w0)).bytes(),
+	}, nil
+}
+
+// Salt returns the passphrase salt the client needs to derive its scalars.
+func (s *PAKEServer) Salt() []byte {
+	return s.salt
+}
+
+// Share returns the server's share, sent to the client with the salt.
+func (s *PAKEServer) Share() []byte {
+	return s.share
+}
+
+// Finish checks the client's share and confirmation. It returns ErrWrongPassphrase if
+// the client doesn't know the passphrase, and otherwise the server's confirmation,
+// which proves to the client that the server holds the verifier.
+func (s *PAKEServer) Finish(share, confirm []byte) ([]byte, error) {
+	x, err := decodePoint(share)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	negW0, err := negateScalar(s.w0)
+	if err != nil {
+		return nil, err
+	}
+	t := x.add(pakeM.mul(negW0))
+	z, v := t.mul(s.y), s.l.mul(s.y)
+	if z.isIdentity() || v.isIdentity() {
+		return nil, ErrWrongPassphrase
+	}
+	confirmP, confirmV, key, err := pakeKeys(s.context, share, s.share, z, v, s.w0)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(confirm, confirmP) {
+		return nil, ErrWrongPassphrase
+	}
+	s.key = key
+	return confirmV, nil
+}
+
+// Seal encrypts the envelope for the client with the key shared by a finished exchange.
+func (s *PAKEServer) Seal(envelope []byte) ([]byte, error) {
+	if s.key == nil {
+		return nil, errors.New("PAKE exchange not finished")
+	}
+	gcm, err := newGCM(s.key)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nil, nil, envelope, nil), nil
+}
+
+// PAKEClient is the client side of a SPAKE2+ exchange, which opens a PAKE envelope
+// held by a server without sending it the passphrase.
+type PAKEClient struct {
+	cs       *CryptoService
+	context  []byte
+	master   []byte
+	w0, w1   []byte
+	x        []byte
+	share    []byte
+	confirmV []byte
+	key      []byte
+}
+
+// NewPAKEClient derives the client's scalars from passphrase and the salt sent by the
+// server. This is where the Argon2id derivation happens.
+func (cs *CryptoService) NewPAKEClient(salt []byte, passphrase string, context []byte) (*PAKEClient, error) {
+	if cs.FIPS {
+		return nil, ErrNotApproved
+	}
+	if len(salt) != cs.SaltSize {
+		return nil, errors.New("invalid salt")
+	}
+	master, err := cs.passphraseKey(modePassphrase, salt, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	w0, w1, err := pakeScalars(master)
+	if err != nil {
+		return nil, err
+	}
+	x, xG, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+	return &PAKEClient{
+		cs:      cs,
+		context: pakeTranscriptContext(context),
+		master:  master,
+		w0:      w0,
+		w1:      w1,
+		x:       x,
+		share:   xG.add(pakeM.mul(w0)).bytes(),
+	}, nil
+}
+
+// Share returns the client's share.
+func (c *PAKEClient) Share() []byte {
+	return c.share
+}
+
+// Confirm processes the server's share and returns the client's confirmation,
+// which is sent to the server together with the client's share.
+func (c *PAKEClient) Confirm(serverShare []byte) ([]byte, error) {
+	y, err := decodePoint(serverShare)
+	if err != nil {
+		return nil, errors.New("invalid server share")
+	}
+	negW0, err := negateScalar(c.w0)
+	if err != nil {
+		return nil, err
+	}
+	t := y.add(pakeN.mul(negW0))
+	z, v := t.mul(c.x), t.mul(c.w1)
+	if z.isIdentity() || v.isIdentity() {
+		return nil, errors.New("invalid server share")
+	}
+	confirmP, confirmV, key, err := pakeKeys(c.context, c.share, serverShare, z, v, c.w0)
+	if err != nil {
+		return nil, err
+	}
+	c.confirmV, c.key = confirmV, key
+	return confirmP, nil
+}
+
+// Open checks the server's confirmation and decrypts the envelope it sealed with
+// PAKEServer.Seal, using the key derived from the passphrase. The aad must be the one
+// the envelope was encrypted with.
+func (c *PAKEClient) Open(confirm, sealed, aad []byte) ([]byte, error) {
+	if c.key == nil {
+		return nil, errors.New("PAKE exchange not confirmed")
+	}
+	if !hmac.Equal(confirm, c.confirmV) {
+		return nil, ErrServerProof
+	}
+	gcm, err := newGCM(c.key)
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := gcm.Open(nil, nil, sealed, nil)
+	if err != nil {
+		return nil, ErrTampered
+	}
+	env, err := c.cs.parse(envelope)
+	if err != nil {
+		return nil, err
+	}
+	if env.mode != modePAKE {
+		return nil, ErrTampered
+	}
+	plaintext, err := c.cs.open(env, c.master, aad)
+	if errors.Is(err, errKeyCheck) {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, err
+}
@@ -0,0 +1,180 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// exchange runs a PAKE exchange for envelope and returns what the client opened.
+func exchange(t *testing.T, cs *CryptoService, envelope []byte, passphrase string, aad []byte) ([]byte, error) {
+	t.Helper()
+	server, err := cs.NewPAKEServer(envelope, []byte("id"))
+	if err != nil {
+		t.Fatalf("server start failed: %v", err)
+	}
+	client, err := cs.NewPAKEClient(server.Salt(), passphrase, []byte("id"))
+	if err != nil {
+		t.Fatalf("client start failed: %v", err)
+	}
+	confirm, err := client.Confirm(server.Share())
+	if err != nil {
+		t.Fatalf("client confirm failed: %v", err)
+	}
+	serverConfirm, err := server.Finish(client.Share(), confirm)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := server.Seal(envelope)
+	if err != nil {
+		t.Fatalf("seal failed: %v", err)
+	}
+	return client.Open(serverConfirm, sealed, aad)
+}
+
+func TestPAKE(t *testing.T) {
+	cs := NewCryptoService()
+	aad := []byte("item")
+	envelope, err := cs.EncryptPAKE([]byte("secret"), "correct horse", aad)
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+
+	got, err := exchange(t, cs, envelope, " correct  horse ", aad)
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if !bytes.Equal(got, []byte("secret")) {
+		t.Errorf("got %q", got)
+	}
+
+	if _, err := exchange(t, cs, envelope, "wrong horse", aad); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("expected ErrWrongPassphrase, got %v", err)
+	}
+
+	// a PAKE envelope still opens with the passphrase
+	if got, err := cs.Decrypt(envelope, "correct horse", aad); err != nil || !bytes.Equal(got, []byte("secret")) {
+		t.Errorf("Decrypt = %q, %v", got, err)
+	}
+}
+
+func TestPAKEContext(t *testing.T) {
+	cs := NewCryptoService()
+	envelope, err := cs.EncryptPAKE([]byte("secret"), "passphrase", nil)
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+
+	server, err := cs.NewPAKEServer(envelope, []byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := cs.NewPAKEClient(server.Salt(), "passphrase", []byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirm, err := client.Confirm(server.Share())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Finish(client.Share(), confirm); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("exchange with another context should fail, got %v", err)
+	}
+}
+
+func TestPAKEServerProof(t *testing.T) {
+	cs := NewCryptoService()
+	envelope, err := cs.EncryptPAKE([]byte("secret"), "passphrase", nil)
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+
+	// a server without the verifier can't produce a confirmation the client accepts
+	decoy, err := cs.NewDecoyPAKEServer(envelope[2:2+cs.SaltSize], []byte("id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := cs.NewPAKEClient(decoy.Salt(), "passphrase", []byte("id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Confirm(decoy.Share()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Open(make([]byte, 32), nil, nil); !errors.Is(err, ErrServerProof) {
+		t.Errorf("expected ErrServerProof, got %v", err)
+	}
+}
+
+func TestPAKEFIPS(t *testing.T) {
+	cs := NewCryptoService()
+	envelope, err := cs.EncryptPAKE([]byte("secret"), "passphrase", nil)
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+
+	cs.FIPS = true
+	if _, err := cs.EncryptPAKE([]byte("secret"), "passphrase", nil); !errors.Is(err, ErrNotApproved) {
+		t.Errorf("EncryptPAKE in FIPS mode: expected ErrNotApproved, got %v", err)
+	}
+	if _, err := cs.NewPAKEServer(envelope, nil); !errors.Is(err, ErrNotApproved) {
+		t.Errorf("NewPAKEServer in FIPS mode: expected ErrNotApproved, got %v", err)
+	}
+}
+
+func TestPAKEScalarArithmetic(t *testing.T) {
+	order, _ := new(big.Int).SetString("ffffffff00000000ffffffffffffffffbce6faada7179e84f3b9cac2fc632551", 16)
+	inputs := [][]byte{
+		make([]byte, pakeScalarSize+8),
+		bytes.Repeat([]byte{0xff}, pakeScalarSize+8),
+		order.FillBytes(make([]byte, pakeScalarSize+8)),
+	}
+	for range 50 {
+		b := make([]byte, pakeScalarSize+8)
+		rand.Read(b)
+		inputs = append(inputs, b)
+	}
+
+	for _, b := range inputs {
+		got, err := reduceScalar(b)
+		if err != nil {
+			t.Fatalf("reduceScalar(%x): %v", b, err)
+		}
+		want := new(big.Int).Mod(new(big.Int).SetBytes(b), order)
+		if !bytes.Equal(got, want.FillBytes(make([]byte, pakeScalarSize))) {
+			t.Fatalf("reduceScalar(%x) = %x, want %x", b, got, want)
+		}
+
+		neg, err := negateScalar(got)
+		if err != nil {
+			t.Fatalf("negateScalar(%x): %v", got, err)
+		}
+		want.Mod(want.Neg(want), order)
+		if !bytes.Equal(neg, want.FillBytes(make([]byte, pakeScalarSize))) {
+			t.Fatalf("negateScalar(%x) = %x, want %x", got, neg, want)
+		}
+	}
+}
+
+func TestPAKERejectsInvalidShares(t *testing.T) {
+	cs := NewCryptoService()
+	envelope, err := cs.EncryptPAKE([]byte("secret"), "passphrase", nil)
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+	server, err := cs.NewPAKEServer(envelope, []byte("id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offCurve := append([]byte{4}, make([]byte, pakePointSize-1)...)
+	offCurve[pakePointSize-1] = 1
+	compressed := pakeM.p.BytesCompressed()
+	for _, share := range [][]byte{nil, {0}, offCurve, compressed} {
+		if _, err := server.Finish(share, make([]byte, 32)); !errors.Is(err, ErrWrongPassphrase) {
+			t.Errorf("Finish with share %x: expected ErrWrongPassphrase, got %v", share, err)
+		}
+	}
+}
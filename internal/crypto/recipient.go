@@ -0,0 +1,162 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha3"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+const (
+	recipientPrefix = "shhhpub1:"
+	identityPrefix  = "SHHH-SECRET-KEY-1:"
+
+	// recipientCiphertextSize is the ephemeral X25519 public key followed by the ML-KEM-768 ciphertext.
+	recipientCiphertextSize = 32 + mlkem.CiphertextSize768
+
+	// hybridLabel is the domain separator of the X25519 + ML-KEM-768 combiner.
+	hybridLabel = "shhh hybrid x25519 mlkem768"
+)
+
+// Recipient is a hybrid X25519 + ML-KEM-768 public key secrets can be encrypted to.
+type Recipient struct {
+	x25519 *ecdh.PublicKey
+	mlkem  *mlkem.EncapsulationKey768
+}
+
+// Identity is the private key matching a Recipient.
+type Identity struct {
+	x25519 *ecdh.PrivateKey
+	mlkem  *mlkem.DecapsulationKey768
+}
+
+// GenerateIdentity creates a new random identity.
+func GenerateIdentity() (*Identity, error) {
+	x, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	m, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{x25519: x, mlkem: m}, nil
+}
+
+// ParseIdentity parses an identity encoded by Identity.String.
+func ParseIdentity(s string) (*Identity, error) {
+	b, err := decodeKey(s, identityPrefix, 32+mlkem.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	x, err := ecdh.X25519().NewPrivateKey(b[:32])
+	if err != nil {
+		return nil, err
+	}
+	m, err := mlkem.NewDecapsulationKey768(b[32:])
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{x25519: x, mlkem: m}, nil
+}
+
+// String encodes the identity; it must be kept private.
+func (id *Identity) String() string {
+	return identityPrefix + base64.RawURLEncoding.EncodeToString(append(id.x25519.Bytes(), id.mlkem.Bytes()...))
+}
+
+// Recipient returns the public key of the identity.
+func (id *Identity) Recipient() *Recipient {
+	return &Recipient{x25519: id.x25519.PublicKey(), mlkem: id.mlkem.EncapsulationKey()}
+}
+
+// ParseRecipient parses a public key encoded by Recipient.String.
+func ParseRecipient(s string) (*Recipient, error) {
+	b, err := decodeKey(s, recipientPrefix, 32+mlkem.EncapsulationKeySize768)
+	if err != nil {
+		return nil, err
+	}
+	x, err := ecdh.X25519().NewPublicKey(b[:32])
+	if err != nil {
+		return nil, err
+	}
+	m, err := mlkem.NewEncapsulationKey768(b[32:])
+	if err != nil {
+		return nil, err
+	}
+	return &Recipient{x25519: x, mlkem: m}, nil
+}
+
+// String encodes the public key so it can be shared.
+func (r *Recipient) String() string {
+	return recipientPrefix + base64.RawURLEncoding.EncodeToString(append(r.x25519.Bytes(), r.mlkem.Bytes()...))
+}
+
+func decodeKey(s, prefix string, size int) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, prefix) {
+		return nil, errors.New("invalid key: missing " + prefix + " prefix")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s[len(prefix):])
+	if err != nil {
+		return nil, errors.New("invalid key encoding")
+	}
+	if len(b) != size {
+		return nil, errors.New("invalid key length")
+	}
+	return b, nil
+}
+
+// encapsulate generates a shared secret for the recipient and the ciphertext
+// that lets the identity recover it.
+func (r *Recipient) encapsulate() (ciphertext, shared []byte, err error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	ssX, err := eph.ECDH(r.x25519)
+	if err != nil {
+		return nil, nil, err
+	}
+	ssM, ctM := r.mlkem.Encapsulate()
+
+	ctX := eph.PublicKey().Bytes()
+	return append(ctX, ctM...), combine(ssM, ssX, ctX, r.x25519.Bytes()), nil
+}
+
+// decapsulate recovers the shared secret from a ciphertext produced by encapsulate.
+func (id *Identity) decapsulate(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) != recipientCiphertextSize {
+		return nil, errors.New("invalid recipient ciphertext")
+	}
+	ctX, ctM := ciphertext[:32], ciphertext[32:]
+	eph, err := ecdh.X25519().NewPublicKey(ctX)
+	if err != nil {
+		return nil, err
+	}
+	ssX, err := id.x25519.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	ssM, err := id.mlkem.Decapsulate(ctM)
+	if err != nil {
+		return nil, err
+	}
+	return combine(ssM, ssX, ctX, id.x25519.PublicKey().Bytes()), nil
+}
+
+// combine derives the hybrid shared secret the way X-Wing does: both shared secrets,
+// the X25519 ciphertext and public key, and a domain label hashed with SHA3-256.
+// The ML-KEM ciphertext needn't be included because ML-KEM is ciphertext-binding.
+func combine(ssM, ssX, ctX, pkX []byte) []byte {
+	h := sha3.New256()
+	h.Write(ssM)
+	h.Write(ssX)
+	h.Write(ctX)
+	h.Write(pkX)
+	h.Write([]byte(hybridLabel))
+	return h.Sum(nil)
+}
@@ -0,0 +1,78 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEncryptToRecipient(t *testing.T) {
+	cs := NewCryptoService()
+
+	identity, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("GenerateIdentity failed: %v", err)
+	}
+
+	// keys survive an encode/parse round trip
+	identity, err = ParseIdentity(identity.String())
+	if err != nil {
+		t.Fatalf("ParseIdentity failed: %v", err)
+	}
+	recipient, err := ParseRecipient(identity.Recipient().String())
+	if err != nil {
+		t.Fatalf("ParseRecipient failed: %v", err)
+	}
+
+	plaintext := []byte("no passphrase needed")
+	aad := []byte("item-id")
+
+	ciphertext, err := cs.EncryptTo(plaintext, recipient, aad)
+	if err != nil {
+		t.Fatalf("EncryptTo failed: %v", err)
+	}
+	if !IsRecipientEnvelope(ciphertext) {
+		t.Error("expected a recipient envelope")
+	}
+
+	decrypted, err := cs.DecryptWith(ciphertext, identity, aad)
+	if err != nil {
+		t.Fatalf("DecryptWith failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("expected %q, got %q", plaintext, decrypted)
+	}
+
+	if _, err := cs.DecryptWith(ciphertext, identity, []byte("other-id")); !errors.Is(err, ErrTampered) {
+		t.Errorf("expected ErrTampered for mismatched aad, got %v", err)
+	}
+	if _, err := cs.Decrypt(ciphertext, "any passphrase", aad); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("expected ErrWrongPassphrase when opening a recipient envelope with a passphrase, got %v", err)
+	}
+}
+
+func TestDecryptWithWrongIdentity(t *testing.T) {
+	cs := NewCryptoService()
+
+	alice, _ := GenerateIdentity()
+	mallory, _ := GenerateIdentity()
+
+	ciphertext, err := cs.EncryptTo([]byte("for alice"), alice.Recipient(), nil)
+	if err != nil {
+		t.Fatalf("EncryptTo failed: %v", err)
+	}
+
+	if _, err := cs.DecryptWith(ciphertext, mallory, nil); !errors.Is(err, ErrWrongIdentity) {
+		t.Errorf("expected ErrWrongIdentity, got %v", err)
+	}
+}
+
+func TestParseRecipientRejectsInvalidKeys(t *testing.T) {
+	identity, _ := GenerateIdentity()
+
+	for _, s := range []string{"", "shhhpub1:short", identity.String()} {
+		if _, err := ParseRecipient(s); err == nil {
+			t.Errorf("ParseRecipient(%.20q) should fail", s)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	signingKeyPrefix   = "SHHH-SIGNING-KEY-1:"
+	verifyingKeyPrefix = "shhhsig1:"
+
+	// signatureLabel is the domain separator of the signed message.
+	signatureLabel = "shhh sender signature v1"
+)
+
+// senderNamePattern limits sender names to characters that are safe to show
+// and to use as the first field of a trust store line.
+var senderNamePattern = regexp.MustCompile(`^[A-Za-z0-9._@+-]{1,64}$`)
+
+// ValidSenderName reports whether name can be used as a sender name.
+func ValidSenderName(name string) bool {
+	return senderNamePattern.MatchString(name)
+}
+
+// SigningKey is a sender's Ed25519 private key.
+type SigningKey struct {
+	key ed25519.PrivateKey
+}
+
+// VerifyingKey is the public key matching a SigningKey.
+type VerifyingKey struct {
+	key ed25519.PublicKey
+}
+
+// GenerateSigningKey creates a new random signing key.
+func GenerateSigningKey() (*SigningKey, error) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{key: key}, nil
+}
+
+// ParseSigningKey parses a signing key encoded by SigningKey.String.
+func ParseSigningKey(s string) (*SigningKey, error) {
+	seed, err := decodeKey(s, signingKeyPrefix, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{key: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// String encodes the signing key; it must be kept private.
+func (k *SigningKey) String() string {
+	return signingKeyPrefix + base64.RawURLEncoding.EncodeToString(k.key.Seed())
+}
+
+// Public returns the verifying key of the signing key.
+func (k *SigningKey) Public() *VerifyingKey {
+	return &VerifyingKey{key: k.key.Public().(ed25519.PublicKey)}
+}
+
+// Sign signs data on behalf of sender. The signature covers the sender name and
+// the SHA-256 of data, so it can't be moved to another sender or another secret.
+func (k *SigningKey) Sign(sender string, data []byte) []byte {
+	return ed25519.Sign(k.key, signedMessage(sender, data))
+}
+
+// ParseVerifyingKey parses a public key encoded by VerifyingKey.String.
+func ParseVerifyingKey(s string) (*VerifyingKey, error) {
+	b, err := decodeKey(s, verifyingKeyPrefix, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return &VerifyingKey{key: b}, nil
+}
+
+// String encodes the public key so it can be added to a trust store.
+func (v *VerifyingKey) String() string {
+	return verifyingKeyPrefix + base64.RawURLEncoding.EncodeToString(v.key)
+}
+
+// Fingerprint returns the SHA-256 of the public key in the form ssh-keygen uses.
+func (v *VerifyingKey) Fingerprint() string {
+	sum := sha256.Sum256(v.key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Verify reports whether sig is a signature by this key for sender over data.
+func (v *VerifyingKey) Verify(sender string, data, sig []byte) bool {
+	return ed25519.Verify(v.key, signedMessage(sender, data), sig)
+}
+
+// Equal reports whether both keys are the same.
+func (v *VerifyingKey) Equal(other *VerifyingKey) bool {
+	return v.key.Equal(other.key)
+}
+
+// ContentFingerprint returns the hex SHA-256 of data, as printed by sha256sum,
+// so a recipient can compare it with the sender out of band.
+func ContentFingerprint(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func signedMessage(sender string, data []byte) []byte {
+	digest := sha256.Sum256(data)
+	msg := make([]byte, 0, len(signatureLabel)+len(sender)+2+len(digest))
+	msg = append(msg, signatureLabel...)
+	msg = append(msg, 0)
+	msg = append(msg, sender...)
+	msg = append(msg, 0)
+	return append(msg, digest[:]...)
+}
+
+// TrustStore maps sender names to the public keys allowed to sign for them.
+type TrustStore struct {
+	keys map[string][]*VerifyingKey
+}
+
+// ParseTrustStore parses "name shhhsig1:..." lines. A name may have several keys,
+// for rotation. Blank lines and lines starting with # are ignored.
+func ParseTrustStore(s string) (*TrustStore, error) {
+	ts := &TrustStore{keys: make(map[string][]*VerifyingKey)}
+	for line := range strings.Lines(s) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New("trust store lines must be in name publickey form")
+		}
+		key, err := ParseVerifyingKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key for %q: %w", fields[0], err)
+		}
+		if err := ts.Add(fields[0], key); err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
+}
+
+// Add trusts key to sign for name.
+func (ts *TrustStore) Add(name string, key *VerifyingKey) error {
+	if !ValidSenderName(name) {
+		return fmt.Errorf("invalid sender name %q", name)
+	}
+	if ts.keys == nil {
+		ts.keys = make(map[string][]*VerifyingKey)
+	}
+	ts.keys[name] = append(ts.keys[name], key)
+	return nil
+}
+
+// Trusts reports whether key is trusted to sign for name. A nil store trusts nothing.
+func (ts *TrustStore) Trusts(name string, key *VerifyingKey) bool {
+	if ts == nil {
+		return false
+	}
+	for _, k := range ts.keys[name] {
+		if k.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package crypto
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// slotOverhead is what wrapping a data key in a slot adds: the GCM nonce and tag.
+const slotOverhead = 12 + 16
+
+// MaxKeySlots is the most slots an envelope can hold, since the count is stored in one byte.
+const MaxKeySlots = 255
+
+// duressSlotAD is the associated data of a duress slot, which tells it apart from the
+// key slots once opened. Key slots have none.
+var duressSlotAD = []byte("shhh duress slot")
+
+var (
+	// ErrDuress is returned by Decrypt when the passphrase opened a duress slot.
+	ErrDuress = errors.New("duress passphrase")
+	// ErrDuressAlert is an ErrDuress for a duress slot that asked for an alert.
+	ErrDuressAlert = fmt.Errorf("%w with alert", ErrDuress)
+)
+
+// Duress is a passphrase that opens nothing. Decrypt reports its use with ErrDuress,
+// or ErrDuressAlert if Alert is set, so the caller can destroy the secret.
+type Duress struct {
+	Passphrase string
+	Alert      bool
+}
+
+// EncryptSlots pads data and seals it under a random data key, wrapped once per
+// passphrase in its own key slot, so any one of the passphrases opens the envelope
+// with Decrypt. Random slots are added up to slots, and the real ones are placed at
+// random positions, so the envelope reveals neither how many passphrases there are
+// nor which slot a passphrase belongs to.
+//
+// A duress passphrase, if given, gets a slot of its own that holds a random value
+// instead of the data key. It looks like any other slot and costs the same to try.
+//
+// All slots share one salt. That keeps opening an envelope at a single key derivation
+// whatever the slot count, at the cost of letting one guess be tested against every
+// slot at once, which is no worse than an attacker picking the weakest passphrase.
+func (cs *CryptoService) EncryptSlots(data []byte, passphrases []string, duress *Duress, slots int, aad []byte) ([]byte, error) {
+	used := len(passphrases)
+	if duress != nil {
+		used++
+		for _, p := range passphrases {
+			if NormalizePassphrase(p) == NormalizePassphrase(duress.Passphrase) {
+				return nil, errors.New("duress passphrase must differ from the passphrases")
+			}
+		}
+	}
+	if len(passphrases) == 0 || used > slots || slots > MaxKeySlots {
+		return nil, errors.New("invalid number of key slots")
+	}
+
+	kdf, kdfMaterial, err := cs.newKDF()
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := cs.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	slotSize := int(cs.KeyLength) + slotOverhead
+	wrapped := make([][]byte, slots)
+	for i, p := range passphrases {
+		kek, err := cs.slotKey(kdf, kdfMaterial, p)
+		if err != nil {
+			return nil, err
+		}
+		gcm, err := newGCM(kek)
+		if err != nil {
+			return nil, err
+		}
+		wrapped[i] = gcm.Seal(nil, nil, dataKey, nil)
+	}
+	if duress != nil {
+		kek, err := cs.slotKey(kdf, kdfMaterial, duress.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		gcm, err := newGCM(kek)
+		if err != nil {
+			return nil, err
+		}
+		// the first byte records whether an alert was asked for, the rest is filler
+		marker := make([]byte, cs.KeyLength)
+		if _, err := rand.Read(marker); err != nil {
+			return nil, err
+		}
+		marker[0] = 0
+		if duress.Alert {
+			marker[0] = 1
+		}
+		wrapped[len(passphrases)] = gcm.Seal(nil, nil, marker, duressSlotAD)
+	}
+	for i := used; i < slots; i++ {
+		wrapped[i] = make([]byte, slotSize)
+		if _, err := rand.Read(wrapped[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := shuffle(wrapped); err != nil {
+		return nil, err
+	}
+
+	material := make([]byte, 0, 2+len(kdfMaterial)+slots*slotSize)
+	material = append(material, kdf)
+	material = append(material, kdfMaterial...)
+	material = append(material, byte(slots))
+	for _, w := range wrapped {
+		material = append(material, w...)
+	}
+	return cs.seal(modeSlots, material, dataKey, data, aad)
+}
+
+// openSlots unwraps the data key from slots material with passphrase. Every slot is
+// tried as a key slot and as a duress slot, so the time taken doesn't depend on which
+// one matched. It returns ErrDuress or ErrDuressAlert if a duress slot opened.
+func (cs *CryptoService) openSlots(material []byte, passphrase string) ([]byte, error) {
+	kdf := material[0]
+	kdfSize, err := cs.keyMaterialSize(kdf, nil)
+	if err != nil {
+		return nil, err
+	}
+	kdfMaterial := material[1 : 1+kdfSize]
+	slots := material[2+kdfSize:]
+
+	kek, err := cs.slotKey(kdf, kdfMaterial, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	var dataKey, marker []byte
+	slotSize := int(cs.KeyLength) + slotOverhead
+	for len(slots) > 0 {
+		key, err := gcm.Open(nil, nil, slots[:slotSize], nil)
+		if err == nil && dataKey == nil {
+			dataKey = key
+		}
+		m, err := gcm.Open(nil, nil, slots[:slotSize], duressSlotAD)
+		if err == nil && marker == nil {
+			marker = m
+		}
+		slots = slots[slotSize:]
+	}
+	switch {
+	case dataKey != nil:
+		return dataKey, nil
+	case marker != nil && marker[0] == 1:
+		return nil, ErrDuressAlert
+	case marker != nil:
+		return nil, ErrDuress
+	default:
+		return nil, errKeyCheck
+	}
+}
+
+// slotKey derives the key that wraps the data key in a passphrase's slot.
+func (cs *CryptoService) slotKey(kdf byte, kdfMaterial []byte, passphrase string) ([]byte, error) {
+	master, err := cs.passphraseKey(kdf, kdfMaterial, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Key(sha256.New, master, nil, "shhh key slot", int(cs.KeyLength))
+}
+
+// slotsMaterialSize returns the length of slots material at the start of rest:
+// KDF mode | KDF material | slot count | slots.
+func (cs *CryptoService) slotsMaterialSize(rest []byte) (int, error) {
+	if len(rest) < 1 {
+		return 0, errors.New("ciphertext too short")
+	}
+	kdf := rest[0]
+	if kdf != modePassphrase && kdf != modePBKDF2 {
+		return 0, errors.New("unsupported key slot KDF")
+	}
+	kdfSize, err := cs.keyMaterialSize(kdf, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) < 2+kdfSize {
+		return 0, errors.New("ciphertext too short")
+	}
+	slots := int(rest[1+kdfSize])
+	if slots == 0 {
+		return 0, errors.New("envelope has no key slots")
+	}
+	return 2 + kdfSize + slots*(int(cs.KeyLength)+slotOverhead), nil
+}
+
+// shuffle permutes s uniformly at random (Fisher-Yates).
+func shuffle(s [][]byte) error {
+	for i := len(s) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return err
+		}
+		s[i], s[j.Int64()] = s[j.Int64()], s[i]
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TOTPPeriod is the time step of TOTP codes, as used by authenticator apps.
+const TOTPPeriod = 30 * time.Second
+
+var errInvalidTOTPSeed = errors.New("TOTP seed must be base32")
+
+// ParseTOTPSeed decodes a base32 TOTP seed the way authenticator apps accept it:
+// case, spaces and padding don't matter.
+func ParseTOTPSeed(seed string) ([]byte, error) {
+	seed = strings.ToUpper(strings.Join(strings.Fields(seed), ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(seed, "="))
+	if err != nil || len(key) == 0 {
+		return nil, errInvalidTOTPSeed
+	}
+	return key, nil
+}
+
+// TOTP returns the RFC 6238 code of key at t: six digits from HMAC-SHA1 over
+// 30-second steps, the parameters every authenticator app defaults to.
+func TOTP(key []byte, t time.Time) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/int64(TOTPPeriod/time.Second)))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1_000_000)
+}
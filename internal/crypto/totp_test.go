@@ -0,0 +1,50 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B test vectors for SHA-1, truncated to six digits.
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := TOTP(key, time.Unix(tt.unix, 0)); got != tt.want {
+			t.Errorf("TOTP at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestParseTOTPSeed(t *testing.T) {
+	// base32 of the RFC 6238 key, as authenticator apps show it
+	for _, seed := range []string{
+		"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+		"gezd gnbv gy3t qojq gezd gnbv gy3t qojq",
+		"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ====",
+	} {
+		key, err := ParseTOTPSeed(seed)
+		if err != nil {
+			t.Fatalf("ParseTOTPSeed(%q): %v", seed, err)
+		}
+		if string(key) != "12345678901234567890" {
+			t.Errorf("ParseTOTPSeed(%q) = %q", seed, key)
+		}
+	}
+
+	for _, seed := range []string{"", "   ", "not base32!", "GEZDGNB1"} {
+		if _, err := ParseTOTPSeed(seed); err == nil {
+			t.Errorf("ParseTOTPSeed(%q) should fail", seed)
+		}
+	}
+}
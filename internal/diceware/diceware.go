@@ -0,0 +1,52 @@
+// Package diceware generates passphrases from the EFF large wordlist
+// (https://www.eff.org/deeplinks/2016/07/new-wordlists-random-passphrases,
+// CC BY 3.0 US), picking words uniformly with crypto/rand.
+package diceware
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	_ "embed"
+	"errors"
+	"math"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+//go:embed eff_large_wordlist.txt
+var wordlistFile []byte
+
+// words loads the wordlist, one "dice rolls<TAB>word" entry per line.
+var words = sync.OnceValue(func() []string {
+	var list []string
+	sc := bufio.NewScanner(bytes.NewReader(wordlistFile))
+	for sc.Scan() {
+		if _, word, ok := strings.Cut(sc.Text(), "\t"); ok {
+			list = append(list, word)
+		}
+	}
+	return list
+})
+
+// BitsPerWord is the entropy every word adds to a passphrase.
+var BitsPerWord = math.Log2(7776)
+
+// Generate returns a passphrase of n random words joined by separator.
+func Generate(n int, separator string) (string, error) {
+	if n < 1 {
+		return "", errors.New("word count must be positive")
+	}
+	list := words()
+	max := big.NewInt(int64(len(list)))
+	picked := make([]string, n)
+	for i := range picked {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		picked[i] = list[idx.Int64()]
+	}
+	return strings.Join(picked, separator), nil
+}
@@ -0,0 +1,36 @@
+package diceware
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWordlist(t *testing.T) {
+	list := words()
+	if len(list) != 7776 {
+		t.Fatalf("expected 7776 words, got %d", len(list))
+	}
+	if list[0] != "abacus" || list[len(list)-1] != "zoom" {
+		t.Errorf("unexpected first or last word: %q, %q", list[0], list[len(list)-1])
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	p, err := Generate(6, "-")
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	parts := strings.Split(p, "-")
+	if len(parts) != 6 {
+		t.Fatalf("expected 6 words, got %q", p)
+	}
+
+	other, _ := Generate(6, "-")
+	if p == other {
+		t.Error("two generated passphrases should not be equal")
+	}
+
+	if _, err := Generate(0, " "); err == nil {
+		t.Error("expected an error for zero words")
+	}
+}
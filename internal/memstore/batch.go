@@ -0,0 +1,112 @@
+package memstore
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"time"
+
+	"github.com/en9inerd/shhh/internal/crypto"
+)
+
+// Batch stores several items at once: Commit inserts either all of them or, if the store
+// hasn't room for them all, none. Its Store methods work like the MemoryStore ones, but
+// the items are only retrievable after Commit. A Batch is not safe for concurrent use.
+type Batch struct {
+	ms    *MemoryStore
+	items map[string]*StoredItem
+	order []string
+}
+
+// NewBatch starts a batch of n items, failing with ErrFull if the store can't hold them.
+// Room is checked again by Commit, since other items may be stored in between.
+func (ms *MemoryStore) NewBatch(n int) (*Batch, error) {
+	ms.mu.RLock()
+	full := len(ms.items)+n > ms.maxItems
+	ms.mu.RUnlock()
+	if full {
+		return nil, ErrFull
+	}
+	return &Batch{ms: ms, items: make(map[string]*StoredItem, n)}, nil
+}
+
+// Store adds an item encrypted under passphrase, like MemoryStore.Store.
+func (b *Batch) Store(data []byte, meta Metadata, passphrase string, ttl time.Duration) (string, *StoredItem, error) {
+	return b.store(data, meta, ttl, b.ms.passphraseSeal(passphrase))
+}
+
+// StoreForPassphrases adds an item any one of passphrases opens, like MemoryStore.StoreForPassphrases.
+func (b *Batch) StoreForPassphrases(data []byte, meta Metadata, passphrases []string, duress *crypto.Duress, ttl time.Duration) (string, *StoredItem, error) {
+	seal, err := b.ms.slotsSeal(passphrases, duress)
+	if err != nil {
+		return "", nil, err
+	}
+	return b.store(data, meta, ttl, seal)
+}
+
+// StoreForRecipient adds an item encrypted to recipient, like MemoryStore.StoreForRecipient.
+func (b *Batch) StoreForRecipient(data []byte, meta Metadata, recipient *crypto.Recipient, ttl time.Duration) (string, *StoredItem, error) {
+	return b.store(data, meta, ttl, b.ms.recipientSeal(recipient))
+}
+
+// StoreWithKey adds an item encrypted under a random key, like MemoryStore.StoreWithKey.
+func (b *Batch) StoreWithKey(data []byte, meta Metadata, ttl time.Duration) (id, token string, item *StoredItem, err error) {
+	seal, token, err := b.ms.keySeal()
+	if err != nil {
+		return "", "", nil, err
+	}
+	if id, item, err = b.store(data, meta, ttl, seal); err != nil {
+		return "", "", nil, err
+	}
+	return id, token, item, nil
+}
+
+func (b *Batch) store(data []byte, meta Metadata, ttl time.Duration, seal sealFunc) (string, *StoredItem, error) {
+	id, item, err := b.ms.seal(data, meta, ttl, len(b.items), seal)
+	if err != nil {
+		return "", nil, err
+	}
+	b.items[id] = item
+	b.order = append(b.order, id)
+	return id, item, nil
+}
+
+// Commit stores the batch's items and returns a management token for each, by ID, that
+// revokes the item with MemoryStore.Revoke. Only the tokens' hashes are kept. If the
+// store has no room for every item, none is stored and it fails with ErrFull.
+func (b *Batch) Commit() (map[string]string, error) {
+	tokens := make(map[string]string, len(b.items))
+	for _, id := range b.order {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		hash := sha256.Sum256(raw)
+		b.items[id].ManageHash = hash[:]
+		tokens[id] = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	if err := b.ms.insert(b.items); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Revoke deletes an item before it is retrieved, given the management token Commit
+// returned for it. Unknown items and wrong tokens both fail with ErrNotFound.
+func (ms *MemoryStore) Revoke(id, token string) error {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return ErrNotFound
+	}
+	hash := sha256.Sum256(raw)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	item, ok := ms.items[id]
+	if !ok || item.ManageHash == nil || subtle.ConstantTimeCompare(item.ManageHash, hash[:]) != 1 {
+		return ErrNotFound
+	}
+	delete(ms.items, id)
+	return nil
+}
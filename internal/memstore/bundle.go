@@ -0,0 +1,139 @@
+package memstore
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// KindBundle marks a secret whose data is a text message followed by attachments, laid
+// out as its Manifest lists them.
+const KindBundle = "bundle"
+
+// bundleMessageName is the message's name in bundle zip archives.
+const bundleMessageName = "message.txt"
+
+// Manifest lists the parts of a bundle's data in order: the message, then each file.
+type Manifest struct {
+	MessageSize int            `json:"message_size"`
+	Files       []ManifestFile `json:"files"`
+}
+
+// ManifestFile describes one attachment of a bundle.
+type ManifestFile struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+// BundleFile is one attachment of a bundle, with its content.
+type BundleFile struct {
+	ManifestFile
+	Data []byte `json:"data"`
+}
+
+// NewBundle lays out a message and files as the data of one secret and returns it with
+// the bundle's metadata. Filenames are sanitized and made unique, so the files can be
+// extracted side by side, and content types are guessed from their extensions.
+func NewBundle(message []byte, files []BundleFile) ([]byte, Metadata) {
+	size := len(message)
+	for _, f := range files {
+		size += len(f.Data)
+	}
+	data := make([]byte, 0, size)
+	data = append(data, message...)
+
+	manifest := &Manifest{MessageSize: len(message), Files: make([]ManifestFile, len(files))}
+	taken := map[string]bool{}
+	if len(message) > 0 {
+		taken[bundleMessageName] = true
+	}
+	for i, f := range files {
+		fm := FileMetadata(uniqueFilename(f.Name, i, taken))
+		manifest.Files[i] = ManifestFile{Name: fm.Filename, ContentType: fm.ContentType, Size: len(f.Data)}
+		data = append(data, f.Data...)
+	}
+	return data, Metadata{Kind: KindBundle, ContentType: "application/zip", Manifest: manifest}
+}
+
+// uniqueFilename sanitizes name, falls back to a numbered name if nothing is left, and
+// adds a counter before the extension until it isn't taken.
+func uniqueFilename(name string, i int, taken map[string]bool) string {
+	name = sanitizeFilename(name)
+	if name == "" {
+		name = "file-" + strconv.Itoa(i+1)
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 2; taken[strings.ToLower(name)]; n++ {
+		name = base + " (" + strconv.Itoa(n) + ")" + ext
+	}
+	taken[strings.ToLower(name)] = true
+	return name
+}
+
+// IsBundle reports whether the secret is a message with attachments.
+func (m Metadata) IsBundle() bool {
+	return m.Kind == KindBundle && m.Manifest != nil
+}
+
+// Bundle splits a bundle's data back into its message and files.
+func (m Metadata) Bundle(data []byte) (message []byte, files []BundleFile, err error) {
+	if !m.IsBundle() {
+		return nil, nil, errors.New("not a bundle")
+	}
+	size := m.Manifest.MessageSize
+	for _, f := range m.Manifest.Files {
+		if f.Size < 0 {
+			return nil, nil, errors.New("malformed bundle manifest")
+		}
+		size += f.Size
+	}
+	if m.Manifest.MessageSize < 0 || size != len(data) {
+		return nil, nil, errors.New("bundle doesn't match its manifest")
+	}
+
+	message, data = data[:m.Manifest.MessageSize], data[m.Manifest.MessageSize:]
+	files = make([]BundleFile, len(m.Manifest.Files))
+	for i, f := range m.Manifest.Files {
+		files[i] = BundleFile{ManifestFile: f, Data: data[:f.Size:f.Size]}
+		data = data[f.Size:]
+	}
+	return message, files, nil
+}
+
+// BundleZip packs a bundle's data into a zip archive, with the message as message.txt.
+// Files are stored uncompressed, since secrets are small and often already compressed.
+func (m Metadata) BundleZip(data []byte) ([]byte, error) {
+	message, files, err := m.Bundle(data)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	add := func(name string, data []byte) error {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	if len(message) > 0 {
+		if err := add(bundleMessageName, message); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range files {
+		if err := add(f.Name, f.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -3,33 +3,106 @@ package memstore
 import (
 	"context"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
-	"strings"
+	"fmt"
+	"maps"
 	"sync"
 	"time"
 
 	"github.com/en9inerd/shhh/internal/crypto"
+	"github.com/en9inerd/shhh/internal/shamir"
 )
 
+// Errors returned by the store. ErrNotFound, ErrExpired and ErrWrongKey must not be told
+// apart to clients, or the difference would reveal which secrets exist.
+var (
+	ErrNotFound           = errors.New("item not found")
+	ErrExpired            = errors.New("item expired")
+	ErrWrongKey           = errors.New("decryption failed") // wrong passphrase, key or PAKE confirmation
+	ErrNotSealed          = errors.New("item is not sealed to a recipient")
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrFull               = errors.New("memory store is full")
+	ErrBusy               = errors.New("too many pending retrievals")
+	ErrTooLarge           = errors.New("data size exceeds maximum allowed")
+	ErrInvalidTTL         = errors.New("TTL must be positive")
+	ErrTooManyPassphrases = errors.New("too many passphrases")
+)
+
+// StoredItem holds an encrypted envelope. Everything except the timestamps
+// needed for expiry lives inside the envelope.
 type StoredItem struct {
-	Data      []byte
-	CreatedAt time.Time
-	ExpiresAt time.Time
-	Filename  string // optional
+	Data       []byte
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	KeyVersion uint32 // master key version Data is wrapped with, 0 if not wrapped
+	Attempts   int    // failed retrievals so far
+	ManageHash []byte // SHA-256 of the token that revokes the item, nil if it has none
 }
 
 type MemoryStore struct {
 	items       map[string]*StoredItem
 	mu          sync.RWMutex
 	crypto      *crypto.CryptoService
+	keyring     *crypto.Keyring
 	stopCtx     context.Context
 	cancel      context.CancelFunc
 	maxItems    int
 	maxDataSize int64
+	keySlots    int
+	maxAttempts int
+	onDuress    func(id string)
+	pake        map[string]*pakeSession
+
+	decoyEnvelope []byte // opened for unknown IDs, fails at the key check like a wrong passphrase
+	decoyKey      []byte
+}
+
+// Option configures a MemoryStore.
+type Option func(*MemoryStore)
+
+// WithCrypto replaces the default crypto service used to seal items.
+func WithCrypto(cs *crypto.CryptoService) Option {
+	return func(ms *MemoryStore) {
+		ms.crypto = cs
+	}
+}
+
+// WithKeyring wraps every envelope with the newest server master key in kr,
+// so stored items can't be brute-forced offline without the master key.
+func WithKeyring(kr *crypto.Keyring) Option {
+	return func(ms *MemoryStore) {
+		ms.keyring = kr
+	}
 }
 
-func NewMemoryStore(retention time.Duration, maxItems int, maxDataSize int64) *MemoryStore {
+// WithKeySlots sets the number of key slots StoreForPassphrases pads every envelope to,
+// which is also the most passphrases a secret can have.
+func WithKeySlots(n int) Option {
+	return func(ms *MemoryStore) {
+		ms.keySlots = n
+	}
+}
+
+// WithMaxAttempts destroys an item after n failed retrievals, whether with a wrong
+// passphrase or a failed PAKE exchange. Zero allows any number of attempts.
+func WithMaxAttempts(n int) Option {
+	return func(ms *MemoryStore) {
+		ms.maxAttempts = n
+	}
+}
+
+// WithDuressAlert sets a function called with the item ID when a secret is destroyed
+// with a duress passphrase that asked for an alert. It must not block.
+func WithDuressAlert(fn func(id string)) Option {
+	return func(ms *MemoryStore) {
+		ms.onDuress = fn
+	}
+}
+
+func NewMemoryStore(retention time.Duration, maxItems int, maxDataSize int64, opts ...Option) *MemoryStore {
 	ctx, cancel := context.WithCancel(context.Background())
 	store := &MemoryStore{
 		items:       make(map[string]*StoredItem),
@@ -38,7 +111,19 @@ func NewMemoryStore(retention time.Duration, maxItems int, maxDataSize int64) *M
 		cancel:      cancel,
 		maxItems:    maxItems,
 		maxDataSize: maxDataSize,
+		keySlots:    8,
+		pake:        make(map[string]*pakeSession),
+		decoyKey:    make([]byte, 32),
+	}
+	rand.Read(store.decoyKey)
+	for _, opt := range opts {
+		opt(store)
 	}
+	// built up front with the configured crypto, so the first unknown ID doesn't also
+	// pay for sealing it
+	passphrase := make([]byte, 32)
+	rand.Read(passphrase)
+	store.decoyEnvelope, _ = store.crypto.Encrypt(nil, hex.EncodeToString(passphrase), nil)
 	go store.cleaner(retention)
 	return store
 }
@@ -53,76 +138,379 @@ func generateUUID() (string, error) {
 	return hex.EncodeToString(b), nil
 }
 
-// sanitizeFilename removes path separators and limits length to prevent path traversal and XSS
-func sanitizeFilename(filename string) string {
-	filename = strings.ReplaceAll(filename, "/", "")
-	filename = strings.ReplaceAll(filename, "\\", "")
-	filename = strings.ReplaceAll(filename, "..", "")
-	if len(filename) > 255 {
-		filename = filename[:255]
+// associatedData returns the values bound to an item's ciphertext, so that blobs
+// can't be swapped between IDs and the creation time can't be altered undetected.
+func associatedData(id string, item *StoredItem) []byte {
+	ad := binary.BigEndian.AppendUint32(nil, uint32(len(id)))
+	ad = append(ad, id...)
+	return binary.BigEndian.AppendUint64(ad, uint64(item.CreatedAt.UnixNano()))
+}
+
+// sealFunc encrypts an item's payload, binding it to the item's associated data.
+type sealFunc func(payload, ad []byte) ([]byte, error)
+
+// Store encrypts data and its metadata under a key derived from passphrase. Outside
+// FIPS mode the item can also be retrieved with StartPAKE and FinishPAKE.
+func (ms *MemoryStore) Store(data []byte, meta Metadata, passphrase string, ttl time.Duration) (string, *StoredItem, error) {
+	return ms.store(data, meta, ttl, ms.passphraseSeal(passphrase))
+}
+
+// encrypt seals a payload under a passphrase, in a PAKE envelope unless in FIPS mode.
+func (ms *MemoryStore) encrypt(payload []byte, passphrase string, ad []byte) ([]byte, error) {
+	if ms.crypto.FIPS {
+		return ms.crypto.Encrypt(payload, passphrase, ad)
+	}
+	return ms.crypto.EncryptPAKE(payload, passphrase, ad)
+}
+
+// StoreForPassphrases encrypts data and its metadata so that any one of passphrases
+// opens it with Retrieve. Every passphrase wraps the key in its own slot, and the
+// envelope is padded to the store's slot count, so it doesn't reveal how many
+// passphrases there are. The item is still deleted by the first retrieval.
+//
+// If duress is set, retrieving with its passphrase destroys the item and fails
+// exactly like a wrong passphrase.
+func (ms *MemoryStore) StoreForPassphrases(data []byte, meta Metadata, passphrases []string, duress *crypto.Duress, ttl time.Duration) (string, *StoredItem, error) {
+	seal, err := ms.slotsSeal(passphrases, duress)
+	if err != nil {
+		return "", nil, err
+	}
+	return ms.store(data, meta, ttl, seal)
+}
+
+// StoreForRecipient encrypts data and its metadata to a recipient's public key.
+// The server can't decrypt the item; it is handed out once by RetrieveSealed.
+func (ms *MemoryStore) StoreForRecipient(data []byte, meta Metadata, recipient *crypto.Recipient, ttl time.Duration) (string, *StoredItem, error) {
+	return ms.store(data, meta, ttl, ms.recipientSeal(recipient))
+}
+
+// StoreWithKey encrypts data and its metadata under a random key, for links that carry
+// the key instead of needing a passphrase. It returns the key encoded as a URL-safe token.
+func (ms *MemoryStore) StoreWithKey(data []byte, meta Metadata, ttl time.Duration) (id, token string, item *StoredItem, err error) {
+	seal, token, err := ms.keySeal()
+	if err != nil {
+		return "", "", nil, err
+	}
+	if id, item, err = ms.store(data, meta, ttl, seal); err != nil {
+		return "", "", nil, err
+	}
+	return id, token, item, nil
+}
+
+func (ms *MemoryStore) passphraseSeal(passphrase string) sealFunc {
+	return func(payload, ad []byte) ([]byte, error) {
+		return ms.encrypt(payload, passphrase, ad)
+	}
+}
+
+func (ms *MemoryStore) slotsSeal(passphrases []string, duress *crypto.Duress) (sealFunc, error) {
+	if n := len(passphrases); n > ms.keySlots || (duress != nil && n+1 > ms.keySlots) {
+		return nil, fmt.Errorf("%w, at most %d are allowed", ErrTooManyPassphrases, ms.keySlots)
+	}
+	return func(payload, ad []byte) ([]byte, error) {
+		return ms.crypto.EncryptSlots(payload, passphrases, duress, ms.keySlots, ad)
+	}, nil
+}
+
+func (ms *MemoryStore) recipientSeal(recipient *crypto.Recipient) sealFunc {
+	return func(payload, ad []byte) ([]byte, error) {
+		return ms.crypto.EncryptTo(payload, recipient, ad)
 	}
-	return filename
 }
 
-func (ms *MemoryStore) Store(data []byte, filename string, passphrase string, ttl time.Duration) (string, *StoredItem, error) {
+// keySeal returns a seal under a new random key, and the key as a URL-safe token.
+func (ms *MemoryStore) keySeal() (sealFunc, string, error) {
+	key, err := ms.crypto.GenerateKey()
+	if err != nil {
+		return nil, "", err
+	}
+	return func(payload, ad []byte) ([]byte, error) {
+		return ms.crypto.EncryptWithKey(payload, key, ad)
+	}, base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+func (ms *MemoryStore) store(data []byte, meta Metadata, ttl time.Duration, seal sealFunc) (string, *StoredItem, error) {
+	id, item, err := ms.seal(data, meta, ttl, 0, seal)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := ms.insert(map[string]*StoredItem{id: item}); err != nil {
+		return "", nil, err
+	}
+	return id, item, nil
+}
+
+// seal encrypts data and its metadata into a new item under a new ID, without storing
+// it. pending is the number of items sealed before it that are still to be inserted.
+func (ms *MemoryStore) seal(data []byte, meta Metadata, ttl time.Duration, pending int, seal sealFunc) (string, *StoredItem, error) {
 	if ttl <= 0 {
-		return "", nil, errors.New("TTL must be positive")
+		return "", nil, ErrInvalidTTL
 	}
 
 	if int64(len(data)) > ms.maxDataSize {
-		return "", nil, errors.New("data size exceeds maximum allowed")
+		return "", nil, ErrTooLarge
 	}
 
-	filename = sanitizeFilename(filename)
+	meta.Filename = sanitizeFilename(meta.Filename)
 
 	// Check capacity before expensive encryption operation
 	ms.mu.RLock()
-	if len(ms.items) >= ms.maxItems {
+	if len(ms.items)+pending >= ms.maxItems {
 		ms.mu.RUnlock()
-		return "", nil, errors.New("memory store is full")
+		return "", nil, ErrFull
 	}
 	ms.mu.RUnlock()
 
-	// Do expensive encryption outside lock for better performance
-	now := time.Now()
-	expiresAt := now.Add(ttl)
-
-	enc, err := ms.crypto.Encrypt(data, passphrase)
+	id, err := generateUUID()
 	if err != nil {
 		return "", nil, err
 	}
 
-	id, err := generateUUID()
+	payload, err := encodePayload(meta, data)
 	if err != nil {
 		return "", nil, err
 	}
 
+	now := time.Now()
 	item := &StoredItem{
-		Data:      enc,
-		Filename:  filename,
 		CreatedAt: now,
-		ExpiresAt: expiresAt,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	// Do expensive encryption outside lock for better performance
+	item.Data, err = seal(payload, associatedData(id, item))
+	if err != nil {
+		return "", nil, err
+	}
+	return id, item, nil
+}
+
+// StoreShares splits data and its metadata into one share per passphrase, any threshold
+// of which reconstruct it with CombineShares. Every share is stored as its own one-time
+// item encrypted under its passphrase, and all shares expire together. Either all
+// shares are stored or none are.
+func (ms *MemoryStore) StoreShares(data []byte, meta Metadata, passphrases []string, threshold int, ttl time.Duration) ([]string, time.Time, error) {
+	if ttl <= 0 {
+		return nil, time.Time{}, ErrInvalidTTL
+	}
+
+	if int64(len(data)) > ms.maxDataSize {
+		return nil, time.Time{}, ErrTooLarge
+	}
+
+	meta.Filename = sanitizeFilename(meta.Filename)
+
+	ms.mu.RLock()
+	if len(ms.items)+len(passphrases) > ms.maxItems {
+		ms.mu.RUnlock()
+		return nil, time.Time{}, ErrFull
+	}
+	ms.mu.RUnlock()
+
+	payload, err := encodePayload(meta, data)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	shares, err := shamir.Split(payload, len(passphrases), threshold)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	now := time.Now()
+	ids := make([]string, len(shares))
+	items := make(map[string]*StoredItem, len(shares))
+	for i, share := range shares {
+		if ids[i], err = generateUUID(); err != nil {
+			return nil, time.Time{}, err
+		}
+		shareMeta := TextMetadata()
+		shareMeta.Share = &ShareInfo{Index: int(share.X), Threshold: share.Threshold, Total: share.Total}
+		sharePayload, err := encodePayload(shareMeta, []byte(share.String()))
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		item := &StoredItem{
+			CreatedAt: now,
+			ExpiresAt: now.Add(ttl),
+		}
+		if item.Data, err = ms.encrypt(sharePayload, passphrases[i], associatedData(ids[i], item)); err != nil {
+			return nil, time.Time{}, err
+		}
+		items[ids[i]] = item
+	}
+
+	if err := ms.insert(items); err != nil {
+		return nil, time.Time{}, err
+	}
+	return ids, now.Add(ttl), nil
+}
+
+// CombineShares reconstructs a secret stored with StoreShares from the share texts
+// returned by retrieving at least threshold of its share items.
+func CombineShares(texts []string) ([]byte, Metadata, error) {
+	shares := make([]shamir.Share, 0, len(texts))
+	for _, text := range texts {
+		share, err := shamir.Parse(text)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		shares = append(shares, share)
 	}
 
-	// Lock again and check capacity before storing (prevent race condition)
+	payload, err := shamir.Combine(shares)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	meta, data, err := decodePayload(payload)
+	if err != nil {
+		return nil, Metadata{}, shamir.ErrInconsistentShares
+	}
+	return data, meta, nil
+}
+
+// insert adds sealed items to the store, wrapping them with the master key.
+// Nothing is added if there isn't room for all of them.
+func (ms *MemoryStore) insert(items map[string]*StoredItem) error {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
 	// Final check - items could have been added during encryption
-	if len(ms.items) >= ms.maxItems {
-		return "", nil, errors.New("memory store is full")
+	if len(ms.items)+len(items) > ms.maxItems {
+		return ErrFull
 	}
 
-	ms.items[id] = item
-	return id, item, nil
+	// Wrapping is cheap, so it's done under the lock to never race with Rekey
+	if ms.keyring != nil {
+		for id, item := range items {
+			data, err := ms.keyring.Wrap(item.Data, associatedData(id, item))
+			if err != nil {
+				return err
+			}
+			item.Data = data
+			item.KeyVersion = ms.keyring.Current()
+		}
+	}
+
+	maps.Copy(ms.items, items)
+	return nil
 }
 
-func (ms *MemoryStore) Retrieve(id, passphrase string) ([]byte, string, error) {
+// Retrieve decrypts an item with its passphrase and deletes it.
+func (ms *MemoryStore) Retrieve(id, passphrase string) ([]byte, Metadata, error) {
+	return ms.retrieve(id, func(enc, ad []byte) ([]byte, error) {
+		return ms.crypto.Decrypt(enc, passphrase, ad)
+	})
+}
+
+// RetrieveWithKey decrypts an item stored with StoreWithKey using its token and deletes it.
+func (ms *MemoryStore) RetrieveWithKey(id, token string) ([]byte, Metadata, error) {
+	key, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		key = nil // rejected by the key check below, like any other wrong key
+	}
+	return ms.retrieve(id, func(enc, ad []byte) ([]byte, error) {
+		return ms.crypto.DecryptWithKey(enc, key, ad)
+	})
+}
+
+func (ms *MemoryStore) retrieve(id string, open func(enc, ad []byte) ([]byte, error)) ([]byte, Metadata, error) {
+	enc, ad, err := ms.envelope(id)
+	if err != nil {
+		// Unknown, expired and unreadable items cost the same key derivation as a
+		// wrong passphrase, so response times don't reveal which IDs exist.
+		open(ms.decoyEnvelope, nil)
+		return nil, Metadata{}, err
+	}
+
+	payload, err := open(enc, ad)
+	if errors.Is(err, crypto.ErrDuress) {
+		// destroyed, but indistinguishable from a wrong passphrase to the caller
+		ms.delete(id)
+		if errors.Is(err, crypto.ErrDuressAlert) && ms.onDuress != nil {
+			ms.onDuress(id)
+		}
+		return nil, Metadata{}, ErrWrongKey
+	}
+	if err != nil && !errors.Is(err, crypto.ErrTampered) {
+		ms.failed(id)
+		return nil, Metadata{}, ErrWrongKey
+	}
+
+	// The key matched, so the item is consumed even if it fails integrity checks:
+	// a tampered item can never be opened again. Only the retrieval that removes it
+	// may return it, so concurrent retrievals with valid keys can't both read it.
+	if !ms.take(id) {
+		return nil, Metadata{}, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	meta, data, err := decodePayload(payload)
+	if err != nil {
+		return nil, Metadata{}, crypto.ErrTampered
+	}
+	return data, meta, nil
+}
+
+// failed records a failed retrieval of an item, and destroys it once the store's
+// attempt limit is reached.
+func (ms *MemoryStore) failed(id string) {
+	if ms.maxAttempts == 0 {
+		return
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	item, ok := ms.items[id]
+	if !ok {
+		return
+	}
+	item.Attempts++
+	if item.Attempts >= ms.maxAttempts {
+		delete(ms.items, id)
+	}
+}
+
+// RetrieveSealed deletes an item stored with StoreForRecipient and returns its
+// envelope along with the associated data needed to open it with OpenSealed.
+func (ms *MemoryStore) RetrieveSealed(id string) (envelope, ad []byte, err error) {
+	enc, ad, err := ms.envelope(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !crypto.IsRecipientEnvelope(enc) {
+		return nil, nil, ErrNotSealed
+	}
+
+	if !ms.take(id) {
+		return nil, nil, ErrNotFound
+	}
+	return enc, ad, nil
+}
+
+// OpenSealed decrypts an envelope returned by RetrieveSealed with the recipient's identity.
+func OpenSealed(cs *crypto.CryptoService, envelope, ad []byte, identity *crypto.Identity) ([]byte, Metadata, error) {
+	payload, err := cs.DecryptWith(envelope, identity, ad)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	meta, data, err := decodePayload(payload)
+	if err != nil {
+		return nil, Metadata{}, crypto.ErrTampered
+	}
+	return data, meta, nil
+}
+
+// envelope returns an unexpired item's envelope, unwrapped from the master key,
+// together with its associated data.
+func (ms *MemoryStore) envelope(id string) (enc, ad []byte, err error) {
 	ms.mu.RLock()
 	item, ok := ms.items[id]
 	if !ok {
 		ms.mu.RUnlock()
-		return nil, "", errors.New("item not found")
+		return nil, nil, ErrNotFound
 	}
 
 	if time.Now().After(item.ExpiresAt) {
@@ -130,23 +518,79 @@ func (ms *MemoryStore) Retrieve(id, passphrase string) ([]byte, string, error) {
 		ms.mu.Lock()
 		delete(ms.items, id)
 		ms.mu.Unlock()
-		return nil, "", errors.New("item expired")
+		return nil, nil, ErrExpired
 	}
 
-	enc := item.Data
-	filename := item.Filename
+	enc = item.Data
+	ad = associatedData(id, item)
+	keyVersion, kr := item.KeyVersion, ms.keyring
 	ms.mu.RUnlock()
 
-	decrypted, err := ms.crypto.Decrypt(enc, passphrase)
-	if err != nil {
-		return nil, "", errors.New("decryption failed")
+	if keyVersion == 0 {
+		return enc, ad, nil
+	}
+	if kr == nil {
+		return nil, nil, crypto.ErrUnknownKeyVersion
 	}
+	if enc, err = kr.Unwrap(enc, ad); err != nil {
+		if errors.Is(err, crypto.ErrTampered) {
+			ms.delete(id)
+		}
+		return nil, nil, err
+	}
+	return enc, ad, nil
+}
+
+// Rekey rewraps every stored item with the newest key in kr and makes kr the store's
+// keyring. kr must still contain every key version in use. Nothing is changed if any
+// item fails to unwrap. It returns the number of rewrapped items.
+func (ms *MemoryStore) Rekey(kr *crypto.Keyring) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	rewrapped := make(map[string][]byte)
+	for id, item := range ms.items {
+		if item.KeyVersion == kr.Current() {
+			continue
+		}
+		ad := associatedData(id, item)
+		env := item.Data
+		if item.KeyVersion != 0 {
+			var err error
+			if env, err = kr.Unwrap(item.Data, ad); errors.Is(err, crypto.ErrUnknownKeyVersion) {
+				return 0, fmt.Errorf("item %s is wrapped with master key version %d, which the new keys don't include: %w", id, item.KeyVersion, err)
+			} else if err != nil {
+				return 0, fmt.Errorf("can't unwrap item %s: %w", id, err)
+			}
+		}
+		data, err := kr.Wrap(env, ad)
+		if err != nil {
+			return 0, err
+		}
+		rewrapped[id] = data
+	}
+
+	for id, data := range rewrapped {
+		ms.items[id].Data = data
+		ms.items[id].KeyVersion = kr.Current()
+	}
+	ms.keyring = kr
+	return len(rewrapped), nil
+}
 
+// take deletes an item, reporting whether it was still there.
+func (ms *MemoryStore) take(id string) bool {
 	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, ok := ms.items[id]
 	delete(ms.items, id)
-	ms.mu.Unlock()
+	return ok
+}
 
-	return decrypted, filename, nil
+func (ms *MemoryStore) delete(id string) {
+	ms.mu.Lock()
+	delete(ms.items, id)
+	ms.mu.Unlock()
 }
 
 func (ms *MemoryStore) cleaner(retention time.Duration) {
@@ -166,13 +610,16 @@ func (ms *MemoryStore) cleaner(retention time.Duration) {
 			}
 			ms.mu.RUnlock()
 
-			if len(expired) > 0 {
-				ms.mu.Lock()
-				for _, id := range expired {
-					delete(ms.items, id)
+			ms.mu.Lock()
+			for _, id := range expired {
+				delete(ms.items, id)
+			}
+			for session, s := range ms.pake {
+				if now.After(s.expires) {
+					delete(ms.pake, session)
 				}
-				ms.mu.Unlock()
 			}
+			ms.mu.Unlock()
 		case <-ms.stopCtx.Done():
 			return
 		}
@@ -1,8 +1,20 @@
 package memstore
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/en9inerd/shhh/internal/crypto"
 )
 
 const (
@@ -23,12 +35,12 @@ func TestStoreAndRetrieve_Text(t *testing.T) {
 	data := []byte("Hello, world!")
 	ttl := 2 * time.Second
 
-	id, _, err := store.Store(data, "", testPassphrase, ttl)
+	id, _, err := store.Store(data, TextMetadata(), testPassphrase, ttl)
 	if err != nil {
 		t.Fatalf("Store failed: %v", err)
 	}
 
-	retrieved, filename, err := store.Retrieve(id, testPassphrase)
+	retrieved, meta, err := store.Retrieve(id, testPassphrase)
 	if err != nil {
 		t.Fatalf("Retrieve failed: %v", err)
 	}
@@ -37,8 +49,8 @@ func TestStoreAndRetrieve_Text(t *testing.T) {
 		t.Errorf("Expected %s, got %s", string(data), string(retrieved))
 	}
 
-	if filename != "" {
-		t.Errorf("Expected empty filename for text, got %s", filename)
+	if meta.Filename != "" {
+		t.Errorf("Expected empty filename for text, got %s", meta.Filename)
 	}
 }
 
@@ -50,12 +62,12 @@ func TestStoreAndRetrieve_File(t *testing.T) {
 	filename := "archive.tar.gz"
 	ttl := 2 * time.Second
 
-	id, _, err := store.Store(data, filename, testPassphrase, ttl)
+	id, _, err := store.Store(data, FileMetadata(filename), testPassphrase, ttl)
 	if err != nil {
 		t.Fatalf("Store failed: %v", err)
 	}
 
-	retrieved, gotFilename, err := store.Retrieve(id, testPassphrase)
+	retrieved, meta, err := store.Retrieve(id, testPassphrase)
 	if err != nil {
 		t.Fatalf("Retrieve failed: %v", err)
 	}
@@ -64,8 +76,104 @@ func TestStoreAndRetrieve_File(t *testing.T) {
 		t.Errorf("Expected %v, got %v", data, retrieved)
 	}
 
-	if gotFilename != filename {
-		t.Errorf("Expected filename %s, got %s", filename, gotFilename)
+	if meta.Filename != filename {
+		t.Errorf("Expected filename %s, got %s", filename, meta.Filename)
+	}
+}
+
+func TestStoreAndRetrieve_Credential(t *testing.T) {
+	store := newTestStore()
+	defer store.Stop()
+
+	cred := Credential{Username: "alice", Password: "hunter2", TOTPSeed: "JBSWY3DPEHPK3PXP"}
+	data, err := json.Marshal(cred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := store.Store(data, CredentialMetadata(), testPassphrase, time.Second)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+
+	retrieved, meta, err := store.Retrieve(id, testPassphrase)
+	if err != nil {
+		t.Fatalf("Retrieve failed: %v", err)
+	}
+	if !meta.IsCredential() || meta.IsFile() {
+		t.Errorf("expected credential metadata, got %+v", meta)
+	}
+	var got Credential
+	if err := json.Unmarshal(retrieved, &got); err != nil || got != cred {
+		t.Errorf("expected %+v, got %+v (%v)", cred, got, err)
+	}
+}
+
+func TestStoreAndRetrieve_Bundle(t *testing.T) {
+	store := newTestStore()
+	defer store.Stop()
+
+	data, meta := NewBundle([]byte("see attached"), []BundleFile{
+		{ManifestFile: ManifestFile{Name: "report.pdf"}, Data: []byte("%PDF")},
+		{ManifestFile: ManifestFile{Name: "../report.pdf"}, Data: []byte("second")},
+		{ManifestFile: ManifestFile{Name: "message.txt"}, Data: nil},
+		{ManifestFile: ManifestFile{Name: ""}, Data: []byte("unnamed")},
+	})
+	id, _, err := store.Store(data, meta, testPassphrase, time.Second)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+
+	retrieved, meta, err := store.Retrieve(id, testPassphrase)
+	if err != nil {
+		t.Fatalf("Retrieve failed: %v", err)
+	}
+	if !meta.IsBundle() || meta.IsFile() {
+		t.Fatalf("expected bundle metadata, got %+v", meta)
+	}
+	message, files, err := meta.Bundle(retrieved)
+	if err != nil {
+		t.Fatalf("Bundle failed: %v", err)
+	}
+	if string(message) != "see attached" {
+		t.Errorf("expected message, got %q", message)
+	}
+	want := []struct{ name, ct, data string }{
+		{"report.pdf", "application/pdf", "%PDF"},
+		{"report (2).pdf", "application/pdf", "second"},
+		{"message (2).txt", "text/plain; charset=utf-8", ""},
+		{"file-4", "application/octet-stream", "unnamed"},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("expected %d files, got %d", len(want), len(files))
+	}
+	for i, w := range want {
+		if files[i].Name != w.name || files[i].ContentType != w.ct || string(files[i].Data) != w.data {
+			t.Errorf("file %d: expected %s %s %q, got %s %s %q", i, w.name, w.ct, w.data, files[i].Name, files[i].ContentType, files[i].Data)
+		}
+	}
+
+	meta.Manifest.Files[0].Size++
+	if _, _, err := meta.Bundle(retrieved); err == nil {
+		t.Error("expected an error for a manifest that doesn't match the data")
+	}
+}
+
+func TestBundleZip(t *testing.T) {
+	data, meta := NewBundle([]byte("hello"), []BundleFile{{ManifestFile: ManifestFile{Name: "a.txt"}, Data: []byte("A")}})
+	b, err := meta.BundleZip(data)
+	if err != nil {
+		t.Fatalf("BundleZip failed: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("invalid zip: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if !slices.Equal(names, []string{"message.txt", "a.txt"}) {
+		t.Errorf("unexpected zip entries %v", names)
 	}
 }
 
@@ -73,8 +181,8 @@ func TestStore_InvalidTTL(t *testing.T) {
 	store := newTestStore()
 	defer store.Stop()
 
-	_, _, err := store.Store([]byte("test"), "", testPassphrase, 0)
-	if err == nil || err.Error() != "TTL must be positive" {
+	_, _, err := store.Store([]byte("test"), TextMetadata(), testPassphrase, 0)
+	if !errors.Is(err, ErrInvalidTTL) {
 		t.Errorf("Expected TTL error, got %v", err)
 	}
 }
@@ -83,8 +191,8 @@ func TestStore_ExceedsDataSize(t *testing.T) {
 	store := NewMemoryStore(cleanupDuration, maxItems, 5) // 5 bytes max
 	defer store.Stop()
 
-	_, _, err := store.Store([]byte("123456"), "", testPassphrase, 1*time.Second)
-	if err == nil || err.Error() != "data size exceeds maximum allowed" {
+	_, _, err := store.Store([]byte("123456"), TextMetadata(), testPassphrase, 1*time.Second)
+	if !errors.Is(err, ErrTooLarge) {
 		t.Errorf("Expected data size error, got %v", err)
 	}
 }
@@ -93,13 +201,13 @@ func TestStore_ExceedsMaxItems(t *testing.T) {
 	store := NewMemoryStore(cleanupDuration, 1, maxDataSize) // allow only 1 item
 	defer store.Stop()
 
-	_, _, err := store.Store([]byte("one"), "", testPassphrase, 1*time.Second)
+	_, _, err := store.Store([]byte("one"), TextMetadata(), testPassphrase, 1*time.Second)
 	if err != nil {
 		t.Fatalf("Unexpected error on first store: %v", err)
 	}
 
-	_, _, err = store.Store([]byte("two"), "", testPassphrase, 1*time.Second)
-	if err == nil || err.Error() != "memory store is full" {
+	_, _, err = store.Store([]byte("two"), TextMetadata(), testPassphrase, 1*time.Second)
+	if !errors.Is(err, ErrFull) {
 		t.Errorf("Expected memory full error, got %v", err)
 	}
 }
@@ -108,7 +216,7 @@ func TestRetrieve_Expired(t *testing.T) {
 	store := newTestStore()
 	defer store.Stop()
 
-	id, _, err := store.Store([]byte("temp data"), "", testPassphrase, 1*time.Millisecond)
+	id, _, err := store.Store([]byte("temp data"), TextMetadata(), testPassphrase, 1*time.Millisecond)
 	if err != nil {
 		t.Fatalf("Store failed: %v", err)
 	}
@@ -116,7 +224,7 @@ func TestRetrieve_Expired(t *testing.T) {
 	time.Sleep(10 * time.Millisecond)
 
 	_, _, err = store.Retrieve(id, testPassphrase)
-	if err == nil || err.Error() != "item expired" {
+	if !errors.Is(err, ErrExpired) {
 		t.Errorf("Expected expiration error, got %v", err)
 	}
 }
@@ -126,7 +234,7 @@ func TestRetrieve_NotFound(t *testing.T) {
 	defer store.Stop()
 
 	_, _, err := store.Retrieve("nonexistent-id", testPassphrase)
-	if err == nil || err.Error() != "item not found" {
+	if !errors.Is(err, ErrNotFound) {
 		t.Errorf("Expected not found error, got %v", err)
 	}
 }
@@ -136,22 +244,659 @@ func TestRetrieve_WrongPassphrase(t *testing.T) {
 	defer store.Stop()
 
 	data := []byte("secret data")
-	id, _, err := store.Store(data, "", testPassphrase, 1*time.Second)
+	id, _, err := store.Store(data, TextMetadata(), testPassphrase, 1*time.Second)
 	if err != nil {
 		t.Fatalf("Store failed: %v", err)
 	}
 
 	_, _, err = store.Retrieve(id, "wrongpass")
-	if err == nil || err.Error() != "decryption failed" {
+	if !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected decryption error, got %v", err)
+	}
+}
+
+func TestRetrieve_TamperedCreationTime(t *testing.T) {
+	store := newTestStore()
+	defer store.Stop()
+
+	id, _, err := store.Store([]byte("report"), FileMetadata("report.pdf"), testPassphrase, 1*time.Second)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+
+	store.mu.Lock()
+	store.items[id].CreatedAt = store.items[id].CreatedAt.Add(-time.Hour)
+	store.mu.Unlock()
+
+	_, _, err = store.Retrieve(id, testPassphrase)
+	if !errors.Is(err, crypto.ErrTampered) {
+		t.Errorf("Expected tampering error, got %v", err)
+	}
+}
+
+func TestRetrieve_SwappedBlob(t *testing.T) {
+	store := newTestStore()
+	defer store.Stop()
+
+	idA, _, err := store.Store([]byte("secret A"), TextMetadata(), testPassphrase, 1*time.Second)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	idB, _, err := store.Store([]byte("secret B"), TextMetadata(), testPassphrase, 1*time.Second)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+
+	store.mu.Lock()
+	store.items[idA].Data, store.items[idB].Data = store.items[idB].Data, store.items[idA].Data
+	store.mu.Unlock()
+
+	_, _, err = store.Retrieve(idA, testPassphrase)
+	if !errors.Is(err, crypto.ErrTampered) {
+		t.Errorf("Expected tampering error, got %v", err)
+	}
+}
+
+func TestStore_MetadataIsEncrypted(t *testing.T) {
+	store := newTestStore()
+	defer store.Stop()
+
+	filename := "prod-db-root.kdbx"
+	id, _, err := store.Store([]byte("vault"), FileMetadata(filename), testPassphrase, 1*time.Second)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+
+	store.mu.RLock()
+	enc := store.items[id].Data
+	store.mu.RUnlock()
+
+	if bytes.Contains(enc, []byte(filename)) {
+		t.Errorf("Expected filename to be encrypted, found it in stored data")
+	}
+}
+
+func TestStoreForRecipient(t *testing.T) {
+	store := newTestStore()
+	defer store.Stop()
+
+	identity, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("GenerateIdentity failed: %v", err)
+	}
+
+	data := []byte("sealed for one")
+	id, _, err := store.StoreForRecipient(data, FileMetadata("notes.txt"), identity.Recipient(), 1*time.Second)
+	if err != nil {
+		t.Fatalf("StoreForRecipient failed: %v", err)
+	}
+
+	if _, _, err := store.Retrieve(id, testPassphrase); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected decryption error for passphrase retrieval, got %v", err)
+	}
+
+	envelope, ad, err := store.RetrieveSealed(id)
+	if err != nil {
+		t.Fatalf("RetrieveSealed failed: %v", err)
+	}
+	if _, _, err := store.RetrieveSealed(id); err == nil {
+		t.Error("Expected sealed item to be deleted after retrieval")
+	}
+
+	retrieved, meta, err := OpenSealed(crypto.NewCryptoService(), envelope, ad, identity)
+	if err != nil {
+		t.Fatalf("OpenSealed failed: %v", err)
+	}
+	if !bytes.Equal(retrieved, data) || meta.Filename != "notes.txt" {
+		t.Errorf("Expected %s in notes.txt, got %s in %s", data, retrieved, meta.Filename)
+	}
+}
+
+func TestRetrieveSealed_PassphraseItem(t *testing.T) {
+	store := newTestStore()
+	defer store.Stop()
+
+	id, _, err := store.Store([]byte("data"), TextMetadata(), testPassphrase, 1*time.Second)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+
+	// handing out a passphrase envelope would allow offline brute force
+	if _, _, err := store.RetrieveSealed(id); err == nil {
+		t.Fatal("Expected RetrieveSealed to refuse a passphrase item")
+	}
+	if _, _, err := store.Retrieve(id, testPassphrase); err != nil {
+		t.Errorf("Expected passphrase item to be kept, got %v", err)
+	}
+}
+
+func TestStoreWithKey(t *testing.T) {
+	store := newTestStore()
+	defer store.Stop()
+
+	data := []byte("no passphrase needed")
+	id, token, _, err := store.StoreWithKey(data, TextMetadata(), 1*time.Second)
+	if err != nil {
+		t.Fatalf("StoreWithKey failed: %v", err)
+	}
+
+	if _, _, err := store.RetrieveWithKey(id, "bm90IHRoZSBrZXk"); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected decryption error for wrong token, got %v", err)
+	}
+	if _, _, err := store.Retrieve(id, token); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected decryption error for token used as passphrase, got %v", err)
+	}
+
+	retrieved, _, err := store.RetrieveWithKey(id, token)
+	if err != nil {
+		t.Fatalf("RetrieveWithKey failed: %v", err)
+	}
+	if !bytes.Equal(retrieved, data) {
+		t.Errorf("Expected %s, got %s", data, retrieved)
+	}
+	if _, _, err := store.RetrieveWithKey(id, token); err == nil {
+		t.Error("Expected item to be deleted after retrieval")
+	}
+}
+
+func TestStoreForPassphrases(t *testing.T) {
+	store := newTestStore()
+	defer store.Stop()
+
+	data := []byte("for the whole team")
+	passphrases := []string{"alice-pass", "bob-pass"}
+	id, _, err := store.StoreForPassphrases(data, TextMetadata(), passphrases, nil, time.Second)
+	if err != nil {
+		t.Fatalf("StoreForPassphrases failed: %v", err)
+	}
+
+	if _, _, err := store.Retrieve(id, "mallory-pass"); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected decryption error for wrong passphrase, got %v", err)
+	}
+	retrieved, _, err := store.Retrieve(id, "bob-pass")
+	if err != nil {
+		t.Fatalf("Retrieve failed: %v", err)
+	}
+	if !bytes.Equal(retrieved, data) {
+		t.Errorf("Expected %s, got %s", data, retrieved)
+	}
+
+	// read-once applies to the secret, not to each passphrase
+	if _, _, err := store.Retrieve(id, "alice-pass"); err == nil {
+		t.Error("Expected item to be deleted after retrieval")
+	}
+
+	tooMany := []string{"a-pass", "b-pass", "c-pass", "d-pass", "e-pass", "f-pass", "g-pass", "h-pass", "i-pass"}
+	if _, _, err := store.StoreForPassphrases(data, TextMetadata(), tooMany, nil, time.Second); err == nil {
+		t.Error("Expected error for more passphrases than key slots")
+	}
+}
+
+func TestRetrieve_ConcurrentReadOnce(t *testing.T) {
+	store := newTestStore()
+	defer store.Stop()
+
+	passphrases := []string{"alice-pass", "bob-pass"}
+	for range 3 {
+		id, _, err := store.StoreForPassphrases([]byte("read me once"), TextMetadata(), passphrases, nil, time.Minute)
+		if err != nil {
+			t.Fatalf("StoreForPassphrases failed: %v", err)
+		}
+
+		// every reader holds a valid passphrase and they all decrypt at once
+		const readers = 4
+		start := make(chan struct{})
+		results := make(chan error, readers)
+		var wg sync.WaitGroup
+		for i := range readers {
+			wg.Go(func() {
+				<-start
+				_, _, err := store.Retrieve(id, passphrases[i%len(passphrases)])
+				results <- err
+			})
+		}
+		close(start)
+		wg.Wait()
+		close(results)
+
+		opened := 0
+		for err := range results {
+			switch {
+			case err == nil:
+				opened++
+			case !errors.Is(err, ErrNotFound):
+				t.Errorf("Expected ErrNotFound for a late reader, got %v", err)
+			}
+		}
+		if opened != 1 {
+			t.Fatalf("Secret was opened %d times, want once", opened)
+		}
+	}
+}
+
+func TestStoreForPassphrases_Duress(t *testing.T) {
+	alerts := make(chan string, 1)
+	store := NewMemoryStore(cleanupDuration, maxItems, maxDataSize, WithDuressAlert(func(id string) {
+		alerts <- id
+	}))
+	defer store.Stop()
+
+	duress := &crypto.Duress{Passphrase: "duress-pass", Alert: true}
+	id, _, err := store.StoreForPassphrases([]byte("under duress"), TextMetadata(), []string{"real-pass"}, duress, time.Second)
+	if err != nil {
+		t.Fatalf("StoreForPassphrases failed: %v", err)
+	}
+
+	_, _, wrongErr := store.Retrieve(id, "wrong-pass")
+	_, _, duressErr := store.Retrieve(id, "duress-pass")
+	if duressErr == nil || wrongErr == nil || duressErr.Error() != wrongErr.Error() {
+		t.Errorf("Expected duress to fail like a wrong passphrase, got %v and %v", duressErr, wrongErr)
+	}
+	select {
+	case got := <-alerts:
+		if got != id {
+			t.Errorf("Expected alert for %s, got %s", id, got)
+		}
+	default:
+		t.Error("Expected a duress alert")
+	}
+	if _, _, err := store.Retrieve(id, "real-pass"); err == nil {
+		t.Error("Expected item to be destroyed by the duress passphrase")
+	}
+}
+
+// pakeRetrieve runs a PAKE retrieval of id with passphrase, as a client would.
+func pakeRetrieve(t *testing.T, store *MemoryStore, id, passphrase string) ([]byte, Metadata, error) {
+	t.Helper()
+	session, salt, share, err := store.StartPAKE(id)
+	if err != nil {
+		t.Fatalf("StartPAKE failed: %v", err)
+	}
+	client, err := crypto.NewCryptoService().NewPAKEClient(salt, passphrase, []byte(id))
+	if err != nil {
+		t.Fatalf("NewPAKEClient failed: %v", err)
+	}
+	confirm, err := client.Confirm(share)
+	if err != nil {
+		t.Fatalf("Confirm failed: %v", err)
+	}
+	serverConfirm, sealed, ad, err := store.FinishPAKE(id, session, client.Share(), confirm)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	return OpenPAKE(client, serverConfirm, sealed, ad)
+}
+
+func TestPAKERetrieve(t *testing.T) {
+	store := newTestStore()
+	defer store.Stop()
+
+	meta := FileMetadata("notes.txt")
+	id, _, err := store.Store([]byte("pake data"), meta, testPassphrase, time.Second)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+
+	if _, _, err := pakeRetrieve(t, store, id, "wrongpass"); !errors.Is(err, ErrWrongKey) {
 		t.Errorf("Expected decryption error, got %v", err)
 	}
+
+	data, got, err := pakeRetrieve(t, store, id, testPassphrase)
+	if err != nil {
+		t.Fatalf("PAKE retrieval failed: %v", err)
+	}
+	if string(data) != "pake data" || got.Filename != "notes.txt" {
+		t.Errorf("Got %q with filename %q", data, got.Filename)
+	}
+
+	if _, _, err := store.Retrieve(id, testPassphrase); err == nil {
+		t.Error("Expected item to be deleted after PAKE retrieval")
+	}
+}
+
+func TestPAKERetrieve_SessionIsSingleUse(t *testing.T) {
+	store := newTestStore()
+	defer store.Stop()
+
+	id, _, err := store.Store([]byte("data"), TextMetadata(), testPassphrase, time.Second)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	session, salt, share, err := store.StartPAKE(id)
+	if err != nil {
+		t.Fatalf("StartPAKE failed: %v", err)
+	}
+	client, err := crypto.NewCryptoService().NewPAKEClient(salt, "wrongpass", []byte(id))
+	if err != nil {
+		t.Fatalf("NewPAKEClient failed: %v", err)
+	}
+	confirm, err := client.Confirm(share)
+	if err != nil {
+		t.Fatalf("Confirm failed: %v", err)
+	}
+	store.FinishPAKE(id, session, client.Share(), confirm)
+	if _, _, _, err := store.FinishPAKE(id, session, client.Share(), confirm); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected a used session to be gone, got %v", err)
+	}
+}
+
+func TestPAKERetrieve_UnknownID(t *testing.T) {
+	store := newTestStore()
+	defer store.Stop()
+
+	_, salt1, _, err := store.StartPAKE("unknown")
+	if err != nil {
+		t.Fatalf("StartPAKE failed: %v", err)
+	}
+	_, salt2, _, err := store.StartPAKE("unknown")
+	if err != nil {
+		t.Fatalf("StartPAKE failed: %v", err)
+	}
+	if !bytes.Equal(salt1, salt2) {
+		t.Error("Expected the same decoy salt for an ID")
+	}
+
+	if _, _, err := pakeRetrieve(t, store, "unknown", testPassphrase); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected unknown ID to fail like a wrong passphrase, got %v", err)
+	}
+}
+
+func TestPAKERetrieve_SessionsPerID(t *testing.T) {
+	store := NewMemoryStore(cleanupDuration, 2, maxDataSize)
+	defer store.Stop()
+
+	for range maxPAKESessionsPerID {
+		if _, _, _, err := store.StartPAKE("busy"); err != nil {
+			t.Fatalf("StartPAKE failed: %v", err)
+		}
+	}
+	if _, _, _, err := store.StartPAKE("busy"); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected ErrBusy past the per-ID limit, got %v", err)
+	}
+	if _, _, _, err := store.StartPAKE("other"); err != nil {
+		t.Errorf("Expected other IDs not to be held up, got %v", err)
+	}
+
+	store.mu.Lock()
+	for _, s := range store.pake {
+		s.expires = time.Now().Add(-time.Second)
+	}
+	store.mu.Unlock()
+	if _, _, _, err := store.StartPAKE("busy"); err != nil {
+		t.Errorf("Expected expired sessions to be evicted, got %v", err)
+	}
+	if len(store.pake) != 1 {
+		t.Errorf("Expected 1 pending session, got %d", len(store.pake))
+	}
+}
+
+func TestPAKERetrieve_DecoyFlood(t *testing.T) {
+	store := NewMemoryStore(cleanupDuration, 2, maxDataSize)
+	defer store.Stop()
+
+	id, _, err := store.Store([]byte("data"), TextMetadata(), testPassphrase, time.Minute)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	for i := range 3 * 2 * maxPAKESessionsPerID {
+		if _, _, _, err := store.StartPAKE(fmt.Sprintf("unknown-%d", i)); err != nil {
+			t.Fatalf("Expected unknown IDs never to be refused, got %v", err)
+		}
+	}
+	if len(store.pake) != 2*maxPAKESessionsPerID {
+		t.Errorf("Expected the oldest decoy sessions to be dropped, got %d pending", len(store.pake))
+	}
+	if data, _, err := pakeRetrieve(t, store, id, testPassphrase); err != nil || string(data) != "data" {
+		t.Errorf("Expected a real item to open during the flood, got %q, %v", data, err)
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	store := NewMemoryStore(cleanupDuration, maxItems, maxDataSize, WithMaxAttempts(2))
+	defer store.Stop()
+
+	id, _, err := store.Store([]byte("data"), TextMetadata(), testPassphrase, time.Second)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	store.Retrieve(id, "wrongpass")
+	pakeRetrieve(t, store, id, "wrongpass")
+	if _, _, err := store.Retrieve(id, testPassphrase); err == nil {
+		t.Error("Expected item to be destroyed after too many failed attempts")
+	}
+}
+
+func TestMaxAttempts_DecoyPAKESessions(t *testing.T) {
+	store := NewMemoryStore(cleanupDuration, maxItems, maxDataSize, WithMaxAttempts(2))
+	defer store.Stop()
+
+	id, _, err := store.StoreForPassphrases([]byte("data"), TextMetadata(), []string{"alice-pass", "bob-pass"}, nil, time.Minute)
+	if err != nil {
+		t.Fatalf("StoreForPassphrases failed: %v", err)
+	}
+	for range 3 {
+		if _, _, err := pakeRetrieve(t, store, id, "alice-pass"); !errors.Is(err, ErrWrongKey) {
+			t.Fatalf("Expected PAKE to fail for a multi-passphrase secret, got %v", err)
+		}
+	}
+	if data, _, err := store.Retrieve(id, "alice-pass"); err != nil || string(data) != "data" {
+		t.Errorf("Expected decoy sessions not to count as attempts, got %q, %v", data, err)
+	}
+}
+
+func TestStoreShares(t *testing.T) {
+	store := newTestStore()
+	defer store.Stop()
+
+	data := []byte("break glass")
+	passphrases := []string{"first-pass", "second-pass", "third-pass"}
+	ids, expiresAt, err := store.StoreShares(data, FileMetadata("root.txt"), passphrases, 2, time.Minute)
+	if err != nil {
+		t.Fatalf("StoreShares failed: %v", err)
+	}
+	if len(ids) != 3 {
+		t.Fatalf("Expected 3 share IDs, got %d", len(ids))
+	}
+	for _, id := range ids {
+		if !store.items[id].ExpiresAt.Equal(expiresAt) {
+			t.Errorf("Expected share %s to expire at %v, got %v", id, expiresAt, store.items[id].ExpiresAt)
+		}
+	}
+
+	var texts []string
+	for _, i := range []int{2, 0} {
+		share, meta, err := store.Retrieve(ids[i], passphrases[i])
+		if err != nil {
+			t.Fatalf("Retrieve share %d failed: %v", i, err)
+		}
+		if meta.Share == nil || meta.Share.Threshold != 2 || meta.Share.Total != 3 {
+			t.Errorf("Expected share metadata 2 of 3, got %+v", meta.Share)
+		}
+		texts = append(texts, string(share))
+	}
+
+	if _, _, err := CombineShares(texts[:1]); err == nil {
+		t.Error("Expected combine to fail below the threshold")
+	}
+	retrieved, meta, err := CombineShares(texts)
+	if err != nil {
+		t.Fatalf("CombineShares failed: %v", err)
+	}
+	if !bytes.Equal(retrieved, data) || meta.Filename != "root.txt" {
+		t.Errorf("Expected %s in root.txt, got %s in %s", data, retrieved, meta.Filename)
+	}
+}
+
+func TestStoreShares_ExceedsMaxItems(t *testing.T) {
+	store := NewMemoryStore(cleanupDuration, 2, maxDataSize)
+	defer store.Stop()
+
+	_, _, err := store.StoreShares([]byte("data"), TextMetadata(), []string{"a", "b", "c"}, 2, time.Second)
+	if !errors.Is(err, ErrFull) {
+		t.Errorf("Expected 'memory store is full' error, got %v", err)
+	}
+	if len(store.items) != 0 {
+		t.Errorf("Expected no shares to be stored, got %d", len(store.items))
+	}
+}
+
+func TestBatch(t *testing.T) {
+	store := newTestStore()
+	defer store.Stop()
+
+	batch, err := store.NewBatch(2)
+	if err != nil {
+		t.Fatalf("NewBatch failed: %v", err)
+	}
+	id1, _, err := batch.Store([]byte("one"), TextMetadata(), testPassphrase, time.Minute)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	id2, key, _, err := batch.StoreWithKey([]byte("two"), TextMetadata(), time.Minute)
+	if err != nil {
+		t.Fatalf("StoreWithKey failed: %v", err)
+	}
+
+	// nothing is stored before Commit
+	if _, _, err := store.Retrieve(id1, testPassphrase); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound before Commit, got %v", err)
+	}
+
+	tokens, err := batch.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if len(tokens) != 2 || tokens[id1] == "" || tokens[id2] == "" {
+		t.Fatalf("expected a management token per item, got %v", tokens)
+	}
+
+	if data, _, err := store.Retrieve(id1, testPassphrase); err != nil || string(data) != "one" {
+		t.Errorf("Retrieve = %q, %v", data, err)
+	}
+
+	if err := store.Revoke(id2, tokens[id1]); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Revoke with another item's token: expected ErrNotFound, got %v", err)
+	}
+	if err := store.Revoke(id2, tokens[id2]); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if _, _, err := store.RetrieveWithKey(id2, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after Revoke, got %v", err)
+	}
+}
+
+func TestBatch_AllOrNothing(t *testing.T) {
+	store := NewMemoryStore(cleanupDuration, 3, maxDataSize)
+	defer store.Stop()
+
+	if _, err := store.NewBatch(4); !errors.Is(err, ErrFull) {
+		t.Errorf("NewBatch over capacity: expected ErrFull, got %v", err)
+	}
+
+	batch, err := store.NewBatch(2)
+	if err != nil {
+		t.Fatalf("NewBatch failed: %v", err)
+	}
+	for range 2 {
+		if _, _, err := batch.Store([]byte("data"), TextMetadata(), testPassphrase, time.Minute); err != nil {
+			t.Fatalf("Store failed: %v", err)
+		}
+	}
+
+	// the store fills up before the batch is committed
+	for range 2 {
+		if _, _, err := store.Store([]byte("data"), TextMetadata(), testPassphrase, time.Minute); err != nil {
+			t.Fatalf("Store failed: %v", err)
+		}
+	}
+	if _, err := batch.Commit(); !errors.Is(err, ErrFull) {
+		t.Fatalf("Commit: expected ErrFull, got %v", err)
+	}
+	if n := len(store.items); n != 2 {
+		t.Errorf("expected no batch item to be stored, store has %d items", n)
+	}
+}
+
+func TestRevoke_ItemWithoutToken(t *testing.T) {
+	store := newTestStore()
+	defer store.Stop()
+
+	id, _, err := store.Store([]byte("data"), TextMetadata(), testPassphrase, time.Minute)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	if err := store.Revoke(id, ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	key := func(b byte) string {
+		return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+	}
+	oldRing, err := crypto.ParseKeyring("1:" + key(1))
+	if err != nil {
+		t.Fatalf("ParseKeyring failed: %v", err)
+	}
+	newRing, err := crypto.ParseKeyring("1:" + key(1) + "\n2:" + key(2))
+	if err != nil {
+		t.Fatalf("ParseKeyring failed: %v", err)
+	}
+
+	store := NewMemoryStore(cleanupDuration, maxItems, maxDataSize, WithKeyring(oldRing))
+	defer store.Stop()
+
+	data := []byte("wrapped secret")
+	id, item, err := store.Store(data, TextMetadata(), testPassphrase, 1*time.Second)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	if item.KeyVersion != 1 {
+		t.Fatalf("Expected key version 1, got %d", item.KeyVersion)
+	}
+
+	n, err := store.Rekey(newRing)
+	if err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	if n != 1 || item.KeyVersion != 2 {
+		t.Errorf("Expected 1 item rewrapped with version 2, got %d items with version %d", n, item.KeyVersion)
+	}
+
+	retrieved, _, err := store.Retrieve(id, testPassphrase)
+	if err != nil {
+		t.Fatalf("Retrieve after rekey failed: %v", err)
+	}
+	if !bytes.Equal(retrieved, data) {
+		t.Errorf("Expected %s, got %s", data, retrieved)
+	}
+}
+
+func TestRekey_MissingKeyVersion(t *testing.T) {
+	oldRing, _ := crypto.ParseKeyring("1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	otherRing, _ := crypto.ParseKeyring("2:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)))
+
+	store := NewMemoryStore(cleanupDuration, maxItems, maxDataSize, WithKeyring(oldRing))
+	defer store.Stop()
+
+	if _, _, err := store.Store([]byte("data"), TextMetadata(), testPassphrase, 1*time.Second); err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+
+	_, err := store.Rekey(otherRing)
+	if !errors.Is(err, crypto.ErrUnknownKeyVersion) {
+		t.Errorf("Expected unknown key version error, got %v", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "master key version 1") {
+		t.Errorf("Expected the error to name the missing version, got %v", err)
+	}
 }
 
 func TestCleaner_RemovesExpired(t *testing.T) {
 	store := NewMemoryStore(1*time.Second, maxItems, maxDataSize)
 	defer store.Stop()
 
-	id, _, err := store.Store([]byte("clean me"), "", testPassphrase, 1*time.Millisecond)
+	id, _, err := store.Store([]byte("clean me"), TextMetadata(), testPassphrase, 1*time.Millisecond)
 	if err != nil {
 		t.Fatalf("Store failed: %v", err)
 	}
@@ -166,3 +911,79 @@ func TestCleaner_RemovesExpired(t *testing.T) {
 		t.Errorf("Expected item to be removed by cleaner")
 	}
 }
+
+// TestRetrieve_UniformTiming checks with a two-sample Kolmogorov-Smirnov test that
+// unknown IDs, expired items and wrong passphrases take indistinguishable time.
+func TestRetrieve_UniformTiming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing test")
+	}
+	const samples = 60
+
+	// cheaper key derivation keeps the test fast; the decoy costs as much as a real one either way
+	cs := crypto.NewCryptoService()
+	cs.Memory, cs.Iterations, cs.Threads = 4*1024, 1, 1
+	store := NewMemoryStore(time.Hour, 2*samples+1, maxDataSize, WithCrypto(cs))
+	defer store.Stop()
+
+	live, _, err := store.Store([]byte("data"), TextMetadata(), testPassphrase, time.Hour)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	expired := make([]string, samples)
+	for i := range expired {
+		if expired[i], _, err = store.Store([]byte("data"), TextMetadata(), testPassphrase, time.Nanosecond); err != nil {
+			t.Fatalf("Store failed: %v", err)
+		}
+	}
+
+	measure := func(id string) time.Duration {
+		start := time.Now()
+		if _, _, err := store.Retrieve(id, "wrong passphrase"); err == nil {
+			t.Fatal("Retrieve should fail")
+		}
+		return time.Since(start)
+	}
+
+	// the first lookup of an unknown ID is measured too, it must not pay for the decoy
+	first := measure("ffffffffffffffffffffffffffffffff")
+	var notFound, expiredTimes, wrongPass []time.Duration
+	for i := range samples {
+		// interleaved, so drift in machine load affects all three alike
+		notFound = append(notFound, measure(fmt.Sprintf("%032x", i)))
+		expiredTimes = append(expiredTimes, measure(expired[i]))
+		wrongPass = append(wrongPass, measure(live))
+	}
+
+	// sealing the decoy on first use would double the cost of the first lookup
+	sorted := slices.Sorted(slices.Values(wrongPass))
+	if median := sorted[len(sorted)/2]; first > median*8/5 {
+		t.Errorf("first unknown ID took %v, wrong passphrases take %v", first, median)
+	}
+
+	// critical value for alpha = 0.001 with equal sample sizes
+	critical := 1.95 * math.Sqrt(2.0/samples)
+	for name, other := range map[string][]time.Duration{"not found": notFound, "expired": expiredTimes} {
+		if d := ksStatistic(other, wrongPass); d > critical {
+			t.Errorf("%s and wrong passphrase timings differ: D = %.2f > %.2f", name, d, critical)
+		}
+	}
+}
+
+// ksStatistic returns the largest distance between the empirical distributions of a and b.
+func ksStatistic(a, b []time.Duration) float64 {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	var i, j int
+	var d float64
+	for i < len(a) && j < len(b) {
+		if a[i] <= b[j] {
+			i++
+		} else {
+			j++
+		}
+		d = max(d, math.Abs(float64(i)/float64(len(a))-float64(j)/float64(len(b))))
+	}
+	return d
+}
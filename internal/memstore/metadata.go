@@ -0,0 +1,117 @@
+package memstore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// Metadata describes a stored secret. It is sealed inside the encrypted envelope
+// together with the data, so it is only revealed after a successful passphrase check.
+type Metadata struct {
+	Kind        string     `json:"kind,omitempty"` // KindCredential or KindBundle, or empty for text and files
+	Filename    string     `json:"filename,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+	Manifest    *Manifest  `json:"manifest,omitempty"` // the parts of a bundle
+	Share       *ShareInfo `json:"share,omitempty"`
+	Signature   *Signature `json:"signature,omitempty"`
+}
+
+// KindCredential marks a secret whose data is a JSON encoded Credential.
+const KindCredential = "credential"
+
+// Credential is a login bundle shared as one secret. Its fields are only checked when
+// it is created; the store keeps its JSON encoding as the secret's data.
+type Credential struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	URL      string `json:"url,omitempty"`
+	TOTPSeed string `json:"totp_seed,omitempty"` // base32, as authenticator apps take it
+	Notes    string `json:"notes,omitempty"`
+}
+
+// Signature is a sender's Ed25519 signature over the data, made with crypto.SigningKey.
+// It is stored as given; whether to trust it is decided when the secret is retrieved.
+type Signature struct {
+	Sender    string `json:"sender"`
+	PublicKey string `json:"public_key"`
+	Value     []byte `json:"sig"`
+}
+
+// ShareInfo describes an item holding one share of a split secret.
+type ShareInfo struct {
+	Index     int `json:"index"`
+	Threshold int `json:"threshold"`
+	Total     int `json:"total"`
+}
+
+// TextMetadata returns the metadata for a text secret.
+func TextMetadata() Metadata {
+	return Metadata{ContentType: "text/plain; charset=utf-8"}
+}
+
+// FileMetadata returns the metadata for a file secret, with the filename sanitized
+// and the content type guessed from its extension.
+func FileMetadata(filename string) Metadata {
+	filename = sanitizeFilename(filename)
+	ct := mime.TypeByExtension(filepath.Ext(filename))
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	return Metadata{Filename: filename, ContentType: ct}
+}
+
+// CredentialMetadata returns the metadata for a credential secret.
+func CredentialMetadata() Metadata {
+	return Metadata{Kind: KindCredential, ContentType: "application/json"}
+}
+
+// IsCredential reports whether the secret's data is a JSON encoded Credential.
+func (m Metadata) IsCredential() bool {
+	return m.Kind == KindCredential
+}
+
+// IsFile reports whether the secret was uploaded as a file.
+func (m Metadata) IsFile() bool {
+	return m.Filename != ""
+}
+
+// sanitizeFilename removes path separators and limits length to prevent path traversal and XSS
+func sanitizeFilename(filename string) string {
+	filename = strings.ReplaceAll(filename, "/", "")
+	filename = strings.ReplaceAll(filename, "\\", "")
+	filename = strings.ReplaceAll(filename, "..", "")
+	if len(filename) > 255 {
+		filename = filename[:255]
+	}
+	return filename
+}
+
+// encodePayload serializes metadata and data into the plaintext that gets encrypted:
+// a uvarint length, the JSON encoded metadata, then the raw data.
+func encodePayload(meta Metadata, data []byte) ([]byte, error) {
+	m, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, 0, binary.MaxVarintLen64+len(m)+len(data))
+	payload = binary.AppendUvarint(payload, uint64(len(m)))
+	payload = append(payload, m...)
+	return append(payload, data...), nil
+}
+
+// decodePayload is the inverse of encodePayload.
+func decodePayload(payload []byte) (Metadata, []byte, error) {
+	var meta Metadata
+	n, k := binary.Uvarint(payload)
+	if k <= 0 || n > uint64(len(payload)-k) {
+		return meta, nil, errors.New("malformed payload")
+	}
+	if err := json.Unmarshal(payload[k:k+int(n)], &meta); err != nil {
+		return meta, nil, err
+	}
+	return meta, payload[k+int(n):], nil
+}
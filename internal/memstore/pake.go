@@ -0,0 +1,142 @@
+package memstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"time"
+
+	"github.com/en9inerd/shhh/internal/crypto"
+)
+
+const (
+	// pakeSessionTTL is how long a client has to finish a PAKE retrieval it started.
+	pakeSessionTTL = time.Minute
+	// maxPAKESessionsPerID is how many PAKE retrievals of an item can be pending at once,
+	// so clients flooding one item don't hold up retrievals of the others.
+	maxPAKESessionsPerID = 4
+)
+
+// pakeSession is a started PAKE retrieval, waiting for the client's confirmation.
+type pakeSession struct {
+	id      string
+	server  *crypto.PAKEServer
+	expires time.Time
+	decoy   bool // opens nothing, so failing it doesn't count against the item
+}
+
+// StartPAKE starts retrieving an item without its passphrase being sent to the store.
+// It returns a session for FinishPAKE, and the salt and share the client needs to
+// derive its confirmation with crypto.PAKEClient.
+//
+// Unknown and expired items, and items that can't be opened this way, get a decoy
+// session with a salt that stays the same for the ID, so the answer doesn't reveal
+// which items exist. Their exchange fails at FinishPAKE like a wrong passphrase.
+// ErrBusy is returned while an ID already has maxPAKESessionsPerID sessions pending.
+//
+// Decoy sessions are limited separately from real ones, and past their limit the
+// oldest is dropped rather than new ones refused, so a flood of random IDs can't hold
+// up retrievals of real items, nor tell them apart by being refused.
+func (ms *MemoryStore) StartPAKE(id string) (session string, salt, share []byte, err error) {
+	var server *crypto.PAKEServer
+	enc, _, err := ms.envelope(id)
+	if err == nil {
+		server, err = ms.crypto.NewPAKEServer(enc, []byte(id))
+	}
+	decoy := err != nil
+	if decoy {
+		if server, err = ms.crypto.NewDecoyPAKEServer(ms.decoySalt(id), []byte(id)); err != nil {
+			return "", nil, nil, err
+		}
+	}
+
+	if session, err = generateUUID(); err != nil {
+		return "", nil, nil, err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := time.Now()
+	pending, decoys, oldestDecoy := 0, 0, ""
+	for k, s := range ms.pake {
+		if now.After(s.expires) {
+			delete(ms.pake, k)
+			continue
+		}
+		if s.id == id {
+			pending++
+		}
+		if s.decoy {
+			decoys++
+			if oldestDecoy == "" || s.expires.Before(ms.pake[oldestDecoy].expires) {
+				oldestDecoy = k
+			}
+		}
+	}
+	maxSessions := ms.maxItems * maxPAKESessionsPerID
+	switch {
+	case pending >= maxPAKESessionsPerID:
+		return "", nil, nil, ErrBusy
+	case decoy && decoys >= maxSessions:
+		delete(ms.pake, oldestDecoy)
+	case !decoy && len(ms.pake)-decoys >= maxSessions:
+		return "", nil, nil, ErrBusy
+	}
+	ms.pake[session] = &pakeSession{id: id, server: server, expires: now.Add(pakeSessionTTL), decoy: decoy}
+	return session, server.Salt(), server.Share(), nil
+}
+
+// FinishPAKE checks the client's share and confirmation for a session StartPAKE gave for id.
+// If the client knows the passphrase, the item is deleted and its envelope returned
+// sealed for the client, with the server's confirmation and the associated data the
+// client opens it with. A session allows a single attempt, and a failed one counts
+// towards the item's attempt limit, unless it was a decoy session: an item PAKE can't
+// open shouldn't be locked by clients that can't tell it apart from a wrong passphrase.
+func (ms *MemoryStore) FinishPAKE(id, session string, share, confirm []byte) (serverConfirm, sealed, ad []byte, err error) {
+	ms.mu.Lock()
+	s, ok := ms.pake[session]
+	delete(ms.pake, session)
+	ms.mu.Unlock()
+	if !ok || s.id != id || time.Now().After(s.expires) {
+		return nil, nil, nil, ErrSessionNotFound
+	}
+
+	serverConfirm, err = s.server.Finish(share, confirm)
+	if err != nil {
+		if !s.decoy {
+			ms.failed(s.id)
+		}
+		return nil, nil, nil, ErrWrongKey
+	}
+
+	enc, ad, err := ms.envelope(s.id)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// the item may have been retrieved since the session started
+	if !ms.take(s.id) {
+		return nil, nil, nil, ErrNotFound
+	}
+	if sealed, err = s.server.Seal(enc); err != nil {
+		return nil, nil, nil, err
+	}
+	return serverConfirm, sealed, ad, nil
+}
+
+// decoySalt returns the salt of an ID's decoy PAKE session.
+func (ms *MemoryStore) decoySalt(id string) []byte {
+	mac := hmac.New(sha256.New, ms.decoyKey)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)[:ms.crypto.SaltSize]
+}
+
+// OpenPAKE decrypts an envelope returned by FinishPAKE with the client side of the exchange.
+func OpenPAKE(client *crypto.PAKEClient, serverConfirm, sealed, ad []byte) ([]byte, Metadata, error) {
+	payload, err := client.Open(serverConfirm, sealed, ad)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	meta, data, err := decodePayload(payload)
+	if err != nil {
+		return nil, Metadata{}, crypto.ErrTampered
+	}
+	return data, meta, nil
+}
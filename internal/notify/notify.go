@@ -0,0 +1,65 @@
+// Package notify sends secret lifecycle events to a webhook.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// EventDuress is sent when a secret was destroyed with its duress passphrase.
+const EventDuress = "secret.duress"
+
+// Event is a lifecycle event. It never carries secret content or metadata.
+type Event struct {
+	Type string    `json:"event"`
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+// Webhook posts events as JSON to a fixed URL.
+type Webhook struct {
+	url    string
+	client *http.Client
+	logger *slog.Logger
+}
+
+func NewWebhook(url string, logger *slog.Logger) *Webhook {
+	return &Webhook{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: logger,
+	}
+}
+
+// Send posts the event in the background, so callers don't wait on the webhook and
+// their response times don't depend on it. Failures are logged, not retried.
+func (wh *Webhook) Send(event Event) {
+	go func() {
+		body, err := json.Marshal(event)
+		if err != nil {
+			wh.logger.Error("failed to encode lifecycle event", "error", err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), wh.client.Timeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+		if err != nil {
+			wh.logger.Error("failed to build lifecycle webhook request", "error", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := wh.client.Do(req)
+		if err != nil {
+			wh.logger.Error("failed to send lifecycle event", "event", event.Type, "error", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			wh.logger.Error("lifecycle webhook rejected event", "event", event.Type, "status", resp.StatusCode)
+		}
+	}()
+}
@@ -0,0 +1,516 @@
+// Package qrcode encodes short texts, like secret links, as QR codes (ISO/IEC 18004)
+// and renders them as SVG.
+//
+// Only what links need is implemented: byte mode, error correction level M, versions
+// 1 to 40 and automatic mask selection.
+package qrcode
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// quietZone is the light border around a code that scanners need, in modules.
+	quietZone = 4
+
+	// formatLevelM is level M's error correction bits in the format information.
+	formatLevelM = 0
+)
+
+// ErrTooLong is returned when data doesn't fit in the largest QR code.
+var ErrTooLong = errors.New("data too long for a QR code")
+
+// Error correction codewords per block and number of blocks for level M, indexed by
+// version.
+var (
+	eccPerBlock = [41]int{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+	eccBlocks   = [41]int{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+)
+
+// Code is an encoded QR code.
+type Code struct {
+	Size     int // modules per side, without the quiet zone
+	modules  []bool
+	function []bool // finder, timing, alignment, format and version modules
+}
+
+// Encode returns the smallest QR code holding data at error correction level M.
+func Encode(data []byte) (*Code, error) {
+	version := 0
+	for v := 1; v <= 40; v++ {
+		if len(data) <= dataCapacity(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, ErrTooLong
+	}
+
+	codewords := addECC(dataCodewords(data, version), version)
+	c := newCode(version)
+	c.drawFunctionPatterns(version)
+	c.drawCodewords(codewords)
+
+	best, bestPenalty := 0, -1
+	for mask := range 8 {
+		c.applyMask(mask)
+		c.drawFormatBits(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask) // masks are XOR, so applying one again undoes it
+	}
+	c.applyMask(best)
+	c.drawFormatBits(best)
+	return c, nil
+}
+
+// Dark reports whether the module in column x and row y is dark.
+func (c *Code) Dark(x, y int) bool {
+	return c.modules[y*c.Size+x]
+}
+
+// SVG renders the code with its quiet zone as an SVG image that scales to its
+// container, one path of dark modules on a white background.
+func (c *Code) SVG() string {
+	n := c.Size + 2*quietZone
+	var path strings.Builder
+	for y := range c.Size {
+		for x := 0; x < c.Size; x++ {
+			if !c.Dark(x, y) {
+				continue
+			}
+			run := 1
+			for x+run < c.Size && c.Dark(x+run, y) {
+				run++
+			}
+			fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", x+quietZone, y+quietZone, run, run)
+			x += run - 1
+		}
+	}
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="%d" height="%d" fill="#fff"/><path d="%s" fill="#000"/></svg>`, n, n, n, n, path.String())
+}
+
+func newCode(version int) *Code {
+	size := version*4 + 17
+	return &Code{Size: size, modules: make([]bool, size*size), function: make([]bool, size*size)}
+}
+
+func (c *Code) set(x, y int, dark bool) {
+	c.modules[y*c.Size+x] = dark
+	c.function[y*c.Size+x] = true
+}
+
+// rawCodewords is the number of 8-bit codewords a version holds, data and error
+// correction together, once function patterns are drawn.
+func rawCodewords(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n / 8
+}
+
+// dataCapacity is the number of bytes a version holds in byte mode at level M.
+func dataCapacity(version int) int {
+	bits := (rawCodewords(version)-eccPerBlock[version]*eccBlocks[version])*8 - 4 - countBits(version)
+	return bits / 8
+}
+
+// countBits is the length of the byte mode character count.
+func countBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// dataCodewords lays out data in byte mode: the mode indicator, the byte count, the
+// data, a terminator and the pad codewords that fill the version's capacity.
+func dataCodewords(data []byte, version int) []byte {
+	capacity := rawCodewords(version) - eccPerBlock[version]*eccBlocks[version]
+	var bb bitBuffer
+	bb.append(0b0100, 4)
+	bb.append(len(data), countBits(version))
+	for _, b := range data {
+		bb.append(int(b), 8)
+	}
+	bb.append(0, min(4, capacity*8-bb.n))
+	bb.append(0, (8-bb.n%8)%8)
+	for pad := 0xec; len(bb.bytes) < capacity; pad ^= 0xec ^ 0x11 {
+		bb.append(pad, 8)
+	}
+	return bb.bytes
+}
+
+type bitBuffer struct {
+	bytes []byte
+	n     int
+}
+
+func (bb *bitBuffer) append(v, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if bb.n%8 == 0 {
+			bb.bytes = append(bb.bytes, 0)
+		}
+		if v>>i&1 == 1 {
+			bb.bytes[bb.n/8] |= 0x80 >> (bb.n % 8)
+		}
+		bb.n++
+	}
+}
+
+// addECC splits data into the version's blocks, appends each block's Reed-Solomon
+// error correction codewords and interleaves the blocks.
+func addECC(data []byte, version int) []byte {
+	numBlocks, eccLen := eccBlocks[version], eccPerBlock[version]
+	raw := rawCodewords(version)
+	shortBlocks := numBlocks - raw%numBlocks
+	shortLen := raw/numBlocks - eccLen // data codewords of a short block
+
+	divisor := rsDivisor(eccLen)
+	blocks := make([][]byte, numBlocks)
+	for i := range blocks {
+		n := shortLen
+		if i >= shortBlocks {
+			n++
+		}
+		blocks[i], data = data[:n], data[n:]
+	}
+
+	out := make([]byte, 0, raw)
+	for i := 0; i <= shortLen; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	eccs := make([][]byte, numBlocks)
+	for i, b := range blocks {
+		eccs[i] = rsRemainder(b, divisor)
+	}
+	for i := range eccLen {
+		for _, e := range eccs {
+			out = append(out, e[i])
+		}
+	}
+	return out
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of the given degree,
+// without its leading 1, highest coefficient first.
+func rsDivisor(degree int) []byte {
+	div := make([]byte, degree)
+	div[degree-1] = 1
+	root := byte(1)
+	for range degree {
+		for j := range div {
+			div[j] = gfMul(div[j], root)
+			if j+1 < len(div) {
+				div[j] ^= div[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return div
+}
+
+// rsRemainder returns the error correction codewords of data.
+func rsRemainder(data, divisor []byte) []byte {
+	rem := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ rem[0]
+		copy(rem, rem[1:])
+		rem[len(rem)-1] = 0
+		for i, d := range divisor {
+			rem[i] ^= gfMul(d, factor)
+		}
+	}
+	return rem
+}
+
+// gfMul multiplies in GF(256) modulo x^8 + x^4 + x^3 + x^2 + 1, the field of QR codes.
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11d
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+func (c *Code) drawFunctionPatterns(version int) {
+	for i := range c.Size {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+
+	c.drawFinder(3, 3)
+	c.drawFinder(c.Size-4, 3)
+	c.drawFinder(3, c.Size-4)
+
+	pos := alignmentPositions(version)
+	last := len(pos) - 1
+	for i, x := range pos {
+		for j, y := range pos {
+			// alignment patterns overlapping the finders are left out
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// reserve the format modules, they are drawn once the mask is chosen
+	c.drawFormatBits(0)
+	c.drawVersionBits(version)
+}
+
+// drawFinder draws a finder pattern centered on x, y, with its separator.
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= c.Size || yy < 0 || yy >= c.Size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			c.set(xx, yy, d != 2 && d != 4)
+		}
+	}
+}
+
+// alignmentPositions returns the rows and columns alignment patterns are centered on.
+func alignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := 26
+	if version != 32 {
+		step = (version*4 + n*2 + 1) / (n*2 - 2) * 2
+	}
+	pos := make([]int, n)
+	pos[0] = 6
+	for i, p := n-1, version*4+10; i > 0; i, p = i-1, p-step {
+		pos[i] = p
+	}
+	return pos
+}
+
+// formatBits returns the 15 format information bits of level M and mask: 5 data bits
+// and a BCH(15,5) code, XORed with the fixed mask pattern.
+func formatBits(mask int) int {
+	data := formatLevelM<<3 | mask
+	rem := data
+	for range 10 {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (c *Code) drawFormatBits(mask int) {
+	bits := formatBits(mask)
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	// around the top left finder
+	for i := range 6 {
+		c.set(8, i, bit(i))
+	}
+	c.set(8, 7, bit(6))
+	c.set(8, 8, bit(7))
+	c.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i))
+	}
+
+	// split between the top right and bottom left finders
+	for i := range 8 {
+		c.set(c.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, c.Size-15+i, bit(i))
+	}
+	c.set(8, c.Size-8, true) // always dark
+}
+
+// versionBits returns the 18 version information bits: 6 data bits and a
+// BCH(18,6) code.
+func versionBits(version int) int {
+	rem := version
+	for range 12 {
+		rem = rem<<1 ^ (rem>>11)*0x1f25
+	}
+	return version<<12 | rem
+}
+
+func (c *Code) drawVersionBits(version int) {
+	if version < 7 {
+		return
+	}
+	bits := versionBits(version)
+	for i := range 18 {
+		dark := bits>>i&1 == 1
+		a, b := c.Size-11+i%3, i/3
+		c.set(a, b, dark)
+		c.set(b, a, dark)
+	}
+}
+
+// drawCodewords fills the modules that aren't function patterns with codewords, in
+// two module wide columns zigzagging up and down from the bottom right.
+func (c *Code) drawCodewords(codewords []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := range c.Size {
+			y := vert
+			if upward {
+				y = c.Size - 1 - vert
+			}
+			for j := range 2 {
+				x := right - j
+				if c.function[y*c.Size+x] || i >= len(codewords)*8 {
+					continue
+				}
+				c.modules[y*c.Size+x] = codewords[i/8]>>(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts the modules that aren't function patterns where mask's
+// condition holds.
+func (c *Code) applyMask(mask int) {
+	for y := range c.Size {
+		for x := range c.Size {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !c.function[y*c.Size+x] {
+				c.modules[y*c.Size+x] = !c.modules[y*c.Size+x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code is to scan, by the four rules of the standard:
+// long runs of one color, 2x2 blocks, patterns that look like finders, and
+// imbalance between dark and light modules. The mask with the lowest score is used.
+func (c *Code) penalty() int {
+	p := 0
+	line := make([]bool, c.Size)
+	for _, vertical := range []bool{false, true} {
+		for i := range c.Size {
+			for j := range c.Size {
+				if vertical {
+					line[j] = c.Dark(i, j)
+				} else {
+					line[j] = c.Dark(j, i)
+				}
+			}
+			p += linePenalty(line)
+		}
+	}
+
+	dark := 0
+	for y := range c.Size {
+		for x := range c.Size {
+			d := c.Dark(x, y)
+			if d {
+				dark++
+			}
+			if x+1 < c.Size && y+1 < c.Size && d == c.Dark(x+1, y) && d == c.Dark(x, y+1) && d == c.Dark(x+1, y+1) {
+				p += 3
+			}
+		}
+	}
+	total := c.Size * c.Size
+	// 10 points for every full 5% the share of dark modules deviates from 50%
+	p += abs(dark*20-total*10) / total * 10
+	return p
+}
+
+// linePenalty scores the runs and finder-like patterns of one row or column.
+func linePenalty(line []bool) int {
+	p := 0
+	for i := 0; i < len(line); {
+		run := 1
+		for i+run < len(line) && line[i+run] == line[i] {
+			run++
+		}
+		if run >= 5 {
+			p += run - 2
+		}
+		i += run
+	}
+
+	// dark-light-dark-dark-dark-light-dark with 4 light modules on either side,
+	// counting the quiet zone as light
+	finder := []bool{true, false, true, true, true, false, true}
+	light := func(i int) bool { return i < 0 || i >= len(line) || !line[i] }
+	for i := 0; i+len(finder) <= len(line); i++ {
+		match := true
+		for j, d := range finder {
+			if line[i+j] != d {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		before, after := true, true
+		for j := 1; j <= 4; j++ {
+			before = before && light(i-j)
+			after = after && light(i+len(finder)-1+j)
+		}
+		if before {
+			p += 40
+		}
+		if after {
+			p += 40
+		}
+	}
+	return p
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,122 @@
+package qrcode
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRSRemainder(t *testing.T) {
+	// "HELLO WORLD" as version 1-M data codewords and their error correction codewords
+	data := []byte{0x20, 0x5b, 0x0b, 0x78, 0xd1, 0x72, 0xdc, 0x4d, 0x43, 0x40, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11}
+	want := []byte{0xc4, 0x23, 0x27, 0x77, 0xeb, 0xd7, 0xe7, 0xe2, 0x5d, 0x17}
+	if got := rsRemainder(data, rsDivisor(len(want))); !bytes.Equal(got, want) {
+		t.Errorf("rsRemainder = % x, want % x", got, want)
+	}
+}
+
+func TestFormatAndVersionBits(t *testing.T) {
+	for mask, want := range []int{0x5412, 0x5125, 0x5e7c, 0x5b4b, 0x45f9, 0x40ce, 0x4f97, 0x4aa0} {
+		if got := formatBits(mask); got != want {
+			t.Errorf("formatBits(%d) = %#x, want %#x", mask, got, want)
+		}
+	}
+	if got := versionBits(7); got != 0x07c94 {
+		t.Errorf("versionBits(7) = %#x, want 0x07c94", got)
+	}
+	if got := versionBits(40); got != 0x28c69 {
+		t.Errorf("versionBits(40) = %#x, want 0x28c69", got)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		size    int
+		version int
+	}{
+		{1, 1},
+		{14, 1},
+		{15, 2},
+		{106, 6},
+		{107, 7},
+		{2331, 40},
+	}
+	for _, tt := range tests {
+		c, err := Encode(bytes.Repeat([]byte("a"), tt.size))
+		if err != nil {
+			t.Fatalf("Encode(%d bytes): %v", tt.size, err)
+		}
+		if want := tt.version*4 + 17; c.Size != want {
+			t.Errorf("Encode(%d bytes) is %d modules wide, want %d", tt.size, c.Size, want)
+		}
+	}
+
+	if _, err := Encode(bytes.Repeat([]byte("a"), 2332)); err != ErrTooLong {
+		t.Errorf("Encode of 2332 bytes: got %v, want ErrTooLong", err)
+	}
+}
+
+func TestEncodePatterns(t *testing.T) {
+	c, err := Encode([]byte("https://shhh.example.com/secret/508fc053f1ca4bb28fb2eb44b8f95ea0#RNpqRfsr4_qEprn1FTdsxUCu2zRSZ1wPnj5YW5I_DOM"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// finder patterns: dark ring, light ring, dark 3x3 center
+	for _, corner := range [][2]int{{0, 0}, {c.Size - 7, 0}, {0, c.Size - 7}} {
+		for dy := range 7 {
+			for dx := range 7 {
+				d := max(abs(dx-3), abs(dy-3))
+				if want := d != 2; c.Dark(corner[0]+dx, corner[1]+dy) != want {
+					t.Fatalf("finder at %v: module %d,%d is wrong", corner, dx, dy)
+				}
+			}
+		}
+	}
+	if !c.Dark(8, c.Size-8) {
+		t.Error("dark module is light")
+	}
+
+	// both copies of the format information decode to level M
+	var first, second int
+	for i := range 6 {
+		first |= b2i(c.Dark(8, i)) << i
+	}
+	first |= b2i(c.Dark(8, 7))<<6 | b2i(c.Dark(8, 8))<<7 | b2i(c.Dark(7, 8))<<8
+	for i := 9; i < 15; i++ {
+		first |= b2i(c.Dark(14-i, 8)) << i
+	}
+	for i := range 8 {
+		second |= b2i(c.Dark(c.Size-1-i, 8)) << i
+	}
+	for i := 8; i < 15; i++ {
+		second |= b2i(c.Dark(8, c.Size-15+i)) << i
+	}
+	if first != second {
+		t.Fatalf("format copies differ: %#x, %#x", first, second)
+	}
+	if level := (first ^ 0x5412) >> 13; level != formatLevelM {
+		t.Errorf("format level = %d, want M", level)
+	}
+}
+
+func TestSVG(t *testing.T) {
+	c, err := Encode([]byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg := c.SVG()
+	if !strings.HasPrefix(svg, "<svg ") || !strings.Contains(svg, `viewBox="0 0 29 29"`) {
+		t.Errorf("unexpected SVG: %.80s", svg)
+	}
+	// the top row of the top left finder is one 7 module run inside the quiet zone
+	if !strings.Contains(svg, `d="M4 4h7v1h-7z`) {
+		t.Errorf("SVG doesn't start with the finder row: %.120s", svg)
+	}
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
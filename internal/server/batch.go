@@ -0,0 +1,321 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/en9inerd/go-pkgs/httpjson"
+	"github.com/en9inerd/shhh/internal/config"
+	"github.com/en9inerd/shhh/internal/memstore"
+)
+
+// maxBatchPassphrases bounds the passphrase keys derived for one batch. Each takes a
+// few hundred milliseconds of Argon2, so many more wouldn't be done before the server's
+// write timeout ends the request. Link mode and recipient secrets derive none.
+const maxBatchPassphrases = 20
+
+type batchRequest struct {
+	Secrets []batchSecret `json:"secrets"`
+}
+
+// batchSecret is one secret of a batch. Its name is only echoed in its result, so
+// clients can match results to their own records.
+type batchSecret struct {
+	Name string `json:"name"`
+	saveSecretRequest
+}
+
+// batchResult is the outcome of creating one secret of a batch: its key, URL and
+// management token, or why it wasn't created.
+type batchResult struct {
+	Name        string    `json:"name,omitempty"`
+	Key         string    `json:"key,omitempty"`
+	Exp         int       `json:"exp,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	Token       string    `json:"token,omitempty"`
+	ManageToken string    `json:"manage_token,omitempty"`
+	Error       *apiError `json:"error,omitempty"`
+}
+
+// batchPassphrases counts the passphrase keys creating secrets derives.
+func batchPassphrases(secrets []batchSecret) int {
+	n := 0
+	for _, s := range secrets {
+		if s.Recipient != "" || s.Mode == linkMode {
+			continue
+		}
+		n += 1 + len(s.Passphrases)
+		if s.Duress != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// createBatch creates secrets together. Invalid secrets get an error in their result
+// and the others are still created, but store capacity is all-or-nothing: if the store
+// can't hold every valid secret, none is stored and ErrFull is returned. A bad sender
+// token fails the whole batch too.
+func createBatch(r *http.Request, cfg *config.Config, memStore *memstore.MemoryStore, signers *signers, secrets []batchSecret) ([]batchResult, error) {
+	results := make([]batchResult, len(secrets))
+	datas := make([][]byte, len(secrets))
+	metas := make([]memstore.Metadata, len(secrets))
+	var valid []int
+	for i := range secrets {
+		s := &secrets[i]
+		results[i].Name = s.Name
+		s.Validate(&s.Validator, cfg)
+		if !s.Valid() {
+			results[i].Error = &apiError{Code: codeValidationFailed, Message: "validation failed", Fields: s.FieldErrors}
+			continue
+		}
+		datas[i], metas[i] = s.content()
+		var err error
+		metas[i].Signature, err = signers.sign(r, datas[i], s.Signature)
+		if errors.Is(err, errBadAuthorization) || errors.Is(err, errUnknownSender) {
+			return nil, err
+		}
+		if err != nil {
+			results[i].Error = &apiError{Code: codeInvalidSignature, Message: err.Error()}
+			continue
+		}
+		valid = append(valid, i)
+	}
+
+	batch, err := memStore.NewBatch(len(valid))
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range valid {
+		s := &secrets[i]
+		key := secretKey{
+			passphrase:  s.PassPhrase,
+			passphrases: s.Passphrases,
+			duress:      s.Duress,
+			duressAlert: s.DuressAlert,
+			recipient:   s.Recipient,
+			mode:        s.Mode,
+		}
+		id, token, _, err := storeSecret(batch, datas[i], metas[i], key, calculateTTL(s.Exp, cfg.MaxRetention))
+		if errors.Is(err, memstore.ErrFull) {
+			return nil, err
+		}
+		if err != nil {
+			_, code := storeErrorStatus(err)
+			results[i].Error = &apiError{Code: code, Message: "can't create secret", Retryable: code.retryable()}
+			continue
+		}
+		results[i].Key, results[i].Exp, results[i].Token = id, s.Exp, token
+		results[i].URL = secretLink(r, cfg, id, token)
+	}
+
+	tokens, err := batch.Commit()
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].ManageToken = tokens[results[i].Key]
+	}
+	return results, nil
+}
+
+func saveSecretBatch(l *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore, signers *signers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req batchRequest
+		if err := httpjson.DecodeJSON(r, &req); err != nil {
+			l.Warn("can't bind request", "error", err)
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, err, "can't decode request")
+			return
+		}
+		if len(req.Secrets) == 0 || len(req.Secrets) > cfg.MaxItems {
+			sendFieldErrors(w, r, l, map[string][]string{
+				"secrets": {fmt.Sprintf("between 1 and %d secrets are required", cfg.MaxItems)},
+			})
+			return
+		}
+		if batchPassphrases(req.Secrets) > maxBatchPassphrases {
+			sendFieldErrors(w, r, l, map[string][]string{
+				"secrets": {fmt.Sprintf("at most %d passphrases can be used in one batch, use link mode for more secrets", maxBatchPassphrases)},
+			})
+			return
+		}
+
+		results, err := createBatch(r, cfg, memStore, signers, req.Secrets)
+		if errors.Is(err, errBadAuthorization) || errors.Is(err, errUnknownSender) {
+			sendSignError(w, r, l, err)
+			return
+		}
+		if err != nil {
+			sendStoreError(w, r, l, err, "can't create batch")
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		httpjson.WriteJSON(w, httpjson.JSON{"results": results})
+		created := 0
+		for _, res := range results {
+			if res.Error == nil {
+				created++
+			}
+		}
+		l.Info("created secret batch", "count", len(results), "created", created)
+	}
+}
+
+// revokeSecret deletes a secret before it is read, given the management token it was
+// created with. Unknown secrets and wrong tokens get the same not found response.
+func revokeSecret(l *slog.Logger, memStore *memstore.MemoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if err := memStore.Revoke(id, r.Header.Get("X-Manage-Token")); err != nil {
+			sendRetrieveError(w, r, l, id, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		l.Info("revoked secret", "id", id)
+	}
+}
+
+// batchRow is a row of a batch CSV upload.
+type batchRow struct {
+	name, secret, passphrase string
+}
+
+// parseBatchCSV reads name,secret rows, with an optional passphrase column and an
+// optional name,secret header row.
+func parseBatchCSV(data []byte, maxRows int) ([]batchRow, error) {
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.FieldsPerRecord = -1
+	var rows []batchRow
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+		if line == 1 && len(rec) >= 2 && strings.EqualFold(strings.TrimSpace(rec[0]), "name") && strings.EqualFold(strings.TrimSpace(rec[1]), "secret") {
+			continue
+		}
+		if len(rec) < 2 || len(rec) > 3 {
+			return nil, fmt.Errorf("line %d: expected name,secret or name,secret,passphrase", line)
+		}
+		row := batchRow{name: strings.TrimSpace(rec[0]), secret: rec[1]}
+		if len(rec) == 3 {
+			row.passphrase = rec[2]
+		}
+		rows = append(rows, row)
+		if len(rows) > maxRows {
+			return nil, fmt.Errorf("at most %d secrets can be created at once", maxRows)
+		}
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("the CSV has no secrets")
+	}
+	return rows, nil
+}
+
+// writeBatchCSV writes batch results as name,url,manage_token,error rows.
+func writeBatchCSV(w io.Writer, results []batchResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "url", "manage_token", "error"})
+	for _, res := range results {
+		var msg string
+		if res.Error != nil {
+			msg = res.Error.Message
+			for _, field := range slices.Sorted(maps.Keys(res.Error.Fields)) {
+				msg += "; " + field + ": " + strings.Join(res.Error.Fields[field], ", ")
+			}
+		}
+		cw.Write([]string{res.Name, res.URL, res.ManageToken, msg})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func batchPage(logger *slog.Logger, cfg *config.Config, templates *templateCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderBatchPage(w, logger, cfg, templates, "")
+	}
+}
+
+func renderBatchPage(w http.ResponseWriter, logger *slog.Logger, cfg *config.Config, templates *templateCache, errMsg string) {
+	intervals := getExpirationIntervals(cfg.MaxRetention)
+	for i := range intervals {
+		if intervals[i].Seconds > 0 {
+			intervals[i].Selected = true
+			break
+		}
+	}
+	renderPage(w, logger, templates, "batch", &templateData{
+		Config:      cfg,
+		Intervals:   intervals,
+		Form:        map[string]string{"error": errMsg},
+		PageTitle:   "Create Many Secrets - SHHH",
+		PageDesc:    "Create one-time links for many secrets from a CSV file",
+		CurrentYear: time.Now().Year(),
+	})
+}
+
+// createBatchWeb creates a secret for every row of an uploaded CSV and responds with a
+// CSV of their links to download. Rows without a passphrase get link mode secrets.
+func createBatchWeb(logger *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore, templates *templateCache, signers *signers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, _, err := readMultipartFile(r, cfg.MaxFileSize)
+		if err != nil {
+			logger.Warn("failed to read CSV upload", "error", err)
+			renderBatchPage(w, logger, cfg, templates, "A CSV file is required")
+			return
+		}
+		exp, err := parseExpiration(r.FormValue("exp_unit"), r.FormValue("custom_exp"))
+		if err != nil {
+			renderBatchPage(w, logger, cfg, templates, err.Error())
+			return
+		}
+		rows, err := parseBatchCSV(data, cfg.MaxItems)
+		if err != nil {
+			renderBatchPage(w, logger, cfg, templates, err.Error())
+			return
+		}
+
+		secrets := make([]batchSecret, len(rows))
+		for i, row := range rows {
+			secrets[i] = batchSecret{Name: row.name, saveSecretRequest: saveSecretRequest{Secret: row.secret, Exp: exp, PassPhrase: row.passphrase}}
+			if row.passphrase == "" {
+				secrets[i].Mode = linkMode
+			}
+		}
+		if batchPassphrases(secrets) > maxBatchPassphrases {
+			renderBatchPage(w, logger, cfg, templates, fmt.Sprintf("At most %d rows can have a passphrase, leave it out of the others to give them links.", maxBatchPassphrases))
+			return
+		}
+		results, err := createBatch(r, cfg, memStore, signers, secrets)
+		if err != nil {
+			logger.Warn("failed to create batch", "error", err)
+			msg := "Failed to create secrets"
+			if errors.Is(err, memstore.ErrFull) {
+				msg = "Not enough room for all the secrets, none were created. Try again later or with fewer rows."
+			}
+			renderBatchPage(w, logger, cfg, templates, msg)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="shhh-links.csv"`)
+		w.Header().Set("Cache-Control", "no-store")
+		if err := writeBatchCSV(w, results); err != nil {
+			logger.Error("failed to write batch CSV", "error", err)
+		}
+		logger.Info("created secret batch from CSV", "count", len(results))
+	}
+}
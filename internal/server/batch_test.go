@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRevokeSecret(t *testing.T) {
+	handler := newTestServer(t)
+
+	resp := serve(handler, http.MethodPost, "/api/v1/secrets:batch", strings.NewReader(`{"secrets": [
+		{"name": "alice", "secret": "s1", "exp": 3600, "passphrase": "correct-horse-battery-staple"},
+		{"name": "bob", "secret": "s2", "exp": 3600, "passphrase": "correct-horse-battery-staple"}
+	]}`), jsonHeader())
+	var batch struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("can't create batch: %d, %v", resp.StatusCode, err)
+	}
+	if len(batch.Results) != 2 {
+		t.Fatalf("got %d results, want 2", len(batch.Results))
+	}
+	alice, bob := batch.Results[0], batch.Results[1]
+	if alice.ManageToken == "" || bob.ManageToken == "" {
+		t.Fatal("expected a management token for each secret")
+	}
+	if want := "http://example.com/secret/" + alice.Key; alice.URL != want {
+		t.Errorf("url %q, want %q", alice.URL, want)
+	}
+
+	revoke := func(id, token string) int {
+		return serve(handler, http.MethodDelete, "/api/v1/secret/"+id, nil, http.Header{"X-Manage-Token": {token}}).StatusCode
+	}
+	if status := revoke(alice.Key, bob.ManageToken); status != http.StatusNotFound {
+		t.Errorf("revoke with another secret's token: status %d, want 404", status)
+	}
+	if status := revoke(alice.Key, ""); status != http.StatusNotFound {
+		t.Errorf("revoke without a token: status %d, want 404", status)
+	}
+	if status := revoke(alice.Key, alice.ManageToken); status != http.StatusNoContent {
+		t.Fatalf("revoke: status %d, want 204", status)
+	}
+	if status := revoke(alice.Key, alice.ManageToken); status != http.StatusNotFound {
+		t.Errorf("second revoke: status %d, want 404", status)
+	}
+
+	retrieve := func(id string) int {
+		return serve(handler, http.MethodPost, "/api/v1/secret/"+id,
+			strings.NewReader(`{"passphrase": "correct-horse-battery-staple"}`), jsonHeader()).StatusCode
+	}
+	if status := retrieve(alice.Key); status != http.StatusNotFound {
+		t.Errorf("retrieve revoked secret: status %d, want 404", status)
+	}
+	if status := retrieve(bob.Key); status != http.StatusOK {
+		t.Errorf("retrieve other secret: status %d, want 200", status)
+	}
+}
+
+func TestSaveSecretBatch_PassphraseLimit(t *testing.T) {
+	handler := newTestServer(t)
+	batch := func(secrets ...string) *http.Response {
+		return serve(handler, http.MethodPost, "/api/v1/secrets:batch",
+			strings.NewReader(`{"secrets": [`+strings.Join(secrets, ",")+`]}`), jsonHeader())
+	}
+	passphrase := `{"secret": "s", "exp": 3600, "passphrase": "correct-horse-battery-staple"}`
+	link := `{"secret": "s", "exp": 3600, "mode": "link"}`
+
+	tooMany := make([]string, maxBatchPassphrases+1)
+	for i := range tooMany {
+		tooMany[i] = passphrase
+	}
+	resp := batch(tooMany...)
+	var body struct {
+		Error apiError `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusBadRequest || len(body.Error.Fields["secrets"]) == 0 {
+		t.Errorf("too many passphrases: status %d, %+v, want 400 on secrets", resp.StatusCode, body.Error)
+	}
+
+	// link mode secrets derive no keys, and extra and duress passphrases each count
+	links := make([]string, maxBatchPassphrases+1)
+	for i := range links {
+		links[i] = link
+	}
+	if resp := batch(links...); resp.StatusCode != http.StatusOK {
+		t.Errorf("link mode secrets: status %d, want 200", resp.StatusCode)
+	}
+	secrets := []batchSecret{{saveSecretRequest: saveSecretRequest{
+		PassPhrase: "first", Passphrases: []string{"second", "third"}, Duress: "fourth",
+	}}}
+	if n := batchPassphrases(secrets); n != 4 {
+		t.Errorf("counted %d passphrases, want 4", n)
+	}
+}
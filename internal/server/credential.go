@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/en9inerd/shhh/internal/config"
+	"github.com/en9inerd/shhh/internal/crypto"
+	"github.com/en9inerd/shhh/internal/memstore"
+	"github.com/en9inerd/shhh/internal/validator"
+)
+
+const (
+	// maxCredentialField bounds the one-line fields of a credential. The password and
+	// notes are only bounded by the secret size.
+	maxCredentialField = 2048
+
+	// minTOTPSeedChars is 80 bits of base32, the shortest seed RFC 4226 allows.
+	minTOTPSeedChars = 16
+)
+
+// validateCredential checks a credential secret. Field errors are keyed by prefix and
+// the field's JSON name.
+func validateCredential(v *validator.Validator, c *memstore.Credential, prefix string, cfg *config.Config) {
+	v.CheckField(validator.NotBlank(c.Password), prefix+"password", "password is required")
+	v.CheckField(validator.MaxChars(c.Username, maxCredentialField), prefix+"username", "username is too long")
+	v.CheckField(c.URL == "" || validator.IsURL(c.URL), prefix+"url", "url must be an http or https URL")
+	v.CheckField(validator.MaxChars(c.URL, maxCredentialField), prefix+"url", "url is too long")
+	if c.TOTPSeed != "" {
+		v.CheckField(validator.IsBase32(c.TOTPSeed), prefix+"totp_seed", "TOTP seed must be base32")
+		v.CheckField(validator.MinChars(strings.Join(strings.Fields(c.TOTPSeed), ""), minTOTPSeedChars), prefix+"totp_seed", "TOTP seed is too short")
+		v.CheckField(validator.MaxChars(c.TOTPSeed, maxCredentialField), prefix+"totp_seed", "TOTP seed is too long")
+	}
+	data, _ := json.Marshal(c)
+	v.CheckField(int64(len(data)) <= cfg.MaxFileSize, strings.TrimSuffix(prefix, "."), "credential exceeds maximum size")
+}
+
+// credentialFromForm reads the credential fields of the web form.
+func credentialFromForm(r *http.Request) *memstore.Credential {
+	return &memstore.Credential{
+		Username: r.FormValue("username"),
+		Password: r.FormValue("password"),
+		URL:      strings.TrimSpace(r.FormValue("url")),
+		TOTPSeed: strings.TrimSpace(r.FormValue("totp_seed")),
+		Notes:    r.FormValue("notes"),
+	}
+}
+
+// fieldErrorsMessage joins validation errors into one message for the web UI, which
+// shows a single error line.
+func fieldErrorsMessage(fields map[string][]string) string {
+	var msgs []string
+	for _, field := range slices.Sorted(maps.Keys(fields)) {
+		msgs = append(msgs, fields[field]...)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// credentialContent validates a credential and returns the data and metadata to store.
+func credentialContent(c *memstore.Credential, cfg *config.Config) ([]byte, memstore.Metadata, error) {
+	var v validator.Validator
+	validateCredential(&v, c, "", cfg)
+	if !v.Valid() {
+		return nil, memstore.Metadata{}, errors.New(fieldErrorsMessage(v.FieldErrors))
+	}
+	data, err := json.Marshal(c)
+	return data, memstore.CredentialMetadata(), err
+}
+
+// credentialView is a retrieved credential as the result page shows it. The TOTP code
+// of the current period is rendered by the server, so it is shown even where the page
+// script can't compute codes itself.
+type credentialView struct {
+	memstore.Credential
+	TOTPKey     string // the seed as unpadded upper case base32, for the page script
+	TOTPCode    string
+	TOTPExpires int64 // unix time the code expires
+}
+
+func newCredentialView(data []byte, now time.Time) (*credentialView, error) {
+	var view credentialView
+	if err := json.Unmarshal(data, &view.Credential); err != nil {
+		return nil, err
+	}
+	if key, err := crypto.ParseTOTPSeed(view.TOTPSeed); err == nil {
+		period := int64(crypto.TOTPPeriod / time.Second)
+		view.TOTPKey = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+		view.TOTPCode = crypto.TOTP(key, now)
+		view.TOTPExpires = (now.Unix()/period + 1) * period
+	}
+	return &view, nil
+}
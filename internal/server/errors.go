@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/en9inerd/go-pkgs/httpjson"
+	"github.com/en9inerd/shhh/internal/crypto"
+	"github.com/en9inerd/shhh/internal/memstore"
+)
+
+// errorCode is a machine-readable error code of the v1 API. Codes are part of the API:
+// new ones may be added, but existing ones are never changed or removed.
+type errorCode string
+
+const (
+	codeInvalidRequest   errorCode = "invalid_request"   // the body or a parameter can't be parsed
+	codeValidationFailed errorCode = "validation_failed" // fields are invalid, see the field errors
+	codeSecretNotFound   errorCode = "secret_not_found"  // unknown, expired, already read, or wrong passphrase or key
+	codeTooLarge         errorCode = "too_large"         // the secret exceeds the size limit
+	codeStoreFull        errorCode = "store_full"        // no room for new secrets, retry later
+	codeBusy             errorCode = "busy"              // too many retrievals in progress, retry later
+	codeNotApproved      errorCode = "not_approved"      // not available in FIPS mode
+	codeUnauthorized     errorCode = "unauthorized"      // the sender token is unknown
+	codeInvalidSignature errorCode = "invalid_signature" // the sender signature doesn't verify
+	codeInvalidShares    errorCode = "invalid_shares"    // shares are corrupted, duplicated or from different secrets
+
+	codeIdempotencyKeyReused  errorCode = "idempotency_key_reused"  // the Idempotency-Key was sent with a different request
+	codeIdempotencyInProgress errorCode = "idempotency_in_progress" // the first request with the Idempotency-Key hasn't finished
+
+	codeInternal errorCode = "internal_error"
+)
+
+// retryable reports whether the same request may succeed if sent again later.
+func (c errorCode) retryable() bool {
+	return c == codeStoreFull || c == codeBusy || c == codeIdempotencyInProgress || c == codeInternal
+}
+
+// apiError is the error body of the v1 API.
+type apiError struct {
+	Code      errorCode           `json:"code"`
+	Message   string              `json:"message"`
+	Fields    map[string][]string `json:"fields,omitempty"`
+	Retryable bool                `json:"retryable"`
+}
+
+type legacyAPIKey struct{}
+
+// legacyAPI marks requests to the unversioned /api routes, which are kept as deprecated
+// aliases of /api/v1 with their original error responses.
+func legacyAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", `</api/v1>; rel="successor-version"`)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), legacyAPIKey{}, true)))
+	})
+}
+
+func isLegacyAPI(r *http.Request) bool {
+	legacy, _ := r.Context().Value(legacyAPIKey{}).(bool)
+	return legacy
+}
+
+// sendError logs err and responds with msg under code. Client errors are logged as
+// warnings, only internal errors as errors. Legacy routes get the original {"error": msg} body.
+func sendError(w http.ResponseWriter, r *http.Request, l *slog.Logger, status int, code errorCode, err error, msg string) {
+	level := slog.LevelWarn
+	if code == codeInternal {
+		level = slog.LevelError
+	}
+	l.Log(r.Context(), level, "request failed", "method", r.Method, "path", r.URL.Path, "status", status, "code", code, "error", err)
+	if isLegacyAPI(r) {
+		httpjson.SendErrorJSON(w, r, nil, status, err, msg)
+		return
+	}
+	if err := httpjson.EncodeJSON(w, status, httpjson.JSON{
+		"error": apiError{Code: code, Message: msg, Retryable: code.retryable()},
+	}); err != nil {
+		l.Error("can't write error response", "error", err)
+	}
+}
+
+// sendFieldErrors responds with validation errors by field. Legacy routes get the
+// original {"errors": fields} body.
+func sendFieldErrors(w http.ResponseWriter, r *http.Request, l *slog.Logger, fields map[string][]string) {
+	l.Warn("validation failed", "errors", fields)
+	var body any = httpjson.JSON{"errors": fields}
+	if !isLegacyAPI(r) {
+		body = httpjson.JSON{"error": apiError{Code: codeValidationFailed, Message: "validation failed", Fields: fields}}
+	}
+	if err := httpjson.EncodeJSON(w, http.StatusBadRequest, body); err != nil {
+		l.Error("can't write error response", "error", err)
+	}
+}
+
+// sendStoreError responds to an error from storing a secret.
+func sendStoreError(w http.ResponseWriter, r *http.Request, l *slog.Logger, err error, msg string) {
+	status, code := storeErrorStatus(err)
+	sendError(w, r, l, status, code, err, msg)
+}
+
+// storeErrorStatus maps an error from storing a secret to its status and code.
+func storeErrorStatus(err error) (int, errorCode) {
+	switch {
+	case errors.Is(err, memstore.ErrFull):
+		return http.StatusServiceUnavailable, codeStoreFull
+	case errors.Is(err, memstore.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge, codeTooLarge
+	case errors.Is(err, memstore.ErrInvalidTTL), errors.Is(err, memstore.ErrTooManyPassphrases):
+		return http.StatusBadRequest, codeValidationFailed
+	case errors.Is(err, crypto.ErrNotApproved):
+		return http.StatusBadRequest, codeNotApproved
+	default:
+		return http.StatusInternalServerError, codeInternal
+	}
+}
+
+// sendRetrieveError responds to an error from retrieving a secret. Unknown, expired and
+// consumed secrets, wrong passphrases and tampered items all get the same response, so
+// it doesn't reveal which secrets exist.
+func sendRetrieveError(w http.ResponseWriter, r *http.Request, l *slog.Logger, id string, err error) {
+	switch {
+	case errors.Is(err, crypto.ErrTampered):
+		l.Error("secret failed integrity check, possible tampering", "id", id)
+	case errors.Is(err, crypto.ErrUnknownKeyVersion):
+		l.Error("secret is wrapped with a master key the server doesn't have", "id", id)
+	}
+	switch {
+	case errors.Is(err, memstore.ErrNotFound), errors.Is(err, memstore.ErrExpired),
+		errors.Is(err, memstore.ErrWrongKey), errors.Is(err, memstore.ErrNotSealed),
+		errors.Is(err, memstore.ErrSessionNotFound), errors.Is(err, crypto.ErrTampered),
+		errors.Is(err, crypto.ErrUnknownKeyVersion):
+		l.Warn("secret retrieval failed", "id", id)
+		sendError(w, r, l, http.StatusNotFound, codeSecretNotFound, errors.New("secret not found"), "secret not found")
+	case errors.Is(err, memstore.ErrBusy):
+		sendError(w, r, l, http.StatusServiceUnavailable, codeBusy, err, "too many retrievals in progress")
+	default:
+		sendError(w, r, l, http.StatusInternalServerError, codeInternal, err, "can't retrieve secret")
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/en9inerd/shhh/internal/crypto"
+)
+
+const testSecretBody = `{"secret": "s", "exp": 3600, "passphrase": "correct-horse-battery-staple"}`
+
+func jsonHeader() http.Header {
+	return http.Header{"Content-Type": {"application/json"}}
+}
+
+func decodeBody(t *testing.T, resp *http.Response) map[string]any {
+	t.Helper()
+	var body map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("can't decode response: %v", err)
+	}
+	return body
+}
+
+func TestErrorResponses(t *testing.T) {
+	var logs bytes.Buffer
+	handler := newTestServerWith(t, slog.New(slog.NewTextHandler(&logs, nil)), map[string]string{"SHHH_MAX_ITEMS": "1"})
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		status     int
+		want       map[string]any
+		deprecated bool
+	}{
+		{
+			name: "not found", method: http.MethodPost, path: "/api/v1/secret/unknown",
+			body:   `{"passphrase": "correct-horse-battery-staple"}`,
+			status: http.StatusNotFound,
+			want: map[string]any{"error": map[string]any{
+				"code": "secret_not_found", "message": "secret not found", "retryable": false,
+			}},
+		},
+		{
+			name: "validation", method: http.MethodPost, path: "/api/v1/secret",
+			body:   `{"exp": 3600, "passphrase": "correct-horse-battery-staple"}`,
+			status: http.StatusBadRequest,
+			want: map[string]any{"error": map[string]any{
+				"code": "validation_failed", "message": "validation failed", "retryable": false,
+				"fields": map[string]any{"secret": []any{"secret is required"}},
+			}},
+		},
+		{
+			name: "create", method: http.MethodPost, path: "/api/v1/secret",
+			body: testSecretBody, status: http.StatusCreated,
+		},
+		{
+			name: "store full", method: http.MethodPost, path: "/api/v1/secret",
+			body:   testSecretBody,
+			status: http.StatusServiceUnavailable,
+			want: map[string]any{"error": map[string]any{
+				"code": "store_full", "message": "can't create secret", "retryable": true,
+			}},
+		},
+		{
+			name: "legacy not found", method: http.MethodPost, path: "/api/secret/unknown",
+			body:       `{"passphrase": "correct-horse-battery-staple"}`,
+			status:     http.StatusNotFound,
+			want:       map[string]any{"error": "secret not found"},
+			deprecated: true,
+		},
+		{
+			name: "legacy validation", method: http.MethodPost, path: "/api/secret",
+			body:       `{"exp": 3600, "passphrase": "correct-horse-battery-staple"}`,
+			status:     http.StatusBadRequest,
+			want:       map[string]any{"errors": map[string]any{"secret": []any{"secret is required"}}},
+			deprecated: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := serve(handler, tt.method, tt.path, strings.NewReader(tt.body), jsonHeader())
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Deprecation") == "true"; got != tt.deprecated {
+				t.Errorf("Deprecation header %q, want deprecated %v", resp.Header.Get("Deprecation"), tt.deprecated)
+			}
+			if tt.deprecated && resp.Header.Get("Link") != `</api/v1>; rel="successor-version"` {
+				t.Errorf("Link header %q, want the successor version", resp.Header.Get("Link"))
+			}
+			if tt.want == nil {
+				return
+			}
+			if got := decodeBody(t, resp); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("body %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if strings.Contains(logs.String(), "level=ERROR") {
+		t.Errorf("client errors were logged as errors:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), `level=WARN msg="request failed"`) {
+		t.Errorf("client errors were not logged as warnings:\n%s", logs.String())
+	}
+}
+
+func TestSendRetrieveError_UnknownKeyVersion(t *testing.T) {
+	var logs bytes.Buffer
+	rec := httptest.NewRecorder()
+	err := fmt.Errorf("can't unwrap: %w", crypto.ErrUnknownKeyVersion)
+	sendRetrieveError(rec, httptest.NewRequest(http.MethodPost, "/api/v1/secret/abc", nil), slog.New(slog.NewTextHandler(&logs, nil)), "abc", err)
+
+	want := map[string]any{"error": map[string]any{"code": "secret_not_found", "message": "secret not found", "retryable": false}}
+	if got := decodeBody(t, rec.Result()); rec.Code != http.StatusNotFound || !reflect.DeepEqual(got, want) {
+		t.Errorf("status %d, body %v, want 404 %v", rec.Code, got, want)
+	}
+	if !strings.Contains(logs.String(), `level=ERROR msg="secret is wrapped with a master key the server doesn't have"`) {
+		t.Errorf("missing master key was not logged as an error:\n%s", logs.String())
+	}
+}
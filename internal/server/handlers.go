@@ -1,51 +1,291 @@
 package server
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log/slog"
+	"math"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"filippo.io/age"
 	"github.com/en9inerd/go-pkgs/httpjson"
 	"github.com/en9inerd/shhh/internal/config"
+	"github.com/en9inerd/shhh/internal/crypto"
+	"github.com/en9inerd/shhh/internal/diceware"
 	"github.com/en9inerd/shhh/internal/memstore"
 	"github.com/en9inerd/shhh/internal/validator"
 )
 
+// linkMode is the create mode where the server encrypts the secret under a random key
+// and returns it as a token to put in the link, so no passphrase is needed.
+const linkMode = "link"
+
 type saveSecretRequest struct {
-	Secret     string `json:"secret"`
-	Exp        int    `json:"exp"`
-	PassPhrase string `json:"passphrase"`
+	Secret      string               `json:"secret"`
+	Credential  *memstore.Credential `json:"credential"` // a login bundle, instead of the secret text
+	Exp         int                  `json:"exp"`
+	PassPhrase  string               `json:"passphrase"`
+	Passphrases []string             `json:"passphrases"`       // optional extra passphrases, any one of them also opens the secret
+	Duress      string               `json:"duress_passphrase"` // optional, destroys the secret instead of opening it
+	DuressAlert bool                 `json:"duress_alert"`      // send a lifecycle alert when the duress passphrase is used
+	Recipient   string               `json:"recipient"`         // optional public key, replaces the passphrase
+	Mode        string               `json:"mode"`              // optional "link", replaces the passphrase with a random key
+	Signature   *memstore.Signature  `json:"signature"`         // optional sender signature over the secret
 	validator.Validator
 }
 
 func (r *saveSecretRequest) Validate(v *validator.Validator, cfg *config.Config) {
+	if r.Credential != nil {
+		v.CheckField(r.Secret == "", "secret", "a secret can't have both text and a credential")
+		validateCredential(v, r.Credential, "credential.", cfg)
+	} else {
+		v.CheckField(validator.NotBlank(r.Secret), "secret", "secret is required")
+		v.CheckField(validator.MaxChars(r.Secret, int(cfg.MaxFileSize)), "secret", "secret exceeds maximum size")
+	}
+	v.CheckField(r.Mode == "" || r.Mode == linkMode, "mode", "mode must be empty or link")
+	if r.Recipient != "" && cfg.FIPS {
+		v.AddFieldError("recipient", errRecipientNotApproved.Error())
+	} else if r.Recipient != "" {
+		_, err := crypto.ParseRecipient(r.Recipient)
+		v.CheckField(err == nil, "recipient", "recipient is not a valid public key")
+	} else if r.Mode != linkMode {
+		if err := validatePassphrase(r.PassPhrase, cfg); err != nil {
+			v.AddFieldError("passphrase", err.Error())
+		}
+		if err := validateExtraPassphrases(r.Passphrases, cfg); err != nil {
+			v.AddFieldError("passphrases", err.Error())
+		}
+		if err := validateDuress(r.Duress, r.DuressAlert, append([]string{r.PassPhrase}, r.Passphrases...), cfg); err != nil {
+			v.AddFieldError("duress_passphrase", err.Error())
+		}
+	}
+	v.CheckField(len(r.Passphrases) == 0 || (r.Recipient == "" && r.Mode != linkMode), "passphrases", errNeedsPassphrase.Error())
+	v.CheckField(r.Duress == "" || (r.Recipient == "" && r.Mode != linkMode), "duress_passphrase", errNeedsPassphrase.Error())
+	v.CheckField(validator.MinInt(r.Exp, 1), "exp", "expiration must be at least 1 second")
+}
+
+// content returns the data and metadata to store: the secret text, or the JSON encoding
+// of the credential, which is also what signatures and content fingerprints cover.
+func (r *saveSecretRequest) content() ([]byte, memstore.Metadata) {
+	if r.Credential != nil {
+		data, _ := json.Marshal(r.Credential)
+		return data, memstore.CredentialMetadata()
+	}
+	return []byte(r.Secret), memstore.TextMetadata()
+}
+
+type saveSharesRequest struct {
+	Secret      string   `json:"secret"`
+	Exp         int      `json:"exp"`
+	Threshold   int      `json:"threshold"`
+	Passphrases []string `json:"passphrases"` // one per share
+	validator.Validator
+}
+
+func (r *saveSharesRequest) Validate(v *validator.Validator, cfg *config.Config) {
 	v.CheckField(validator.NotBlank(r.Secret), "secret", "secret is required")
 	v.CheckField(validator.MaxChars(r.Secret, int(cfg.MaxFileSize)), "secret", "secret exceeds maximum size")
-	v.CheckField(validator.NotBlank(r.PassPhrase), "passphrase", "passphrase is required")
-	v.CheckField(validator.MinChars(r.PassPhrase, cfg.MinPhraseSize), "passphrase", fmt.Sprintf("passphrase must be at least %d characters", cfg.MinPhraseSize))
-	v.CheckField(validator.MaxChars(r.PassPhrase, cfg.MaxPhraseSize), "passphrase", fmt.Sprintf("passphrase must be at most %d characters", cfg.MaxPhraseSize))
+	v.CheckField(len(r.Passphrases) >= 2 && len(r.Passphrases) <= min(255, cfg.MaxItems), "passphrases", fmt.Sprintf("between 2 and %d passphrases are required", min(255, cfg.MaxItems)))
+	v.CheckField(r.Threshold >= 2 && r.Threshold <= len(r.Passphrases), "threshold", "threshold must be between 2 and the number of passphrases")
+	for i, p := range r.Passphrases {
+		if err := validatePassphrase(p, cfg); err != nil {
+			v.AddFieldError("passphrases", fmt.Sprintf("passphrase %d: %v", i+1, err))
+		}
+	}
 	v.CheckField(validator.MinInt(r.Exp, 1), "exp", "expiration must be at least 1 second")
 }
 
+// validatePassphrase applies the passphrase rules shared by every create path. They are
+// checked on the normalized passphrase that keys are derived from, counting characters.
 func validatePassphrase(passphrase string, cfg *config.Config) error {
+	passphrase = crypto.NormalizePassphrase(passphrase)
 	if passphrase == "" {
 		return errors.New("passphrase is required")
 	}
-	if len(passphrase) < cfg.MinPhraseSize {
+	if !validator.MinChars(passphrase, cfg.MinPhraseSize) {
 		return fmt.Errorf("passphrase must be at least %d characters", cfg.MinPhraseSize)
 	}
-	if len(passphrase) > cfg.MaxPhraseSize {
+	if !validator.MaxChars(passphrase, cfg.MaxPhraseSize) {
 		return fmt.Errorf("passphrase must be at most %d characters", cfg.MaxPhraseSize)
 	}
+	if !validator.MinEntropy(passphrase, cfg.MinPassphraseEntropy) {
+		return fmt.Errorf("passphrase is too weak, it needs an estimated %g bits of entropy", cfg.MinPassphraseEntropy)
+	}
 	return nil
 }
 
+// strengthResponse is a passphrase's estimated strength and whether it meets the configured minimum.
+type strengthResponse struct {
+	validator.Strength
+	Label      string  `json:"label"`
+	MinEntropy float64 `json:"min_entropy"`
+	Acceptable bool    `json:"acceptable"`
+}
+
+// passphraseStrength estimates a passphrase's strength. Passphrases longer than the
+// configured maximum are rejected first: they can't be used, and are slow to estimate.
+func passphraseStrength(passphrase string, cfg *config.Config) (strengthResponse, error) {
+	passphrase = crypto.NormalizePassphrase(passphrase)
+	if !validator.MaxChars(passphrase, cfg.MaxPhraseSize) {
+		return strengthResponse{}, fmt.Errorf("passphrase must be at most %d characters", cfg.MaxPhraseSize)
+	}
+	s := validator.PassphraseStrength(passphrase)
+	return strengthResponse{
+		Strength:   s,
+		Label:      s.Label(),
+		MinEntropy: cfg.MinPassphraseEntropy,
+		Acceptable: cfg.MinPassphraseEntropy <= 0 || s.Entropy >= cfg.MinPassphraseEntropy,
+	}, nil
+}
+
+// errRecipientNotApproved is returned for recipient secrets in FIPS mode, since the
+// hybrid X25519 key exchange is not an approved algorithm.
+var errRecipientNotApproved = errors.New("public key encryption is not available in FIPS mode")
+
+// errNeedsPassphrase is returned when extra or duress passphrases are given for a
+// secret that isn't encrypted under a passphrase.
+var errNeedsPassphrase = errors.New("extra and duress passphrases only work with a passphrase")
+
+// secretKey says how a new secret is encrypted: to a recipient public key, under a
+// random key returned as a link token, or under one or more passphrases.
+type secretKey struct {
+	passphrase  string
+	passphrases []string // extra passphrases, each in its own key slot
+	duress      string   // destroys the secret instead of opening it
+	duressAlert bool
+	recipient   string
+	mode        string
+}
+
+// secretKeyFromForm reads the key fields of a form. Extra passphrases are given
+// one per line, in one or more "passphrases" fields.
+func secretKeyFromForm(r *http.Request) secretKey {
+	key := secretKey{
+		passphrase:  r.FormValue("passphrase"),
+		duress:      r.FormValue("duress_passphrase"),
+		duressAlert: r.FormValue("duress_alert") != "",
+		recipient:   strings.TrimSpace(r.FormValue("recipient")),
+		mode:        r.FormValue("mode"),
+	}
+	for _, v := range r.Form["passphrases"] {
+		for line := range strings.Lines(v) {
+			if line = strings.TrimSpace(line); line != "" {
+				key.passphrases = append(key.passphrases, line)
+			}
+		}
+	}
+	return key
+}
+
+// validate checks the passphrase, unless the secret is encrypted to a recipient or a link key.
+func (k secretKey) validate(cfg *config.Config) error {
+	if (len(k.passphrases) > 0 || k.duress != "") && (k.recipient != "" || k.mode != "") {
+		return errNeedsPassphrase
+	}
+	switch {
+	case k.recipient != "" && cfg.FIPS:
+		return errRecipientNotApproved
+	case k.recipient != "":
+		if _, err := crypto.ParseRecipient(k.recipient); err != nil {
+			return errors.New("recipient is not a valid public key")
+		}
+		return nil
+	case k.mode == linkMode:
+		return nil
+	case k.mode != "":
+		return errors.New("mode must be empty or link")
+	default:
+		if err := validatePassphrase(k.passphrase, cfg); err != nil {
+			return err
+		}
+		if err := validateExtraPassphrases(k.passphrases, cfg); err != nil {
+			return err
+		}
+		return validateDuress(k.duress, k.duressAlert, append([]string{k.passphrase}, k.passphrases...), cfg)
+	}
+}
+
+// validateExtraPassphrases checks the passphrases given on top of the main one.
+// Together they must fit in the configured number of key slots.
+func validateExtraPassphrases(passphrases []string, cfg *config.Config) error {
+	if len(passphrases)+1 > cfg.MaxKeySlots {
+		return fmt.Errorf("at most %d passphrases are allowed", cfg.MaxKeySlots)
+	}
+	for i, p := range passphrases {
+		if err := validatePassphrase(p, cfg); err != nil {
+			return fmt.Errorf("passphrase %d: %w", i+2, err)
+		}
+	}
+	return nil
+}
+
+// validateDuress checks an optional duress passphrase against the passphrases that open
+// the secret. It takes a key slot of its own, and alerts need a configured webhook.
+func validateDuress(duress string, alert bool, passphrases []string, cfg *config.Config) error {
+	if duress == "" {
+		if alert {
+			return errors.New("duress alert needs a duress passphrase")
+		}
+		return nil
+	}
+	if err := validatePassphrase(duress, cfg); err != nil {
+		return fmt.Errorf("duress passphrase: %w", err)
+	}
+	if len(passphrases)+1 > cfg.MaxKeySlots {
+		return fmt.Errorf("at most %d passphrases are allowed, including the duress passphrase", cfg.MaxKeySlots)
+	}
+	for _, p := range passphrases {
+		if crypto.NormalizePassphrase(p) == crypto.NormalizePassphrase(duress) {
+			return errors.New("duress passphrase must differ from the other passphrases")
+		}
+	}
+	if alert && cfg.AlertWebhook == "" {
+		return errors.New("duress alerts are not enabled on this server")
+	}
+	return nil
+}
+
+// secretStore stores secrets, either right away in a MemoryStore or in a memstore.Batch.
+type secretStore interface {
+	Store(data []byte, meta memstore.Metadata, passphrase string, ttl time.Duration) (string, *memstore.StoredItem, error)
+	StoreForPassphrases(data []byte, meta memstore.Metadata, passphrases []string, duress *crypto.Duress, ttl time.Duration) (string, *memstore.StoredItem, error)
+	StoreForRecipient(data []byte, meta memstore.Metadata, recipient *crypto.Recipient, ttl time.Duration) (string, *memstore.StoredItem, error)
+	StoreWithKey(data []byte, meta memstore.Metadata, ttl time.Duration) (id, token string, item *memstore.StoredItem, err error)
+}
+
+// storeSecret encrypts data as selected by key. The token is only set in link mode.
+func storeSecret(memStore secretStore, data []byte, meta memstore.Metadata, key secretKey, ttl time.Duration) (id, token string, item *memstore.StoredItem, err error) {
+	switch {
+	case key.recipient != "":
+		r, err := crypto.ParseRecipient(key.recipient)
+		if err != nil {
+			return "", "", nil, err
+		}
+		id, item, err = memStore.StoreForRecipient(data, meta, r, ttl)
+		return id, "", item, err
+	case key.mode == linkMode:
+		return memStore.StoreWithKey(data, meta, ttl)
+	case len(key.passphrases) > 0 || key.duress != "":
+		var duress *crypto.Duress
+		if key.duress != "" {
+			duress = &crypto.Duress{Passphrase: key.duress, Alert: key.duressAlert}
+		}
+		id, item, err = memStore.StoreForPassphrases(data, meta, append([]string{key.passphrase}, key.passphrases...), duress, ttl)
+		return id, "", item, err
+	default:
+		id, item, err = memStore.Store(data, meta, key.passphrase, ttl)
+		return id, "", item, err
+	}
+}
+
 func calculateTTL(exp int, maxRetention time.Duration) time.Duration {
 	ttl := time.Duration(exp) * time.Second
 	if ttl > maxRetention {
@@ -54,153 +294,678 @@ func calculateTTL(exp int, maxRetention time.Duration) time.Duration {
 	return ttl
 }
 
-func saveSecret(l *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore) http.HandlerFunc {
+// publicURL returns the base URL share links point to: SHHH_PUBLIC_URL if it is set, or
+// else the server the request was sent to. Forwarded headers are ignored, since any
+// client can set them; behind a proxy, SHHH_PUBLIC_URL has to be set.
+func publicURL(r *http.Request, cfg *config.Config) string {
+	if cfg.PublicURL != "" {
+		return cfg.PublicURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// secretLink returns the link to a secret. In link mode the token goes in the fragment,
+// which browsers never send to the server.
+func secretLink(r *http.Request, cfg *config.Config, id, token string) string {
+	link := publicURL(r, cfg) + "/secret/" + id
+	if token != "" {
+		link += "#" + token
+	}
+	return link
+}
+
+// padBody appends whitespace to a JSON or HTML body up to the padding bucket,
+// so response sizes don't reveal the exact secret length.
+func padBody(body []byte, padding crypto.Padding) []byte {
+	if n := padding.Size(len(body)) - len(body); n > 0 {
+		body = append(body, bytes.Repeat([]byte(" "), n)...)
+	}
+	return body
+}
+
+// writePaddedJSON writes data as JSON padded with padBody.
+func writePaddedJSON(w http.ResponseWriter, padding crypto.Padding, data any) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(padBody(body, padding))
+}
+
+func saveSecret(l *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore, signers *signers) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req saveSecretRequest
 		if err := httpjson.DecodeJSON(r, &req); err != nil {
 			l.Warn("can't bind request", "error", err)
-			httpjson.SendErrorJSON(w, r, l, http.StatusBadRequest, err, "can't decode request")
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, err, "can't decode request")
 			return
 		}
 
 		req.Validate(&req.Validator, cfg)
 		if !req.Valid() {
-			l.Warn("validation failed", "errors", req.FieldErrors)
-			w.WriteHeader(http.StatusBadRequest)
-			httpjson.WriteJSON(w, httpjson.JSON{"errors": req.FieldErrors})
+			sendFieldErrors(w, r, l, req.FieldErrors)
+			return
+		}
+
+		data, meta := req.content()
+		var err error
+		if meta.Signature, err = signers.sign(r, data, req.Signature); err != nil {
+			l.Warn("can't sign secret", "error", err)
+			sendSignError(w, r, l, err)
 			return
 		}
 
 		ttl := calculateTTL(req.Exp, cfg.MaxRetention)
-		id, storedItem, err := memStore.Store([]byte(req.Secret), "", req.PassPhrase, ttl)
+		key := secretKey{
+			passphrase:  req.PassPhrase,
+			passphrases: req.Passphrases,
+			duress:      req.Duress,
+			duressAlert: req.DuressAlert,
+			recipient:   req.Recipient,
+			mode:        req.Mode,
+		}
+		id, token, storedItem, err := storeSecret(memStore, data, meta, key, ttl)
 		if err != nil {
-			httpjson.SendErrorJSON(w, r, l, http.StatusBadRequest, err, "can't create secret")
+			sendStoreError(w, r, l, err, "can't create secret")
 			return
 		}
 
+		resp := httpjson.JSON{"key": id, "exp": req.Exp, "url": secretLink(r, cfg, id, token)}
+		if token != "" {
+			resp["token"] = token
+		}
 		w.WriteHeader(http.StatusCreated)
-		httpjson.WriteJSON(w, httpjson.JSON{"key": id, "exp": req.Exp})
+		httpjson.WriteJSON(w, resp)
 		l.Info("created secret", "id", id, "expires_at", storedItem.ExpiresAt.Format(time.RFC3339))
 	}
 }
 
-func retrieveSecret(l *slog.Logger, memStore *memstore.MemoryStore) http.HandlerFunc {
+func retrieveSecret(l *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore, signers *signers) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := r.PathValue("id")
 		if id == "" {
-			httpjson.SendErrorJSON(w, r, l, http.StatusBadRequest, errors.New("id is required"), "id is required")
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, errors.New("id is required"), "id is required")
 			return
 		}
 
 		var req struct {
-			Passphrase string `json:"passphrase"`
+			Passphrase   string `json:"passphrase"`
+			Token        string `json:"token"`         // link mode key, replaces the passphrase
+			AgeRecipient string `json:"age_recipient"` // optional, download as an age file instead of plaintext
 		}
 		if err := httpjson.DecodeJSON(r, &req); err != nil {
-			httpjson.SendErrorJSON(w, r, l, http.StatusBadRequest, err, "can't decode request")
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, err, "can't decode request")
 			return
 		}
 
-		if req.Passphrase == "" {
-			httpjson.SendErrorJSON(w, r, l, http.StatusBadRequest, errors.New("passphrase is required"), "passphrase is required")
+		if req.Passphrase == "" && req.Token == "" {
+			sendError(w, r, l, http.StatusBadRequest, codeValidationFailed, errors.New("passphrase is required"), "passphrase or token is required")
 			return
 		}
 
-		data, filename, err := memStore.Retrieve(id, req.Passphrase)
+		// parse before retrieval, so a bad recipient doesn't burn the secret
+		var ageRecipient age.Recipient
+		if req.AgeRecipient != "" {
+			if cfg.FIPS {
+				sendError(w, r, l, http.StatusBadRequest, codeNotApproved, crypto.ErrNotApproved, "age downloads are not available in FIPS mode")
+				return
+			}
+			var err error
+			if ageRecipient, err = crypto.ParseAgeRecipient(req.AgeRecipient); err != nil {
+				sendError(w, r, l, http.StatusBadRequest, codeValidationFailed, err, "invalid age recipient")
+				return
+			}
+		}
+
+		var data []byte
+		var meta memstore.Metadata
+		var err error
+		if req.Token != "" {
+			data, meta, err = memStore.RetrieveWithKey(id, req.Token)
+		} else {
+			data, meta, err = memStore.Retrieve(id, req.Passphrase)
+		}
 		if err != nil {
-			l.Warn("secret retrieval failed", "id", id)
-			httpjson.SendErrorJSON(w, r, l, http.StatusNotFound, errors.New("secret not found"), "secret not found")
+			sendRetrieveError(w, r, l, id, err)
 			return
 		}
 
-		if filename != "" {
-			safeFilename := strings.ReplaceAll(filename, `"`, `\"`)
-			w.Header().Set("Content-Type", "application/octet-stream")
-			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, safeFilename, url.QueryEscape(filename)))
-			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
-			w.WriteHeader(http.StatusOK)
-			w.Write(data)
-			l.Info("retrieved file", "id", id, "filename", filename)
+		signature := signers.check(meta.Signature, data)
+		if ageRecipient != nil {
+			plaintext, filename := data, meta.Filename
+			switch {
+			case meta.IsBundle():
+				if plaintext, err = meta.BundleZip(data); err != nil {
+					sendError(w, r, l, http.StatusInternalServerError, codeInternal, err, "can't read bundle")
+					return
+				}
+				filename = "secret.zip"
+			case meta.IsCredential():
+				filename = "credential.json"
+			case !meta.IsFile():
+				filename = "secret.txt"
+			}
+			ageFile, err := crypto.EncryptAge(plaintext, ageRecipient)
+			if err != nil {
+				sendError(w, r, l, http.StatusInternalServerError, codeInternal, err, "can't encrypt age file")
+				return
+			}
+			setSignatureHeaders(w, data, signature)
+			writeAttachment(w, filename+".age", ageFile)
+			l.Info("retrieved secret as age file", "id", id)
 			return
 		}
 
-		httpjson.WriteJSON(w, httpjson.JSON{"secret": string(data)})
+		if meta.IsFile() {
+			setSignatureHeaders(w, data, signature)
+			writeAttachment(w, meta.Filename, data)
+			l.Info("retrieved file", "id", id)
+			return
+		}
+
+		resp := httpjson.JSON{"content_sha256": crypto.ContentFingerprint(data)}
+		switch {
+		case meta.IsBundle():
+			message, files, err := meta.Bundle(data)
+			if err != nil {
+				sendError(w, r, l, http.StatusInternalServerError, codeInternal, err, "can't read bundle")
+				return
+			}
+			resp["message"] = string(message)
+			resp["files"] = files
+		case meta.IsCredential():
+			resp["credential"] = json.RawMessage(data)
+		default:
+			resp["secret"] = string(data)
+		}
+		if meta.Share != nil {
+			resp["share"] = meta.Share
+		}
+		if signature != nil {
+			resp["signature"] = signature
+		}
+		writePaddedJSON(w, cfg.Padding, resp)
 		l.Info("retrieved secret", "id", id)
 	}
 }
 
-func uploadFile(l *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore) http.HandlerFunc {
+func saveShares(l *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if err := r.ParseMultipartForm(cfg.MaxFileSize + 10240); err != nil {
-			l.Warn("can't parse multipart form", "error", err)
-			httpjson.SendErrorJSON(w, r, l, http.StatusBadRequest, err, "can't parse multipart form")
+		var req saveSharesRequest
+		if err := httpjson.DecodeJSON(r, &req); err != nil {
+			l.Warn("can't bind request", "error", err)
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, err, "can't decode request")
 			return
 		}
 
-		file, header, err := r.FormFile("file")
+		req.Validate(&req.Validator, cfg)
+		if !req.Valid() {
+			sendFieldErrors(w, r, l, req.FieldErrors)
+			return
+		}
+
+		ttl := calculateTTL(req.Exp, cfg.MaxRetention)
+		ids, expiresAt, err := memStore.StoreShares([]byte(req.Secret), memstore.TextMetadata(), req.Passphrases, req.Threshold, ttl)
 		if err != nil {
-			l.Warn("can't get file from form", "error", err)
-			httpjson.SendErrorJSON(w, r, l, http.StatusBadRequest, err, "file is required")
+			sendStoreError(w, r, l, err, "can't create shares")
 			return
 		}
-		defer file.Close()
 
-		fileData, err := io.ReadAll(file)
+		urls := make([]string, len(ids))
+		for i, id := range ids {
+			urls[i] = secretLink(r, cfg, id, "")
+		}
+		w.WriteHeader(http.StatusCreated)
+		httpjson.WriteJSON(w, httpjson.JSON{"keys": ids, "urls": urls, "threshold": req.Threshold, "exp": req.Exp})
+		l.Info("created split secret", "ids", ids, "threshold", req.Threshold, "expires_at", expiresAt.Format(time.RFC3339))
+	}
+}
+
+func combineShares(l *slog.Logger, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Shares []string `json:"shares"`
+		}
+		if err := httpjson.DecodeJSON(r, &req); err != nil {
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, err, "can't decode request")
+			return
+		}
+
+		data, meta, err := memstore.CombineShares(req.Shares)
 		if err != nil {
-			l.Warn("can't read file data", "error", err)
-			httpjson.SendErrorJSON(w, r, l, http.StatusBadRequest, err, "can't read file data")
+			l.Warn("can't combine shares", "error", err)
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidShares, err, "can't combine shares")
 			return
 		}
 
-		passphrase := r.FormValue("passphrase")
-		if err := validatePassphrase(passphrase, cfg); err != nil {
-			l.Warn("passphrase validation failed", "error", err)
-			httpjson.SendErrorJSON(w, r, l, http.StatusBadRequest, err, err.Error())
+		if meta.IsFile() {
+			writeAttachment(w, meta.Filename, data)
+		} else {
+			writePaddedJSON(w, cfg.Padding, httpjson.JSON{"secret": string(data)})
+		}
+		l.Info("combined shares", "count", len(req.Shares))
+	}
+}
+
+// writeAttachment sends data as a file download.
+func writeAttachment(w http.ResponseWriter, filename string, data []byte) {
+	safeFilename := strings.ReplaceAll(filename, `"`, `\"`)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, safeFilename, url.QueryEscape(filename)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func retrieveEnvelope(l *slog.Logger, memStore *memstore.MemoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if id == "" {
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, errors.New("id is required"), "id is required")
 			return
 		}
 
-		expStr := r.FormValue("exp")
-		if expStr == "" {
-			httpjson.SendErrorJSON(w, r, l, http.StatusBadRequest, errors.New("expiration is required"), "expiration is required")
+		envelope, ad, err := memStore.RetrieveSealed(id)
+		if err != nil {
+			sendRetrieveError(w, r, l, id, err)
 			return
 		}
 
-		exp, err := strconv.Atoi(expStr)
-		if err != nil || exp < 1 {
-			l.Warn("invalid expiration value", "exp", expStr)
-			httpjson.SendErrorJSON(w, r, l, http.StatusBadRequest, errors.New("expiration must be at least 1 second"), "expiration must be at least 1 second")
+		httpjson.WriteJSON(w, httpjson.JSON{
+			"envelope": base64.StdEncoding.EncodeToString(envelope),
+			"aad":      base64.StdEncoding.EncodeToString(ad),
+		})
+		l.Info("retrieved envelope", "id", id)
+	}
+}
+
+// errPAKENotApproved is returned for PAKE retrievals in FIPS mode, since SPAKE2+
+// isn't an approved algorithm.
+var errPAKENotApproved = errors.New("PAKE retrieval is not available in FIPS mode")
+
+// startPAKE begins retrieving a secret without sending its passphrase. The client derives
+// its share and confirmation from the salt and the server's share, and sends them to
+// finishPAKE. Unknown IDs get a decoy answer, so this doesn't reveal which secrets exist.
+func startPAKE(l *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if id == "" {
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, errors.New("id is required"), "id is required")
+			return
+		}
+		if cfg.FIPS {
+			sendError(w, r, l, http.StatusBadRequest, codeNotApproved, errPAKENotApproved, errPAKENotApproved.Error())
 			return
 		}
 
-		filename := header.Filename
-		if filename == "" {
-			filename = r.FormValue("filename")
+		session, salt, share, err := memStore.StartPAKE(id)
+		if err != nil {
+			sendRetrieveError(w, r, l, id, err)
+			return
 		}
 
-		id, storedItem, err := memStore.Store(fileData, filename, passphrase, calculateTTL(exp, cfg.MaxRetention))
+		httpjson.WriteJSON(w, httpjson.JSON{
+			"session": session,
+			"salt":    base64.StdEncoding.EncodeToString(salt),
+			"share":   base64.StdEncoding.EncodeToString(share),
+		})
+		l.Debug("started PAKE retrieval", "id", id)
+	}
+}
+
+// finishPAKE checks the client's confirmation. If it proves knowledge of the passphrase,
+// the secret is deleted and its envelope returned encrypted with the key both sides
+// agreed on, for the client to open locally.
+func finishPAKE(l *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if id == "" {
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, errors.New("id is required"), "id is required")
+			return
+		}
+		if cfg.FIPS {
+			sendError(w, r, l, http.StatusBadRequest, codeNotApproved, errPAKENotApproved, errPAKENotApproved.Error())
+			return
+		}
+
+		var req struct {
+			Session string `json:"session"`
+			Share   []byte `json:"share"`
+			Confirm []byte `json:"confirm"`
+		}
+		if err := httpjson.DecodeJSON(r, &req); err != nil {
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, err, "can't decode request")
+			return
+		}
+
+		confirm, sealed, ad, err := memStore.FinishPAKE(id, req.Session, req.Share, req.Confirm)
 		if err != nil {
-			httpjson.SendErrorJSON(w, r, l, http.StatusBadRequest, err, "can't store file")
+			sendRetrieveError(w, r, l, id, err)
 			return
 		}
 
-		w.WriteHeader(http.StatusCreated)
 		httpjson.WriteJSON(w, httpjson.JSON{
+			"confirm":  base64.StdEncoding.EncodeToString(confirm),
+			"envelope": base64.StdEncoding.EncodeToString(sealed),
+			"aad":      base64.StdEncoding.EncodeToString(ad),
+		})
+		l.Info("retrieved secret with PAKE", "id", id)
+	}
+}
+
+func uploadFile(l *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore, ageIdentities []age.Identity, signers *signers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		files, err := readMultipartFiles(r, cfg.MaxFileSize)
+		switch {
+		case errors.Is(err, memstore.ErrTooLarge):
+			sendStoreError(w, r, l, err, "files exceed maximum size")
+			return
+		case errors.Is(err, errFileRequired):
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, err, "file is required")
+			return
+		case err != nil:
+			l.Warn("can't read multipart form", "error", err)
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, err, "can't parse multipart form")
+			return
+		}
+
+		key := secretKeyFromForm(r)
+		if err := key.validate(cfg); err != nil {
+			sendKeyError(w, r, l, err)
+			return
+		}
+
+		exp, err := parseExp(r.FormValue("exp"))
+		if err != nil {
+			l.Warn("invalid expiration value", "exp", r.FormValue("exp"))
+			sendError(w, r, l, http.StatusBadRequest, codeValidationFailed, err, err.Error())
+			return
+		}
+
+		if len(files) == 1 && files[0].filename == "" {
+			files[0].filename = r.FormValue("filename")
+		}
+		fileData, meta := fileContent(files, r.FormValue("message"))
+
+		switch mode := r.FormValue("age"); mode {
+		case "":
+		case "opaque", "decrypt":
+			if meta.IsBundle() {
+				sendError(w, r, l, http.StatusBadRequest, codeValidationFailed, errors.New("age with a bundle"), "age only works for a single file without a message")
+				return
+			}
+			if !crypto.IsAgeFile(fileData) {
+				sendError(w, r, l, http.StatusBadRequest, codeValidationFailed, errors.New("not an age file"), "file is not age encrypted")
+				return
+			}
+			if mode == "opaque" {
+				break
+			}
+			if len(ageIdentities) == 0 {
+				sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, errors.New("no age identity configured"), "server-side age decryption is not enabled")
+				return
+			}
+			if fileData, err = crypto.DecryptAge(fileData, ageIdentities, cfg.MaxFileSize); err != nil {
+				l.Warn("can't decrypt age file", "error", err)
+				sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, err, "can't decrypt age file")
+				return
+			}
+			meta = memstore.FileMetadata(strings.TrimSuffix(meta.Filename, ".age"))
+		default:
+			sendError(w, r, l, http.StatusBadRequest, codeValidationFailed, fmt.Errorf("unknown age mode %q", mode), "age must be opaque or decrypt")
+			return
+		}
+		clientSig, err := signatureFromForm(r)
+		if err == nil {
+			meta.Signature, err = signers.sign(r, fileData, clientSig)
+		}
+		if err != nil {
+			l.Warn("can't sign file", "error", err)
+			sendSignError(w, r, l, err)
+			return
+		}
+
+		id, token, storedItem, err := storeSecret(memStore, fileData, meta, key, calculateTTL(exp, cfg.MaxRetention))
+		if err != nil {
+			sendStoreError(w, r, l, err, "can't store file")
+			return
+		}
+
+		resp := httpjson.JSON{"key": id, "exp": exp, "url": secretLink(r, cfg, id, token)}
+		if meta.IsBundle() {
+			names := make([]string, len(meta.Manifest.Files))
+			for i, f := range meta.Manifest.Files {
+				names[i] = f.Name
+			}
+			resp["files"] = names
+		} else {
+			resp["filename"] = meta.Filename
+		}
+		if token != "" {
+			resp["token"] = token
+		}
+		w.WriteHeader(http.StatusCreated)
+		httpjson.WriteJSON(w, resp)
+		l.Info("uploaded file", "id", id, "expires_at", storedItem.ExpiresAt.Format(time.RFC3339))
+	}
+}
+
+// secretKeyFromHeader reads the key of a raw upload from its request headers.
+func secretKeyFromHeader(r *http.Request) secretKey {
+	return secretKey{
+		passphrase: r.Header.Get("X-Passphrase"),
+		recipient:  strings.TrimSpace(r.Header.Get("X-Recipient")),
+		mode:       r.Header.Get("X-Mode"),
+	}
+}
+
+// sendKeyError responds to a secretKey that doesn't validate.
+func sendKeyError(w http.ResponseWriter, r *http.Request, l *slog.Logger, err error) {
+	l.Warn("passphrase validation failed", "error", err)
+	code := codeValidationFailed
+	if errors.Is(err, errRecipientNotApproved) {
+		code = codeNotApproved
+	}
+	sendError(w, r, l, http.StatusBadRequest, code, err, err.Error())
+}
+
+// parseExp parses an expiration in seconds given as a form field or header.
+func parseExp(v string) (int, error) {
+	if v == "" {
+		return 0, errors.New("expiration is required")
+	}
+	exp, err := strconv.Atoi(v)
+	if err != nil || exp < 1 {
+		return 0, errors.New("expiration must be at least 1 second")
+	}
+	return exp, nil
+}
+
+// uploadRawFile stores a file sent as the raw request body, with its key, expiration and
+// filename in headers. The body is read straight into memory up to the size limit, so
+// nothing is written to disk on the way to encryption, unlike with multipart parsing.
+func uploadRawFile(l *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore, signers *signers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			if mediaType, _, err := mime.ParseMediaType(ct); err != nil || mediaType != "application/octet-stream" {
+				sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("unsupported content type %q", ct), "content type must be application/octet-stream")
+				return
+			}
+		}
+		if r.ContentLength > cfg.MaxFileSize {
+			sendStoreError(w, r, l, memstore.ErrTooLarge, "file exceeds maximum size")
+			return
+		}
+
+		// check the headers first, so a bad request is refused before the body is read
+		key := secretKeyFromHeader(r)
+		if err := key.validate(cfg); err != nil {
+			sendKeyError(w, r, l, err)
+			return
+		}
+		exp, err := parseExp(r.Header.Get("X-Exp"))
+		if err != nil {
+			sendError(w, r, l, http.StatusBadRequest, codeValidationFailed, err, err.Error())
+			return
+		}
+		filename, err := url.PathUnescape(r.Header.Get("X-Filename"))
+		if err != nil || filename == "" {
+			sendError(w, r, l, http.StatusBadRequest, codeValidationFailed, errors.New("invalid filename"), "filename is required, percent-encoded if not ASCII")
+			return
+		}
+
+		data, err := readLimited(r.Body, cfg.MaxFileSize, r.ContentLength)
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.Is(err, memstore.ErrTooLarge), errors.As(err, &maxBytesErr):
+			sendStoreError(w, r, l, memstore.ErrTooLarge, "file exceeds maximum size")
+			return
+		case err != nil:
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, err, "can't read file data")
+			return
+		}
+
+		meta := memstore.FileMetadata(filename)
+		if meta.Signature, err = signers.sign(r, data, nil); err != nil {
+			l.Warn("can't sign file", "error", err)
+			sendSignError(w, r, l, err)
+			return
+		}
+
+		id, token, storedItem, err := storeSecret(memStore, data, meta, key, calculateTTL(exp, cfg.MaxRetention))
+		if err != nil {
+			sendStoreError(w, r, l, err, "can't store file")
+			return
+		}
+
+		resp := httpjson.JSON{
 			"key":      id,
 			"exp":      exp,
-			"filename": storedItem.Filename,
+			"filename": meta.Filename,
+			"url":      secretLink(r, cfg, id, token),
+		}
+		if token != "" {
+			resp["token"] = token
+		}
+		w.WriteHeader(http.StatusCreated)
+		httpjson.WriteJSON(w, resp)
+		l.Info("uploaded file", "id", id, "expires_at", storedItem.ExpiresAt.Format(time.RFC3339))
+	}
+}
+
+func checkPassphrase(l *slog.Logger, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Passphrase string `json:"passphrase"`
+		}
+		if err := httpjson.DecodeJSON(r, &req); err != nil {
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, err, "can't decode request")
+			return
+		}
+		strength, err := passphraseStrength(req.Passphrase, cfg)
+		if err != nil {
+			sendError(w, r, l, http.StatusBadRequest, codeValidationFailed, err, err.Error())
+			return
+		}
+		httpjson.WriteJSON(w, strength)
+	}
+}
+
+const (
+	defaultPassphraseWords = 6
+	maxPassphraseWords     = 16
+)
+
+// generatePassphrase returns a diceware passphrase of at least n words that meets the
+// configured length and entropy rules, adding words while it's too short or too weak.
+func generatePassphrase(cfg *config.Config, n int, separator string) (string, int, error) {
+	for range 32 {
+		if n > maxPassphraseWords {
+			break
+		}
+		p, err := diceware.Generate(n, separator)
+		if err != nil {
+			return "", 0, err
+		}
+		p = crypto.NormalizePassphrase(p)
+		switch {
+		case !validator.MaxChars(p, cfg.MaxPhraseSize):
+			continue // long words, try again
+		case !validator.MinChars(p, cfg.MinPhraseSize), !validator.MinEntropy(p, cfg.MinPassphraseEntropy),
+			float64(n)*diceware.BitsPerWord < cfg.MinPassphraseEntropy: // the estimate can be higher than the real entropy
+			n++
+			continue
+		}
+		return p, n, nil
+	}
+	return "", 0, errors.New("can't generate a passphrase within the configured limits")
+}
+
+func newPassphrase(l *slog.Logger, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		words := defaultPassphraseWords
+		if v := r.URL.Query().Get("words"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxPassphraseWords {
+				sendError(w, r, l, http.StatusBadRequest, codeValidationFailed, errors.New("invalid word count"), fmt.Sprintf("words must be between 1 and %d", maxPassphraseWords))
+				return
+			}
+			words = n
+		}
+
+		separator := "-"
+		if r.URL.Query().Has("separator") {
+			separator = r.URL.Query().Get("separator")
+		}
+		if !validator.MaxChars(separator, 3) {
+			sendError(w, r, l, http.StatusBadRequest, codeValidationFailed, errors.New("separator too long"), "separator must be at most 3 characters")
+			return
+		}
+
+		passphrase, n, err := generatePassphrase(cfg, words, separator)
+		if err != nil {
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, err, err.Error())
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		httpjson.WriteJSON(w, httpjson.JSON{
+			"passphrase": passphrase,
+			"words":      n,
+			"entropy":    math.Round(float64(n)*diceware.BitsPerWord*10) / 10,
 		})
-		l.Info("uploaded file", "id", id, "filename", storedItem.Filename, "expires_at", storedItem.ExpiresAt.Format(time.RFC3339))
 	}
 }
 
 func getParams(l *slog.Logger, cfg *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		httpjson.WriteJSON(w, httpjson.JSON{
-			"min_phrase_size": cfg.MinPhraseSize,
-			"max_phrase_size": cfg.MaxPhraseSize,
-			"max_items":       cfg.MaxItems,
-			"max_file_size":   cfg.MaxFileSize,
-			"max_retention":   int(cfg.MaxRetention.Seconds()),
+			"min_phrase_size":        cfg.MinPhraseSize,
+			"max_phrase_size":        cfg.MaxPhraseSize,
+			"min_passphrase_entropy": cfg.MinPassphraseEntropy,
+			"max_items":              cfg.MaxItems,
+			"max_key_slots":          cfg.MaxKeySlots,
+			"max_attempts":           cfg.MaxAttempts,
+			"duress_alerts":          cfg.AlertWebhook != "",
+			"max_file_size":          cfg.MaxFileSize,
+			"max_retention":          int(cfg.MaxRetention.Seconds()),
+			"crypto_mode":            cryptoMode(cfg),
 		})
 		l.Debug("params requested")
 	}
 }
+
+// cryptoMode names the active crypto mode for clients: "fips" when only approved
+// algorithms are used, "standard" otherwise.
+func cryptoMode(cfg *config.Config) string {
+	if cfg.FIPS {
+		return "fips"
+	}
+	return "standard"
+}
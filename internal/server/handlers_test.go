@@ -0,0 +1,242 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/en9inerd/shhh/internal/memstore"
+)
+
+// chunkedReader hides its length from httptest.NewRequest, so the request is streamed
+// without a Content-Length like a chunked upload.
+type chunkedReader struct{ io.Reader }
+
+func TestUploadRawFile_SizeLimit(t *testing.T) {
+	handler := newTestServerWith(t, slog.New(slog.DiscardHandler), map[string]string{"SHHH_MAX_FILE_SIZE": "1024"})
+	header := http.Header{
+		"Content-Type": {"application/octet-stream"},
+		"X-Filename":   {"blob.bin"},
+		"X-Passphrase": {"correct-horse-battery-staple"},
+		"X-Exp":        {"3600"},
+	}
+	put := func(body io.Reader) *http.Response {
+		return serve(handler, http.MethodPut, "/api/v1/file", body, header)
+	}
+
+	tests := []struct {
+		name   string
+		body   io.Reader
+		status int
+	}{
+		{"at the limit", bytes.NewReader(bytes.Repeat([]byte{1}, 1024)), http.StatusCreated},
+		{"declared too large", bytes.NewReader(bytes.Repeat([]byte{1}, 1025)), http.StatusRequestEntityTooLarge},
+		{"streamed at the limit", chunkedReader{bytes.NewReader(bytes.Repeat([]byte{1}, 1024))}, http.StatusCreated},
+		{"streamed too large", chunkedReader{bytes.NewReader(bytes.Repeat([]byte{1}, 1025))}, http.StatusRequestEntityTooLarge},
+		{"streamed far too large", chunkedReader{io.LimitReader(neverEnding{}, 1<<30)}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := put(tt.body)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusRequestEntityTooLarge {
+				return
+			}
+			var body struct {
+				Error apiError `json:"error"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error.Code != codeTooLarge {
+				t.Errorf("error %+v, %v, want %s", body.Error, err, codeTooLarge)
+			}
+		})
+	}
+
+	// a stored upload opens with the passphrase and holds exactly what was streamed
+	data := []byte(strings.Repeat("raw bytes ", 100))
+	resp := put(chunkedReader{bytes.NewReader(data)})
+	var created struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("can't upload: %d, %v", resp.StatusCode, err)
+	}
+	resp = serve(handler, http.MethodPost, "/api/v1/secret/"+created.Key,
+		strings.NewReader(`{"passphrase": "correct-horse-battery-staple"}`), jsonHeader())
+	got, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(got, data) {
+		t.Errorf("retrieved %d bytes with status %d, want the %d uploaded", len(got), resp.StatusCode, len(data))
+	}
+}
+
+// neverEnding is an endless stream of one byte value.
+type neverEnding struct{}
+
+func (neverEnding) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+func TestUploadBundle(t *testing.T) {
+	handler := newTestServer(t)
+
+	upload := func() string {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		mw.WriteField("message", "the keys")
+		mw.WriteField("passphrase", "correct-horse-battery-staple")
+		mw.WriteField("exp", "3600")
+		for _, f := range []struct{ name, data string }{
+			{"id_ed25519", "private key"},
+			{"notes.txt", "first"},
+			{"notes.txt", "second"},
+		} {
+			fw, _ := mw.CreateFormFile("file", f.name)
+			fw.Write([]byte(f.data))
+		}
+		mw.Close()
+		resp := serve(handler, http.MethodPost, "/api/v1/file", &buf, http.Header{"Content-Type": {mw.FormDataContentType()}})
+		var created struct {
+			Key   string   `json:"key"`
+			Files []string `json:"files"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("can't upload bundle: %d, %v", resp.StatusCode, err)
+		}
+		if want := []string{"id_ed25519", "notes.txt", "notes (2).txt"}; !slices.Equal(created.Files, want) {
+			t.Errorf("stored files %q, want %q", created.Files, want)
+		}
+		return created.Key
+	}
+	retrieve := func(id, body string) *http.Response {
+		resp := serve(handler, http.MethodPost, "/api/v1/secret/"+id, strings.NewReader(body), jsonHeader())
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("retrieve: status %d", resp.StatusCode)
+		}
+		return resp
+	}
+
+	var bundle struct {
+		Message string                `json:"message"`
+		Files   []memstore.BundleFile `json:"files"`
+	}
+	if err := json.NewDecoder(retrieve(upload(), `{"passphrase": "correct-horse-battery-staple"}`).Body).Decode(&bundle); err != nil {
+		t.Fatal(err)
+	}
+	want := []memstore.BundleFile{
+		{ManifestFile: memstore.ManifestFile{Name: "id_ed25519", ContentType: "application/octet-stream", Size: 11}, Data: []byte("private key")},
+		{ManifestFile: memstore.ManifestFile{Name: "notes.txt", ContentType: "text/plain; charset=utf-8", Size: 5}, Data: []byte("first")},
+		{ManifestFile: memstore.ManifestFile{Name: "notes (2).txt", ContentType: "text/plain; charset=utf-8", Size: 6}, Data: []byte("second")},
+	}
+	if bundle.Message != "the keys" || !reflect.DeepEqual(bundle.Files, want) {
+		t.Errorf("retrieved %q with %+v, want %+v", bundle.Message, bundle.Files, want)
+	}
+
+	// as an age download, the bundle is a zip with the message first
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := retrieve(upload(), `{"passphrase": "correct-horse-battery-staple", "age_recipient": "`+identity.Recipient().String()+`"}`)
+	if cd := resp.Header.Get("Content-Disposition"); !strings.Contains(cd, "secret.zip.age") {
+		t.Errorf("Content-Disposition %q, want secret.zip.age", cd)
+	}
+	dec, err := age.Decrypt(resp.Body, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []string
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		entries = append(entries, f.Name+"="+string(data))
+	}
+	if want := []string{"message.txt=the keys", "id_ed25519=private key", "notes.txt=first", "notes (2).txt=second"}; !slices.Equal(entries, want) {
+		t.Errorf("zip entries %q, want %q", entries, want)
+	}
+}
+
+func TestSecretLink(t *testing.T) {
+	tests := []struct {
+		name      string
+		publicURL string
+		want      string
+	}{
+		{"from the request", "", "http://shhh.test/secret/"},
+		{"from the public URL", "https://shhh.example.com/", "https://shhh.example.com/secret/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newTestServerWith(t, slog.New(slog.DiscardHandler), map[string]string{"SHHH_PUBLIC_URL": tt.publicURL})
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/secret", strings.NewReader(testSecretBody))
+			req.Host = "shhh.test"
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-Forwarded-Host", "evil.test")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			var created struct {
+				Key string `json:"key"`
+				URL string `json:"url"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&created); err != nil || rec.Code != http.StatusCreated {
+				t.Fatalf("create: status %d, %v", rec.Code, err)
+			}
+			if created.URL != tt.want+created.Key {
+				t.Errorf("url %q, want %q", created.URL, tt.want+created.Key)
+			}
+		})
+	}
+}
+
+func TestCheckPassphrase_Length(t *testing.T) {
+	handler := newTestServer(t)
+	check := func(passphrase string) *http.Response {
+		return serve(handler, http.MethodPost, "/api/v1/passphrase/strength",
+			strings.NewReader(`{"passphrase": "`+passphrase+`"}`), jsonHeader())
+	}
+
+	start := time.Now()
+	if resp := check(strings.Repeat("ab", 64)); resp.StatusCode != http.StatusOK {
+		t.Errorf("maximum length: status %d, want 200", resp.StatusCode)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("maximum length took %v", d)
+	}
+
+	resp := check(strings.Repeat("a", 4096))
+	var body struct {
+		Error apiError `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusBadRequest || body.Error.Code != codeValidationFailed {
+		t.Errorf("too long: status %d, %+v, want 400 %s", resp.StatusCode, body.Error, codeValidationFailed)
+	}
+}
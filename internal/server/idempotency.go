@@ -0,0 +1,378 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"hash"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/en9inerd/shhh/internal/crypto"
+)
+
+const (
+	// maxIdempotencyKeySize bounds the Idempotency-Key header.
+	maxIdempotencyKeySize = 255
+
+	// HKDF info strings of the keys derived from a request digest.
+	idempotencyRequestInfo  = "shhh idempotent request"
+	idempotencyResponseInfo = "shhh idempotent response"
+)
+
+// idempotencyHeaders are the request headers that describe what a create request
+// stores, besides its body, so they are part of the request hash.
+var idempotencyHeaders = []string{"X-Exp", "X-Filename", "X-Passphrase", "X-Recipient", "X-Mode"}
+
+var (
+	errIdempotencyKeyReused  = errors.New("idempotency key was used for a different request")
+	errIdempotencyInProgress = errors.New("a request with this idempotency key is in progress")
+	errInvalidIdempotencyKey = errors.New("idempotency key must be 1 to 255 printable ASCII characters")
+)
+
+// idempotencyCache remembers the responses of create requests sent with an
+// Idempotency-Key header for a while, so a retried request gets the original response
+// instead of creating the secret again. It keeps no plaintext: entries are found by a
+// hash of the key, requests are compared by a hash of their content, and responses
+// are encrypted under a key derived from the request, which only a client sending the
+// same request again can provide. Request hashes are keyed with a random key of the
+// process, so a cached hash can't be used to guess what a request contained, like its
+// passphrase, without it. Past maxEntries, the oldest entries are dropped.
+type idempotencyCache struct {
+	mu         sync.Mutex
+	entries    map[[sha256.Size]byte]*list.Element
+	order      *list.List // of *idempotencyEntry, oldest first, which is also expiry order
+	window     time.Duration
+	maxEntries int
+	hashKey    []byte
+	cs         *crypto.CryptoService
+}
+
+type idempotencyEntry struct {
+	id          [sha256.Size]byte
+	requestHash []byte
+	status      int
+	contentType string
+	response    []byte // encrypted, nil while the first request is in progress
+	expiresAt   time.Time
+}
+
+// newIdempotencyCache returns a cache keeping up to maxEntries responses for window, or
+// nil if window is 0, which disables Idempotency-Key handling.
+func newIdempotencyCache(window time.Duration, maxEntries int) *idempotencyCache {
+	if window <= 0 {
+		return nil
+	}
+	c := &idempotencyCache{
+		entries:    make(map[[sha256.Size]byte]*list.Element),
+		order:      list.New(),
+		window:     window,
+		maxEntries: maxEntries,
+		hashKey:    make([]byte, 32),
+		cs:         crypto.NewCryptoService(),
+	}
+	rand.Read(c.hashKey)
+	return c
+}
+
+// validIdempotencyKey reports whether key is 1 to 255 printable ASCII characters.
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > maxIdempotencyKeySize {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// idempotent wraps a create handler. Requests without an Idempotency-Key are passed
+// through. The first request with a key runs the handler, and a successful response is
+// remembered; a retry with the same key and content gets that response back, and one
+// with different content fails with 422. Failed responses aren't remembered, so the
+// request can be retried with the same key, and neither is anything if the handler
+// panics.
+func (c *idempotencyCache) idempotent(l *slog.Logger, next http.HandlerFunc) http.HandlerFunc {
+	if c == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			sendError(w, r, l, http.StatusBadRequest, codeValidationFailed, errInvalidIdempotencyKey, errInvalidIdempotencyKey.Error())
+			return
+		}
+
+		id := idempotencyID(r, key)
+		rh, err := newRequestHasher(r, c.hashKey)
+		if err != nil {
+			sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, err, "invalid content type")
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, rh), r.Body}
+
+		entry, err := c.begin(id)
+		if err != nil {
+			sendError(w, r, l, http.StatusConflict, codeIdempotencyInProgress, err, err.Error())
+			return
+		}
+		if entry.response != nil {
+			c.replay(w, r, l, entry, rh)
+			return
+		}
+
+		remembered := false
+		defer func() {
+			if !remembered {
+				c.forget(entry)
+			}
+		}()
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		if rec.status < 200 || rec.status > 299 {
+			return
+		}
+		if err := c.finish(entry, rh, rec, r.Body); err != nil {
+			l.Error("can't remember idempotent response", "error", err)
+			return
+		}
+		remembered = true
+	}
+}
+
+// idempotencyID is the cache key of an Idempotency-Key. Keys are scoped to the endpoint
+// and the sender token, and only kept hashed.
+func idempotencyID(r *http.Request, key string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(r.Method + " " + r.URL.Path + "\n" + r.Header.Get("Authorization") + "\n" + key))
+}
+
+// begin returns the finished entry for id, or reserves id for a new request and
+// returns its entry, without a response yet. It fails with errIdempotencyInProgress if
+// the first request with the key hasn't finished. A full cache makes room by dropping
+// its oldest entries.
+func (c *idempotencyCache) begin(id [sha256.Size]byte) (*idempotencyEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if el, ok := c.entries[id]; ok {
+		e := el.Value.(*idempotencyEntry)
+		if now.Before(e.expiresAt) {
+			if e.response == nil {
+				return nil, errIdempotencyInProgress
+			}
+			return e, nil
+		}
+		c.remove(el)
+	}
+	// entries all live for the same window, so the expired ones are at the front
+	for el := c.order.Front(); el != nil && !now.Before(el.Value.(*idempotencyEntry).expiresAt); el = c.order.Front() {
+		c.remove(el)
+	}
+	for c.order.Len() >= c.maxEntries {
+		c.remove(c.order.Front())
+	}
+	// in progress entries expire too, so a request that never finishes can't hold its key
+	e := &idempotencyEntry{id: id, expiresAt: now.Add(c.window)}
+	c.entries[id] = c.order.PushBack(e)
+	return e, nil
+}
+
+func (c *idempotencyCache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*idempotencyEntry).id)
+	c.order.Remove(el)
+}
+
+// finish remembers a successful response in the entry begin reserved, encrypted under
+// a key derived from the request, once the rest of the body is hashed. If the entry was
+// dropped in the meantime, the response just isn't remembered.
+func (c *idempotencyCache) finish(e *idempotencyEntry, rh *requestHasher, rec *responseRecorder, body io.Reader) error {
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return err
+	}
+	requestHash, encKey, err := rh.keys()
+	if err != nil {
+		return err
+	}
+	response, err := c.cs.EncryptWithKey(rec.body.Bytes(), encKey, e.id[:])
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.requestHash = requestHash
+	e.status = rec.status
+	e.contentType = rec.Header().Get("Content-Type")
+	e.response = response
+	return nil
+}
+
+// forget drops an entry begin reserved, unless it was already dropped.
+func (c *idempotencyCache) forget(e *idempotencyEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.id]; ok && el.Value == e {
+		c.remove(el)
+	}
+}
+
+// replay sends a remembered response, if the request matches the one it was made for.
+func (c *idempotencyCache) replay(w http.ResponseWriter, r *http.Request, l *slog.Logger, e *idempotencyEntry, rh *requestHasher) {
+	if _, err := io.Copy(io.Discard, r.Body); err != nil {
+		sendError(w, r, l, http.StatusBadRequest, codeInvalidRequest, err, "can't read request")
+		return
+	}
+	requestHash, encKey, err := rh.keys()
+	if err != nil {
+		sendError(w, r, l, http.StatusInternalServerError, codeInternal, err, "can't hash request")
+		return
+	}
+	if subtle.ConstantTimeCompare(requestHash, e.requestHash) != 1 {
+		sendError(w, r, l, http.StatusUnprocessableEntity, codeIdempotencyKeyReused, errIdempotencyKeyReused, errIdempotencyKeyReused.Error())
+		return
+	}
+	body, err := c.cs.DecryptWithKey(e.response, encKey, e.id[:])
+	if err != nil {
+		sendError(w, r, l, http.StatusInternalServerError, codeInternal, err, "can't read remembered response")
+		return
+	}
+
+	w.Header().Set("Content-Type", e.contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(e.status)
+	w.Write(body)
+	l.Info("replayed idempotent response", "path", r.URL.Path)
+}
+
+// requestHasher hashes what a create request stores, with HMAC-SHA-256 under a key:
+// its path, media type, the headers in idempotencyHeaders and its body. Multipart
+// boundaries are left out, since clients pick a new one when they rebuild a request to
+// retry it.
+type requestHasher struct {
+	h   hash.Hash
+	sw  *stripWriter
+	out io.Writer
+}
+
+func newRequestHasher(r *http.Request, key []byte) (*requestHasher, error) {
+	rh := &requestHasher{h: hmac.New(sha256.New, key)}
+	rh.out = rh.h
+	var mediaType string
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var params map[string]string
+		var err error
+		if mediaType, params, err = mime.ParseMediaType(ct); err != nil {
+			return nil, err
+		}
+		if boundary := params["boundary"]; boundary != "" {
+			rh.sw = &stripWriter{w: rh.h, sep: []byte(boundary)}
+			rh.out = rh.sw
+		}
+	}
+	writeHashField(rh.h, r.Method+" "+r.URL.Path)
+	writeHashField(rh.h, mediaType)
+	for _, name := range idempotencyHeaders {
+		writeHashField(rh.h, r.Header.Get(name))
+	}
+	return rh, nil
+}
+
+func (rh *requestHasher) Write(p []byte) (int, error) {
+	return rh.out.Write(p)
+}
+
+// keys returns the hash requests are compared by and the key responses are encrypted
+// under, both derived from the keyed request digest.
+func (rh *requestHasher) keys() (requestHash, encKey []byte, err error) {
+	if rh.sw != nil {
+		rh.sw.flush()
+	}
+	digest := rh.h.Sum(nil)
+	if requestHash, err = hkdf.Key(sha256.New, digest, nil, idempotencyRequestInfo, sha256.Size); err != nil {
+		return nil, nil, err
+	}
+	if encKey, err = hkdf.Key(sha256.New, digest, nil, idempotencyResponseInfo, 32); err != nil {
+		return nil, nil, err
+	}
+	return requestHash, encKey, nil
+}
+
+// writeHashField writes s length-prefixed, so fields can't run into each other.
+func writeHashField(h hash.Hash, s string) {
+	h.Write([]byte(strconv.Itoa(len(s)) + ":" + s))
+}
+
+// stripWriter writes to w with every occurrence of sep removed. A possible partial
+// match at the end of a write is held back until the next write or flush.
+type stripWriter struct {
+	w       io.Writer
+	sep     []byte
+	pending []byte
+}
+
+func (s *stripWriter) Write(p []byte) (int, error) {
+	buf := append(s.pending, p...)
+	for {
+		i := bytes.Index(buf, s.sep)
+		if i < 0 {
+			break
+		}
+		s.w.Write(buf[:i])
+		buf = buf[i+len(s.sep):]
+	}
+	keep := min(len(buf), len(s.sep)-1)
+	s.w.Write(buf[:len(buf)-keep])
+	s.pending = bytes.Clone(buf[len(buf)-keep:])
+	return len(p), nil
+}
+
+func (s *stripWriter) flush() {
+	s.w.Write(s.pending)
+	s.pending = nil
+}
+
+// responseRecorder passes a response through and keeps a copy of its status and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotency_Replay(t *testing.T) {
+	handler := newTestServer(t)
+	header := jsonHeader()
+	header.Set("Idempotency-Key", "replay-key")
+
+	create := func(body string) (*http.Response, []byte) {
+		resp := serve(handler, http.MethodPost, "/api/v1/secret", strings.NewReader(body), header)
+		b, _ := io.ReadAll(resp.Body)
+		return resp, b
+	}
+	first, firstBody := create(testSecretBody)
+	if first.StatusCode != http.StatusCreated {
+		t.Fatalf("create: status %d, %s", first.StatusCode, firstBody)
+	}
+	var created struct {
+		Key string `json:"key"`
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(firstBody, &created); err != nil || created.Key == "" || created.URL == "" {
+		t.Fatalf("create: %s, %v", firstBody, err)
+	}
+
+	replay, replayBody := create(testSecretBody)
+	if replay.StatusCode != http.StatusCreated || !bytes.Equal(replayBody, firstBody) {
+		t.Errorf("replay: status %d, %s, want the original %s", replay.StatusCode, replayBody, firstBody)
+	}
+	if replay.Header.Get("Idempotent-Replayed") != "true" {
+		t.Error("replay: expected Idempotent-Replayed header")
+	}
+
+	// the replay didn't create another secret: the original opens once
+	retrieve := func() int {
+		return serve(handler, http.MethodPost, "/api/v1/secret/"+created.Key,
+			strings.NewReader(`{"passphrase": "correct-horse-battery-staple"}`), jsonHeader()).StatusCode
+	}
+	if status := retrieve(); status != http.StatusOK {
+		t.Errorf("retrieve: status %d, want 200", status)
+	}
+
+	reused, reusedBody := create(`{"secret": "other", "exp": 3600, "passphrase": "correct-horse-battery-staple"}`)
+	var body struct {
+		Error apiError `json:"error"`
+	}
+	json.Unmarshal(reusedBody, &body)
+	if reused.StatusCode != http.StatusUnprocessableEntity || body.Error.Code != codeIdempotencyKeyReused {
+		t.Errorf("reused key: status %d, %s, want 422 %s", reused.StatusCode, reusedBody, codeIdempotencyKeyReused)
+	}
+
+	// keys are scoped to the endpoint
+	other := serve(handler, http.MethodPost, "/api/v1/shares", strings.NewReader(
+		`{"secret": "s", "exp": 3600, "threshold": 2, "passphrases": ["first-pass", "second-pass"]}`), header)
+	if other.StatusCode != http.StatusCreated {
+		t.Errorf("same key on another endpoint: status %d, want 201", other.StatusCode)
+	}
+}
+
+func TestIdempotency_MultipartBoundary(t *testing.T) {
+	handler := newTestServer(t)
+
+	upload := func(boundary, content string) (*http.Response, []byte) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		if err := mw.SetBoundary(boundary); err != nil {
+			t.Fatal(err)
+		}
+		mw.WriteField("passphrase", "correct-horse-battery-staple")
+		mw.WriteField("exp", "3600")
+		fw, _ := mw.CreateFormFile("file", "notes.txt")
+		fw.Write([]byte(content))
+		mw.Close()
+		header := http.Header{
+			"Content-Type":    {mw.FormDataContentType()},
+			"Idempotency-Key": {"upload-key"},
+		}
+		resp := serve(handler, http.MethodPost, "/api/v1/file", &buf, header)
+		b, _ := io.ReadAll(resp.Body)
+		return resp, b
+	}
+
+	first, firstBody := upload("first-boundary-1234", "file content")
+	if first.StatusCode != http.StatusCreated {
+		t.Fatalf("upload: status %d, %s", first.StatusCode, firstBody)
+	}
+	retry, retryBody := upload("retry-boundary-5678", "file content")
+	if retry.StatusCode != http.StatusCreated || !bytes.Equal(retryBody, firstBody) || retry.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry with a new boundary: status %d, %s, want the original %s", retry.StatusCode, retryBody, firstBody)
+	}
+	changed, _ := upload("retry-boundary-5678", "other content")
+	if changed.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("retry with other content: status %d, want 422", changed.StatusCode)
+	}
+}
+
+func TestIdempotency_InProgress(t *testing.T) {
+	c := newIdempotencyCache(time.Hour, 10)
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := c.idempotent(slog.New(slog.DiscardHandler), func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"key": "abc"}`))
+	})
+	header := jsonHeader()
+	header.Set("Idempotency-Key", "slow-key")
+	send := func() *http.Response {
+		return serve(handler, http.MethodPost, "/api/v1/secret", strings.NewReader(testSecretBody), header)
+	}
+
+	done := make(chan *http.Response)
+	go func() { done <- send() }()
+	<-started
+
+	resp := send()
+	var body struct {
+		Error apiError `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusConflict || body.Error.Code != codeIdempotencyInProgress || !body.Error.Retryable {
+		t.Errorf("concurrent request: status %d, %+v, want 409 %s", resp.StatusCode, body.Error, codeIdempotencyInProgress)
+	}
+
+	close(release)
+	if first := <-done; first.StatusCode != http.StatusCreated {
+		t.Fatalf("first request: status %d", first.StatusCode)
+	}
+	if resp := send(); resp.StatusCode != http.StatusCreated || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("request after the first finished: status %d, want a replay", resp.StatusCode)
+	}
+}
+
+func TestIdempotency_Panic(t *testing.T) {
+	c := newIdempotencyCache(time.Hour, 10)
+	panics := true
+	handler := c.idempotent(slog.New(slog.DiscardHandler), func(w http.ResponseWriter, r *http.Request) {
+		if panics {
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	header := jsonHeader()
+	header.Set("Idempotency-Key", "panic-key")
+	send := func() *http.Response {
+		return serve(handler, http.MethodPost, "/api/v1/secret", strings.NewReader(testSecretBody), header)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected the handler to panic")
+			}
+		}()
+		send()
+	}()
+	panics = false
+	if resp := send(); resp.StatusCode != http.StatusCreated {
+		t.Errorf("retry after a panic: status %d, want 201", resp.StatusCode)
+	}
+}
+
+func TestIdempotencyCache_KeyedHashes(t *testing.T) {
+	hash := func(c *idempotencyCache) []byte {
+		rh, err := newRequestHasher(httptest.NewRequest(http.MethodPost, "/api/v1/secret", nil), c.hashKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rh.Write([]byte(testSecretBody))
+		requestHash, _, err := rh.keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return requestHash
+	}
+	c := newIdempotencyCache(time.Hour, 10)
+	if !bytes.Equal(hash(c), hash(c)) {
+		t.Error("expected the same request to hash the same")
+	}
+	if bytes.Equal(hash(c), hash(newIdempotencyCache(time.Hour, 10))) {
+		t.Error("expected request hashes to depend on the cache's key")
+	}
+}
+
+func TestIdempotencyCache_DropsOldest(t *testing.T) {
+	c := newIdempotencyCache(time.Hour, 2)
+	ids := make([][sha256.Size]byte, 3)
+	for i := range ids {
+		ids[i] = sha256.Sum256([]byte{byte(i)})
+		if _, err := c.begin(ids[i]); err != nil {
+			t.Fatalf("begin %d: %v", i, err)
+		}
+	}
+	if len(c.entries) != 2 || c.order.Len() != 2 {
+		t.Fatalf("got %d entries, want 2", len(c.entries))
+	}
+	if _, ok := c.entries[ids[0]]; ok {
+		t.Error("expected the oldest entry to be dropped")
+	}
+
+	// a request whose entry was dropped can't touch one reserved later for its key
+	e, _ := c.begin(ids[0])
+	c.forget(&idempotencyEntry{id: ids[0]})
+	if el, ok := c.entries[ids[0]]; !ok || el.Value != e {
+		t.Error("expected forget to leave a newer entry for the key")
+	}
+
+	for _, el := range c.entries {
+		el.Value.(*idempotencyEntry).expiresAt = time.Now().Add(-time.Second)
+	}
+	if _, err := c.begin(sha256.Sum256([]byte("new"))); err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	if len(c.entries) != 1 || c.order.Len() != 1 {
+		t.Errorf("got %d entries, want expired ones dropped", len(c.entries))
+	}
+}
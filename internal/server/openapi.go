@@ -0,0 +1,21 @@
+package server
+
+import (
+	_ "embed"
+	"log/slog"
+	"net/http"
+)
+
+// openAPISpec describes the v1 API. openapi_test.go checks it against the registered
+// routes, so a route can't be added or changed without updating it.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func getOpenAPI(l *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(openAPISpec)
+		l.Debug("openapi document requested")
+	}
+}
@@ -0,0 +1,527 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/en9inerd/shhh/internal/config"
+	"github.com/en9inerd/shhh/internal/memstore"
+)
+
+// registeredRoutes returns the patterns registerRoutes registers, read from its source
+// so that every route is found without a request having to hit it.
+func registeredRoutes(t *testing.T) []string {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), "routes.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var routes []string
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Name.Name != "registerRoutes" {
+			continue
+		}
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) == 0 {
+				return true
+			}
+			if sel, ok := call.Fun.(*ast.SelectorExpr); !ok || sel.Sel.Name != "HandleFunc" {
+				return true
+			}
+			lit, ok := call.Args[0].(*ast.BasicLit)
+			if !ok {
+				t.Fatalf("route pattern at %v is not a literal", call.Pos())
+			}
+			pattern, err := strconv.Unquote(lit.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			routes = append(routes, pattern)
+			return true
+		})
+	}
+	if len(routes) == 0 {
+		t.Fatal("no routes found in registerRoutes")
+	}
+	return routes
+}
+
+// openAPI is the parsed spec, with helpers to walk it.
+type openAPI map[string]any
+
+func loadOpenAPI(t *testing.T) openAPI {
+	t.Helper()
+	var spec openAPI
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+	return spec
+}
+
+// operation returns the operation for a "METHOD /path" route pattern, or nil.
+func (spec openAPI) operation(pattern string) map[string]any {
+	method, path, _ := strings.Cut(pattern, " ")
+	item, _ := spec["paths"].(map[string]any)[path].(map[string]any)
+	op, _ := item[strings.ToLower(method)].(map[string]any)
+	return op
+}
+
+// resolve follows a local $ref.
+func (spec openAPI) resolve(v map[string]any) map[string]any {
+	ref, ok := v["$ref"].(string)
+	if !ok {
+		return v
+	}
+	var node any = map[string]any(spec)
+	for part := range strings.SplitSeq(strings.TrimPrefix(ref, "#/"), "/") {
+		node = node.(map[string]any)[part]
+	}
+	return spec.resolve(node.(map[string]any))
+}
+
+// validate checks v, decoded from JSON, against schema and reports mismatches.
+func (spec openAPI) validate(t *testing.T, schema map[string]any, v any, where string) {
+	t.Helper()
+	schema = spec.resolve(schema)
+	if all, ok := schema["allOf"].([]any); ok {
+		for _, sub := range all {
+			spec.validate(t, sub.(map[string]any), v, where)
+		}
+	}
+	if enum, ok := schema["enum"].([]any); ok && !slices.ContainsFunc(enum, func(e any) bool { return reflect.DeepEqual(e, v) }) {
+		t.Errorf("%s: %v is not one of %v", where, v, enum)
+	}
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			t.Errorf("%s: expected an object, got %T", where, v)
+			return
+		}
+		props, _ := schema["properties"].(map[string]any)
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				t.Errorf("%s: missing required %q", where, name)
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(obj)) {
+			where := where + "." + name
+			if prop, ok := props[name].(map[string]any); ok {
+				spec.validate(t, prop, obj[name], where)
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					t.Errorf("%s: not in the spec", where)
+				}
+			case map[string]any:
+				spec.validate(t, extra, obj[name], where)
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			t.Errorf("%s: expected an array, got %T", where, v)
+			return
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, e := range arr {
+				spec.validate(t, items, e, fmt.Sprintf("%s[%d]", where, i))
+			}
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			t.Errorf("%s: expected a string, got %T", where, v)
+		}
+	case "integer":
+		if n, ok := v.(float64); !ok || n != math.Trunc(n) {
+			t.Errorf("%s: expected an integer, got %v", where, v)
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			t.Errorf("%s: expected a number, got %T", where, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			t.Errorf("%s: expected a boolean, got %T", where, v)
+		}
+	}
+}
+
+// checkResponse validates a response against what op documents for its status.
+func (spec openAPI) checkResponse(t *testing.T, op map[string]any, resp *http.Response, where string) {
+	t.Helper()
+	responses := op["responses"].(map[string]any)
+	doc, ok := responses[strconv.Itoa(resp.StatusCode)].(map[string]any)
+	if !ok && resp.StatusCode >= 500 {
+		doc, ok = responses["default"].(map[string]any)
+	}
+	if !ok {
+		t.Errorf("%s: status %d is not documented", where, resp.StatusCode)
+		return
+	}
+	doc = spec.resolve(doc)
+	if _, ok := doc["content"]; !ok {
+		if body, _ := io.ReadAll(resp.Body); len(body) > 0 {
+			t.Errorf("%s: status %d is documented without a body, got %q", where, resp.StatusCode, body)
+		}
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Errorf("%s: invalid content type: %v", where, err)
+		return
+	}
+	content, ok := doc["content"].(map[string]any)[mediaType].(map[string]any)
+	if !ok {
+		t.Errorf("%s: content type %s is not documented for status %d", where, mediaType, resp.StatusCode)
+		return
+	}
+	if mediaType != "application/json" {
+		return
+	}
+	var body any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Errorf("%s: invalid JSON body: %v", where, err)
+		return
+	}
+	spec.validate(t, content["schema"].(map[string]any), body, fmt.Sprintf("%s %d", where, resp.StatusCode))
+}
+
+// exampleRequest builds a request body and headers from the examples of an operation's
+// request body and header parameters.
+func (spec openAPI) exampleRequest(t *testing.T, op map[string]any) (io.Reader, http.Header) {
+	t.Helper()
+	header := http.Header{}
+	params, _ := op["parameters"].([]any)
+	for _, p := range params {
+		param := spec.resolve(p.(map[string]any))
+		if example, ok := param["example"]; ok && param["in"] == "header" {
+			header.Set(param["name"].(string), fmt.Sprint(example))
+		}
+	}
+
+	rb, ok := op["requestBody"].(map[string]any)
+	if !ok {
+		return nil, header
+	}
+	content := rb["content"].(map[string]any)
+	if c, ok := content["application/json"].(map[string]any); ok {
+		b, err := json.Marshal(c["example"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		header.Set("Content-Type", "application/json")
+		return bytes.NewReader(b), header
+	}
+	if c, ok := content["application/octet-stream"].(map[string]any); ok {
+		header.Set("Content-Type", "application/octet-stream")
+		return strings.NewReader(c["example"].(string)), header
+	}
+	if c, ok := content["multipart/form-data"].(map[string]any); ok {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		example := c["example"].(map[string]any)
+		for _, name := range slices.Sorted(maps.Keys(example)) {
+			values, ok := example[name].([]any)
+			if !ok {
+				values = []any{example[name]}
+			}
+			for i, v := range values {
+				value := fmt.Sprint(v)
+				if name == "file" {
+					fw, err := mw.CreateFormFile(name, fmt.Sprintf("example-%d.txt", i+1))
+					if err != nil {
+						t.Fatal(err)
+					}
+					fw.Write([]byte(value))
+					continue
+				}
+				mw.WriteField(name, value)
+			}
+		}
+		mw.Close()
+		header.Set("Content-Type", mw.FormDataContentType())
+		return &buf, header
+	}
+	t.Fatalf("no example request body for %v", op["operationId"])
+	return nil, nil
+}
+
+func newTestServer(t *testing.T) http.Handler {
+	t.Helper()
+	return newTestServerWith(t, slog.New(slog.DiscardHandler), nil)
+}
+
+// newTestServerWith builds a server configured from env, logging to l.
+func newTestServerWith(t *testing.T, l *slog.Logger, env map[string]string) http.Handler {
+	t.Helper()
+	cfg, err := config.ParseConfig([]string{"shhh"}, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	memStore := memstore.NewMemoryStore(cfg.MaxRetention, cfg.MaxItems, cfg.MaxFileSize)
+	t.Cleanup(memStore.Stop)
+	handler, err := NewServer(l, cfg, memStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+func serve(handler http.Handler, method, path string, body io.Reader, header http.Header) *http.Response {
+	req := httptest.NewRequest(method, path, body)
+	maps.Copy(req.Header, header)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	spec := loadOpenAPI(t)
+	if spec["openapi"] != "3.1.0" {
+		t.Errorf("openapi = %v, want 3.1.0", spec["openapi"])
+	}
+
+	registered := registeredRoutes(t)
+	for _, route := range registered {
+		if spec.operation(route) == nil {
+			t.Errorf("route %q is not in openapi.json", route)
+		}
+	}
+	for path, item := range spec["paths"].(map[string]any) {
+		for method := range item.(map[string]any) {
+			route := strings.ToUpper(method) + " " + path
+			if !slices.Contains(registered, route) {
+				t.Errorf("openapi.json documents %q, which is not registered", route)
+			}
+		}
+	}
+
+	handler := newTestServer(t)
+	for _, path := range []string{"/api/v1/openapi.json", "/api/openapi.json"} {
+		resp := serve(handler, http.MethodGet, path, nil, nil)
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(body, openAPISpec) {
+			t.Errorf("GET %s = %d, want the spec", path, resp.StatusCode)
+		}
+	}
+}
+
+// TestOpenAPIResponses sends every registered route its documented example request, and
+// a malformed one, and checks the responses against the spec.
+func TestOpenAPIResponses(t *testing.T) {
+	spec := loadOpenAPI(t)
+	handler := newTestServer(t)
+
+	// routes with an ID get a secret of their own, created with the createSecret example
+	newSecret := func(t *testing.T) string {
+		body, header := spec.exampleRequest(t, spec.operation("POST /secret"))
+		resp := serve(handler, http.MethodPost, "/api/v1/secret", body, header)
+		var created struct {
+			Key string `json:"key"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("can't create secret: %d, %v", resp.StatusCode, err)
+		}
+		return created.Key
+	}
+
+	for _, route := range registeredRoutes(t) {
+		t.Run(route, func(t *testing.T) {
+			op := spec.operation(route)
+			if op == nil {
+				t.Skip("not in the spec, reported by TestOpenAPIRoutes")
+			}
+			method, path, _ := strings.Cut(route, " ")
+			if strings.Contains(path, "{id}") {
+				path = strings.ReplaceAll(path, "{id}", newSecret(t))
+			}
+
+			if rb, ok := op["requestBody"].(map[string]any); ok {
+				for mediaType, c := range rb["content"].(map[string]any) {
+					if example, ok := c.(map[string]any)["example"]; ok && mediaType == "application/json" {
+						spec.validate(t, c.(map[string]any)["schema"].(map[string]any), example, "request example")
+					}
+				}
+			}
+
+			body, header := spec.exampleRequest(t, op)
+			spec.checkResponse(t, op, serve(handler, method, "/api/v1"+path, body, header), "example request")
+
+			if body != nil {
+				header.Set("Content-Type", "application/json")
+				resp := serve(handler, method, "/api/v1"+path, strings.NewReader("{"), header)
+				if resp.StatusCode != http.StatusBadRequest {
+					t.Errorf("malformed request: status %d, want 400", resp.StatusCode)
+				}
+				spec.checkResponse(t, op, resp, "malformed request")
+			}
+		})
+	}
+}
+
+// readFields returns the form fields and headers the server reads by name, from its
+// source: arguments of FormValue and Header.Get calls, Form indexes, and the part
+// names readMultipartFiles compares against.
+func readFields(t *testing.T) []string {
+	t.Helper()
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields []string
+	literal := func(e ast.Expr) {
+		if lit, ok := e.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			s, _ := strconv.Unquote(lit.Value)
+			fields = append(fields, s)
+		}
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				if sel, ok := n.Fun.(*ast.SelectorExpr); ok && len(n.Args) == 1 && (sel.Sel.Name == "FormValue" || sel.Sel.Name == "Get") {
+					literal(n.Args[0])
+				}
+			case *ast.IndexExpr:
+				if sel, ok := n.X.(*ast.SelectorExpr); ok && sel.Sel.Name == "Form" {
+					literal(n.Index)
+				}
+			case *ast.BinaryExpr:
+				if id, ok := n.X.(*ast.Ident); ok && id.Name == "name" && n.Op == token.EQL {
+					literal(n.Y)
+				}
+			}
+			return true
+		})
+	}
+	return fields
+}
+
+// jsonFields returns the JSON names of a struct's fields, including promoted ones.
+func jsonFields(typ reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := range typ.NumField() {
+		f := typ.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch {
+		case f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct:
+			maps.Copy(fields, jsonFields(f.Type))
+		case f.IsExported() && name != "-":
+			fields[cmp.Or(name, f.Name)] = f.Type
+		}
+	}
+	return fields
+}
+
+// checkFields reports properties of an object schema that typ doesn't decode, which
+// the server would silently ignore.
+func (spec openAPI) checkFields(t *testing.T, schema map[string]any, typ reflect.Type, where string) {
+	t.Helper()
+	schema = spec.resolve(schema)
+	if all, ok := schema["allOf"].([]any); ok {
+		for _, sub := range all {
+			spec.checkFields(t, sub.(map[string]any), typ, where)
+		}
+	}
+	for typ.Kind() == reflect.Pointer || typ.Kind() == reflect.Slice {
+		typ = typ.Elem()
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		spec.checkFields(t, items, typ, where+"[]")
+	}
+	props, _ := schema["properties"].(map[string]any)
+	if typ.Kind() != reflect.Struct {
+		return
+	}
+	fields := jsonFields(typ)
+	for _, name := range slices.Sorted(maps.Keys(props)) {
+		field, ok := fields[name]
+		if !ok {
+			t.Errorf("%s.%s: not read by the server", where, name)
+			continue
+		}
+		spec.checkFields(t, props[name].(map[string]any), field, where+"."+name)
+	}
+}
+
+// TestOpenAPIRequests checks that the create endpoints' documented requests are what
+// their handlers read: JSON examples decode into the request types without unknown
+// fields, and every documented property, form field and header is read.
+func TestOpenAPIRequests(t *testing.T) {
+	spec := loadOpenAPI(t)
+
+	for route, req := range map[string]any{
+		"POST /secret":        &saveSecretRequest{},
+		"POST /secrets:batch": &batchRequest{},
+		"POST /shares":        &saveSharesRequest{},
+	} {
+		t.Run(route, func(t *testing.T) {
+			content := spec.operation(route)["requestBody"].(map[string]any)["content"].(map[string]any)["application/json"].(map[string]any)
+			b, err := json.Marshal(content["example"])
+			if err != nil {
+				t.Fatal(err)
+			}
+			dec := json.NewDecoder(bytes.NewReader(b))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(req); err != nil {
+				t.Errorf("example doesn't decode into %T: %v", req, err)
+			}
+			spec.checkFields(t, content["schema"].(map[string]any), reflect.TypeOf(req), "request")
+		})
+	}
+
+	read := readFields(t)
+	t.Run("POST /file", func(t *testing.T) {
+		content := spec.operation("POST /file")["requestBody"].(map[string]any)["content"].(map[string]any)["multipart/form-data"].(map[string]any)
+		for name := range spec.resolve(content["schema"].(map[string]any))["properties"].(map[string]any) {
+			if !slices.Contains(read, name) {
+				t.Errorf("form field %q is not read by the server", name)
+			}
+		}
+		for name := range content["example"].(map[string]any) {
+			if !slices.Contains(read, name) {
+				t.Errorf("example form field %q is not read by the server", name)
+			}
+		}
+	})
+	t.Run("PUT /file", func(t *testing.T) {
+		for _, p := range spec.operation("PUT /file")["parameters"].([]any) {
+			if param := spec.resolve(p.(map[string]any)); param["in"] == "header" && !slices.Contains(read, param["name"].(string)) {
+				t.Errorf("header %q is not read by the server", param["name"])
+			}
+		}
+	})
+}
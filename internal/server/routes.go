@@ -3,6 +3,7 @@ package server
 import (
 	"log/slog"
 
+	"filippo.io/age"
 	"github.com/en9inerd/go-pkgs/middleware"
 	"github.com/en9inerd/go-pkgs/router"
 	"github.com/en9inerd/shhh/internal/config"
@@ -14,12 +15,26 @@ func registerRoutes(
 	logger *slog.Logger,
 	cfg *config.Config,
 	memStore *memstore.MemoryStore,
+	ageIdentities []age.Identity,
+	signers *signers,
+	idempotency *idempotencyCache,
 ) {
 	apiGroup.Use(Logger(logger))
-	apiGroup.HandleFunc("POST /secret", saveSecret(logger, cfg, memStore))
-	apiGroup.HandleFunc("POST /file", uploadFile(logger, cfg, memStore))
-	apiGroup.HandleFunc("POST /secret/{id}", retrieveSecret(logger, memStore))
+	apiGroup.HandleFunc("POST /secret", idempotency.idempotent(logger, saveSecret(logger, cfg, memStore, signers)))
+	apiGroup.HandleFunc("POST /file", idempotency.idempotent(logger, uploadFile(logger, cfg, memStore, ageIdentities, signers)))
+	apiGroup.HandleFunc("PUT /file", idempotency.idempotent(logger, uploadRawFile(logger, cfg, memStore, signers)))
+	apiGroup.HandleFunc("POST /secrets:batch", idempotency.idempotent(logger, saveSecretBatch(logger, cfg, memStore, signers)))
+	apiGroup.HandleFunc("POST /secret/{id}", retrieveSecret(logger, cfg, memStore, signers))
+	apiGroup.HandleFunc("DELETE /secret/{id}", revokeSecret(logger, memStore))
+	apiGroup.HandleFunc("POST /secret/{id}/envelope", retrieveEnvelope(logger, memStore))
+	apiGroup.HandleFunc("POST /secret/{id}/pake", startPAKE(logger, cfg, memStore))
+	apiGroup.HandleFunc("POST /secret/{id}/pake/finish", finishPAKE(logger, cfg, memStore))
+	apiGroup.HandleFunc("POST /shares", idempotency.idempotent(logger, saveShares(logger, cfg, memStore)))
+	apiGroup.HandleFunc("POST /shares/combine", combineShares(logger, cfg))
+	apiGroup.HandleFunc("GET /passphrase", newPassphrase(logger, cfg))
+	apiGroup.HandleFunc("POST /passphrase/strength", checkPassphrase(logger, cfg))
 	apiGroup.HandleFunc("GET /params", getParams(logger, cfg))
+	apiGroup.HandleFunc("GET /openapi.json", getOpenAPI(logger))
 }
 
 func registerWebRoutes(
@@ -28,11 +43,15 @@ func registerWebRoutes(
 	cfg *config.Config,
 	memStore *memstore.MemoryStore,
 	templates *templateCache,
+	signers *signers,
 ) {
 	webGroup.Use(Logger(logger), middleware.StripSlashes)
 	webGroup.HandleFunc("GET /", homePage(logger, cfg, templates))
 	webGroup.HandleFunc("GET /secret/{id}", retrievePage(logger, templates))
+	webGroup.HandleFunc("GET /batch", batchPage(logger, cfg, templates))
 	webGroup.HandleFunc("POST /web/secret", createTextSecretWeb(logger, cfg, memStore, templates))
 	webGroup.HandleFunc("POST /web/file", createFileSecretWeb(logger, cfg, memStore, templates))
-	webGroup.HandleFunc("POST /web/retrieve", retrieveSecretWeb(logger, memStore, templates))
+	webGroup.HandleFunc("POST /web/batch", createBatchWeb(logger, cfg, memStore, templates, signers))
+	webGroup.HandleFunc("POST /web/strength", passphraseStrengthWeb(logger, cfg, templates))
+	webGroup.HandleFunc("POST /web/retrieve", retrieveSecretWeb(logger, cfg, memStore, templates, signers))
 }
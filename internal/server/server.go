@@ -5,11 +5,14 @@ import (
 	"io/fs"
 	"log/slog"
 	"net/http"
+	"os"
 	"time"
 
+	"filippo.io/age"
 	"github.com/en9inerd/go-pkgs/middleware"
 	"github.com/en9inerd/go-pkgs/router"
 	"github.com/en9inerd/shhh/internal/config"
+	"github.com/en9inerd/shhh/internal/crypto"
 	"github.com/en9inerd/shhh/internal/memstore"
 	"github.com/en9inerd/shhh/ui"
 )
@@ -42,6 +45,16 @@ func NewServer(
 		middleware.SizeLimit(maxRequestSize),
 	)
 
+	ageIdentities, err := loadAgeIdentities(cfg.AgeIdentityFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load age identities: %w", err)
+	}
+
+	signers, err := loadSigners(cfg.TrustStoreFile, cfg.SendersFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sender keys: %w", err)
+	}
+
 	templates, err := newTemplateCache()
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize templates: %w", err)
@@ -53,15 +66,37 @@ func NewServer(
 	}
 	r.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticFS))))
 
+	// one cache for both API versions, so they share its size limit
+	idempotency := newIdempotencyCache(cfg.IdempotencyWindow, cfg.IdempotencyMaxKeys)
+
+	r.Mount("/api/v1").Route(func(apiGroup *router.Group) {
+		registerRoutes(apiGroup, logger, cfg, memStore, ageIdentities, signers, idempotency)
+	})
+
+	// the unversioned routes are deprecated aliases of /api/v1
 	r.Mount("/api").Route(func(apiGroup *router.Group) {
-		registerRoutes(apiGroup, logger, cfg, memStore)
+		apiGroup.Use(legacyAPI)
+		registerRoutes(apiGroup, logger, cfg, memStore, ageIdentities, signers, idempotency)
 	})
 
 	r.Group().Route(func(webGroup *router.Group) {
-		registerWebRoutes(webGroup, logger, cfg, memStore, templates)
+		registerWebRoutes(webGroup, logger, cfg, memStore, templates, signers)
 	})
 
 	r.NotFoundHandler(notFoundPage(logger, templates))
 
 	return r, nil
 }
+
+// loadAgeIdentities reads the identities used to decrypt age uploads server-side.
+// It returns nil if no identity file is configured.
+func loadAgeIdentities(path string) ([]age.Identity, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.ParseAgeIdentities(b)
+}
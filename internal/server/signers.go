@@ -0,0 +1,187 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/en9inerd/shhh/internal/crypto"
+	"github.com/en9inerd/shhh/internal/memstore"
+)
+
+var (
+	errBadAuthorization = errors.New("authorization must be a bearer token")
+	errUnknownSender    = errors.New("unknown sender token")
+)
+
+// signers holds the keys the server signs with for registered senders, and the
+// trust store signatures are checked against when a secret is retrieved.
+type signers struct {
+	trust   *crypto.TrustStore
+	senders map[[sha256.Size]byte]sender // by SHA-256 of the sender's API token
+}
+
+type sender struct {
+	name string
+	key  *crypto.SigningKey
+}
+
+// signatureInfo is what a recipient is told about a signed secret.
+type signatureInfo struct {
+	Sender         string `json:"sender"`
+	KeyFingerprint string `json:"key_fingerprint"`
+	Verified       bool   `json:"verified"`
+	Reason         string `json:"reason,omitempty"` // why the signature can't be trusted
+}
+
+// loadSigners reads the trust store and the senders file. Registered senders'
+// keys are trusted for their names without being listed in the trust store.
+func loadSigners(trustFile, sendersFile string) (*signers, error) {
+	s := &signers{trust: &crypto.TrustStore{}, senders: make(map[[sha256.Size]byte]sender)}
+	if trustFile != "" {
+		b, err := os.ReadFile(trustFile)
+		if err != nil {
+			return nil, err
+		}
+		if s.trust, err = crypto.ParseTrustStore(string(b)); err != nil {
+			return nil, err
+		}
+	}
+	if sendersFile == "" {
+		return s, nil
+	}
+	b, err := os.ReadFile(sendersFile)
+	if err != nil {
+		return nil, err
+	}
+	for line := range strings.Lines(string(b)) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, errors.New("sender lines must be in name token-sha256 signing-key form")
+		}
+		name := fields[0]
+		hash, err := hex.DecodeString(fields[1])
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid token hash for sender %q", name)
+		}
+		key, err := crypto.ParseSigningKey(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key for sender %q: %w", name, err)
+		}
+		if err := s.trust.Add(name, key.Public()); err != nil {
+			return nil, err
+		}
+		s.senders[[sha256.Size]byte(hash)] = sender{name: name, key: key}
+	}
+	return s, nil
+}
+
+// sign returns the signature to store with data. A registered sender, identified by the
+// API token in the Authorization header, is signed for with their server-side key. A
+// signature made by the client is checked against data and kept as is. It returns nil
+// if the secret isn't signed.
+func (s *signers) sign(r *http.Request, data []byte, client *memstore.Signature) (*memstore.Signature, error) {
+	auth := r.Header.Get("Authorization")
+	if auth != "" {
+		if client != nil {
+			return nil, errors.New("a secret can't carry a client signature and a sender token")
+		}
+		token, ok := strings.CutPrefix(auth, "Bearer ")
+		if !ok {
+			return nil, errBadAuthorization
+		}
+		snd, ok := s.senders[sha256.Sum256([]byte(token))]
+		if !ok {
+			return nil, errUnknownSender
+		}
+		return &memstore.Signature{
+			Sender:    snd.name,
+			PublicKey: snd.key.Public().String(),
+			Value:     snd.key.Sign(snd.name, data),
+		}, nil
+	}
+
+	if client == nil {
+		return nil, nil
+	}
+	if !crypto.ValidSenderName(client.Sender) {
+		return nil, errors.New("invalid sender name")
+	}
+	key, err := crypto.ParseVerifyingKey(client.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature public key: %w", err)
+	}
+	if !key.Verify(client.Sender, data, client.Value) {
+		return nil, errors.New("signature doesn't match the secret")
+	}
+	return client, nil
+}
+
+// sendSignError responds to an error from sign: a bad sender token is unauthorized,
+// anything else is an invalid signature.
+func sendSignError(w http.ResponseWriter, r *http.Request, l *slog.Logger, err error) {
+	if errors.Is(err, errBadAuthorization) || errors.Is(err, errUnknownSender) {
+		sendError(w, r, l, http.StatusUnauthorized, codeUnauthorized, err, err.Error())
+		return
+	}
+	sendError(w, r, l, http.StatusBadRequest, codeInvalidSignature, err, err.Error())
+}
+
+// signatureFromForm decodes the JSON signature form field of a multipart upload.
+func signatureFromForm(r *http.Request) (*memstore.Signature, error) {
+	v := r.FormValue("signature")
+	if v == "" {
+		return nil, nil
+	}
+	var sig memstore.Signature
+	if err := json.Unmarshal([]byte(v), &sig); err != nil {
+		return nil, errors.New("invalid signature")
+	}
+	return &sig, nil
+}
+
+// check verifies a stored signature against data and the trust store. A signature
+// is only reported as verified if it is valid and its key is trusted for its sender.
+func (s *signers) check(sig *memstore.Signature, data []byte) *signatureInfo {
+	if sig == nil {
+		return nil
+	}
+	info := &signatureInfo{Sender: sig.Sender}
+	key, err := crypto.ParseVerifyingKey(sig.PublicKey)
+	if err != nil {
+		info.Reason = "the signature has an invalid key"
+		return info
+	}
+	info.KeyFingerprint = key.Fingerprint()
+	switch {
+	case !key.Verify(sig.Sender, data, sig.Value):
+		info.Reason = "the signature doesn't match the secret"
+	case !s.trust.Trusts(sig.Sender, key):
+		info.Reason = "the key is not trusted for this sender"
+	default:
+		info.Verified = true
+	}
+	return info
+}
+
+// setSignatureHeaders describes a file download's content fingerprint and signature
+// in response headers, since the body is the file itself.
+func setSignatureHeaders(w http.ResponseWriter, data []byte, info *signatureInfo) {
+	w.Header().Set("X-Content-SHA256", crypto.ContentFingerprint(data))
+	if info == nil {
+		return
+	}
+	w.Header().Set("X-Signature-Sender", info.Sender)
+	w.Header().Set("X-Signature-Key-Fingerprint", info.KeyFingerprint)
+	w.Header().Set("X-Signature-Verified", fmt.Sprint(info.Verified))
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/en9inerd/shhh/internal/crypto"
+	"github.com/en9inerd/shhh/internal/memstore"
+)
+
+const senderToken = "alice-api-token"
+
+// newSigningServer returns a server that signs for alice with her API token, and
+// trusts bob's key.
+func newSigningServer(t *testing.T) (http.Handler, *crypto.SigningKey, *crypto.SigningKey) {
+	t.Helper()
+	alice, err := crypto.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := crypto.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	tokenHash := sha256.Sum256([]byte(senderToken))
+	sendersFile := filepath.Join(dir, "senders")
+	trustFile := filepath.Join(dir, "trust")
+	if err := os.WriteFile(sendersFile, []byte("# sender token-sha256 key\nalice "+hex.EncodeToString(tokenHash[:])+" "+alice.String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(trustFile, []byte("bob "+bob.Public().String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestServerWith(t, slog.New(slog.DiscardHandler), map[string]string{
+		"SHHH_SENDERS_FILE":     sendersFile,
+		"SHHH_TRUST_STORE_FILE": trustFile,
+	})
+	return handler, alice, bob
+}
+
+// clientSignature returns the signature field of a secret signed by a client.
+func clientSignature(sender string, key *crypto.SigningKey, data string) string {
+	b, _ := json.Marshal(memstore.Signature{Sender: sender, PublicKey: key.Public().String(), Value: key.Sign(sender, []byte(data))})
+	return string(b)
+}
+
+func TestSignedSecrets(t *testing.T) {
+	handler, alice, bob := newSigningServer(t)
+	carol, err := crypto.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		auth      string
+		signature string
+		status    int
+		code      errorCode
+		want      *signatureInfo
+	}{
+		{
+			name: "sender token", auth: "Bearer " + senderToken, status: http.StatusCreated,
+			want: &signatureInfo{Sender: "alice", KeyFingerprint: alice.Public().Fingerprint(), Verified: true},
+		},
+		{name: "unknown token", auth: "Bearer other-token", status: http.StatusUnauthorized, code: codeUnauthorized},
+		{name: "not a bearer token", auth: "Basic " + senderToken, status: http.StatusUnauthorized, code: codeUnauthorized},
+		{
+			name: "client signature and token", auth: "Bearer " + senderToken, signature: clientSignature("bob", bob, "s"),
+			status: http.StatusBadRequest, code: codeInvalidSignature,
+		},
+		{
+			name: "trusted client signature", signature: clientSignature("bob", bob, "s"), status: http.StatusCreated,
+			want: &signatureInfo{Sender: "bob", KeyFingerprint: bob.Public().Fingerprint(), Verified: true},
+		},
+		{name: "forged client signature", signature: clientSignature("bob", bob, "other"), status: http.StatusBadRequest, code: codeInvalidSignature},
+		{
+			name: "signed as another sender", signature: clientSignature("alice", bob, "s"), status: http.StatusCreated,
+			want: &signatureInfo{Sender: "alice", KeyFingerprint: bob.Public().Fingerprint(), Reason: "the key is not trusted for this sender"},
+		},
+		{
+			name: "untrusted key", signature: clientSignature("carol", carol, "s"), status: http.StatusCreated,
+			want: &signatureInfo{Sender: "carol", KeyFingerprint: carol.Public().Fingerprint(), Reason: "the key is not trusted for this sender"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"secret": "s", "exp": 3600, "passphrase": "correct-horse-battery-staple"}`
+			if tt.signature != "" {
+				body = `{"secret": "s", "exp": 3600, "passphrase": "correct-horse-battery-staple", "signature": ` + tt.signature + `}`
+			}
+			header := jsonHeader()
+			if tt.auth != "" {
+				header.Set("Authorization", tt.auth)
+			}
+			resp := serve(handler, http.MethodPost, "/api/v1/secret", strings.NewReader(body), header)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("create: status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.code != "" {
+				var failed struct {
+					Error apiError `json:"error"`
+				}
+				if err := json.NewDecoder(resp.Body).Decode(&failed); err != nil || failed.Error.Code != tt.code {
+					t.Errorf("error %+v, %v, want %s", failed.Error, err, tt.code)
+				}
+				return
+			}
+
+			var created struct {
+				Key string `json:"key"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+				t.Fatal(err)
+			}
+			resp = serve(handler, http.MethodPost, "/api/v1/secret/"+created.Key,
+				strings.NewReader(`{"passphrase": "correct-horse-battery-staple"}`), jsonHeader())
+			var retrieved struct {
+				Signature *signatureInfo `json:"signature"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&retrieved); err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("retrieve: status %d, %v", resp.StatusCode, err)
+			}
+			if retrieved.Signature == nil || *retrieved.Signature != *tt.want {
+				t.Errorf("signature %+v, want %+v", retrieved.Signature, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignedFileHeaders(t *testing.T) {
+	handler, alice, _ := newSigningServer(t)
+	data := "file content"
+
+	resp := serve(handler, http.MethodPut, "/api/v1/file", strings.NewReader(data), http.Header{
+		"Content-Type":  {"application/octet-stream"},
+		"Authorization": {"Bearer " + senderToken},
+		"X-Filename":    {"notes.txt"},
+		"X-Passphrase":  {"correct-horse-battery-staple"},
+		"X-Exp":         {"3600"},
+	})
+	var created struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload: status %d, %v", resp.StatusCode, err)
+	}
+
+	resp = serve(handler, http.MethodPost, "/api/v1/secret/"+created.Key,
+		strings.NewReader(`{"passphrase": "correct-horse-battery-staple"}`), jsonHeader())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("retrieve: status %d", resp.StatusCode)
+	}
+	for header, want := range map[string]string{
+		"X-Content-SHA256":            crypto.ContentFingerprint([]byte(data)),
+		"X-Signature-Sender":          "alice",
+		"X-Signature-Key-Fingerprint": alice.Public().Fingerprint(),
+		"X-Signature-Verified":        "true",
+	} {
+		if got := resp.Header.Get(header); got != want {
+			t.Errorf("%s %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestLoadSigners_Invalid(t *testing.T) {
+	key, err := crypto.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := strings.Repeat("ab", sha256.Size)
+	for name, line := range map[string]string{
+		"missing key":  "alice " + hash,
+		"short hash":   "alice abcd " + key.String(),
+		"invalid key":  "alice " + hash + " " + key.Public().String(),
+		"invalid name": "al/ice " + hash + " " + key.String(),
+	} {
+		file := filepath.Join(t.TempDir(), "senders")
+		if err := os.WriteFile(file, []byte(line), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadSigners("", file); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
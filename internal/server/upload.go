@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+
+	"github.com/en9inerd/shhh/internal/memstore"
+)
+
+// maxFormFieldsSize bounds the non-file fields of a multipart upload together.
+const maxFormFieldsSize = 10240
+
+var (
+	errInvalidForm  = errors.New("invalid form data")
+	errFileRequired = errors.New("file is required")
+)
+
+// readLimited reads r into memory, failing with memstore.ErrTooLarge if it holds more
+// than limit bytes. size is the expected length if known, so the buffer is allocated
+// once instead of leaving partial copies of the secret behind as it grows.
+func readLimited(r io.Reader, limit, size int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if size > 0 {
+		buf.Grow(int(min(size, limit)) + bytes.MinRead)
+	}
+	n, err := buf.ReadFrom(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > limit {
+		return nil, memstore.ErrTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+// upload is a file part of a multipart upload.
+type upload struct {
+	filename string
+	data     []byte
+}
+
+// readMultipartFiles streams a multipart upload and returns its "file" parts. Unlike
+// ParseMultipartForm, it never spills parts to temporary files: the files and the
+// optional "message" field are read into memory up to maxFileSize bytes together, and
+// the other fields up to maxFormFieldsSize, after which they are available from
+// r.FormValue.
+func readMultipartFiles(r *http.Request, maxFileSize int64) ([]upload, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, errInvalidForm
+	}
+
+	form := url.Values{}
+	var files []upload
+	dataLeft, fieldsLeft := maxFileSize, int64(maxFormFieldsSize)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errInvalidForm
+		}
+
+		name := part.FormName()
+		switch {
+		case name == "":
+		case name == "file" || name == "message":
+			data, err := readLimited(part, dataLeft, 0)
+			if err != nil {
+				part.Close()
+				return nil, err
+			}
+			dataLeft -= int64(len(data))
+			if name == "file" {
+				files = append(files, upload{filename: part.FileName(), data: data})
+			} else {
+				form.Add(name, string(data))
+			}
+		default:
+			v, err := readLimited(part, fieldsLeft, 0)
+			if err != nil {
+				part.Close()
+				if errors.Is(err, memstore.ErrTooLarge) {
+					return nil, errors.New("form fields are too large")
+				}
+				return nil, err
+			}
+			fieldsLeft -= int64(len(v))
+			form.Add(name, string(v))
+		}
+		part.Close()
+	}
+	if len(files) == 0 {
+		return nil, errFileRequired
+	}
+
+	r.PostForm = form
+	r.Form = maps.Clone(form)
+	for k, vs := range r.URL.Query() {
+		r.Form[k] = append(r.Form[k], vs...)
+	}
+	return files, nil
+}
+
+// readMultipartFile is readMultipartFiles for uploads of exactly one file, and returns
+// its data and filename.
+func readMultipartFile(r *http.Request, maxFileSize int64) (data []byte, filename string, err error) {
+	files, err := readMultipartFiles(r, maxFileSize)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(files) > 1 {
+		return nil, "", errors.New("only one file can be uploaded")
+	}
+	return files[0].data, files[0].filename, nil
+}
+
+// fileContent returns the data and metadata to store for uploaded files: a file secret
+// for a single file, or a bundle for several files or files with a message.
+func fileContent(files []upload, message string) ([]byte, memstore.Metadata) {
+	if len(files) == 1 && message == "" {
+		return files[0].data, memstore.FileMetadata(files[0].filename)
+	}
+	bundle := make([]memstore.BundleFile, len(files))
+	for i, f := range files {
+		bundle[i] = memstore.BundleFile{ManifestFile: memstore.ManifestFile{Name: f.filename}, Data: f.data}
+	}
+	return memstore.NewBundle([]byte(message), bundle)
+}
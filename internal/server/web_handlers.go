@@ -1,10 +1,11 @@
 package server
 
 import (
+	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"html/template"
-	"io"
 	"io/fs"
 	"log/slog"
 	"net/http"
@@ -14,7 +15,9 @@ import (
 	"time"
 
 	"github.com/en9inerd/shhh/internal/config"
+	"github.com/en9inerd/shhh/internal/crypto"
 	"github.com/en9inerd/shhh/internal/memstore"
+	"github.com/en9inerd/shhh/internal/qrcode"
 	"github.com/en9inerd/shhh/ui"
 )
 
@@ -100,6 +103,21 @@ func (tc *templateCache) render(w http.ResponseWriter, name string, td *template
 	return tmpl.ExecuteTemplate(w, "base", td)
 }
 
+// renderPaddedFragment renders a fragment padded with padBody.
+func (tc *templateCache) renderPaddedFragment(w http.ResponseWriter, name string, td *templateData, padding crypto.Padding) error {
+	tmpl, ok := tc.templates[name]
+	if !ok {
+		return fmt.Errorf("template fragment %s not found", name)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, name, td); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err := w.Write(padBody(buf.Bytes(), padding))
+	return err
+}
+
 func (tc *templateCache) renderFragment(w http.ResponseWriter, name string, td *templateData) error {
 	tmpl, ok := tc.templates[name]
 	if !ok {
@@ -130,7 +148,6 @@ func getExpirationIntervals(maxRetention time.Duration) []expirationInterval {
 	return append(filtered, expirationInterval{Label: "Custom", Seconds: 0})
 }
 
-
 func renderError(w http.ResponseWriter, templates *templateCache, message string) {
 	templates.renderFragment(w, "errors", &templateData{Form: map[string]string{"error": message}})
 }
@@ -153,7 +170,6 @@ func parseExpiration(expUnit, customExp string) (int, error) {
 	return exp, nil
 }
 
-
 func renderPage(w http.ResponseWriter, logger *slog.Logger, templates *templateCache, pageName string, td *templateData) {
 	if err := templates.render(w, pageName, td); err != nil {
 		logger.Error("failed to render page", "page", pageName, "error", err)
@@ -202,17 +218,17 @@ func notFoundPage(logger *slog.Logger, templates *templateCache) http.HandlerFun
 	}
 }
 
-func createSecretWeb(logger *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore, templates *templateCache, getData func(*http.Request) ([]byte, string, error)) http.HandlerFunc {
+func createSecretWeb(logger *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore, templates *templateCache, getData func(*http.Request) ([]byte, memstore.Metadata, error)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		data, filename, err := getData(r)
+		data, meta, err := getData(r)
 		if err != nil {
 			logger.Warn("failed to get data", "error", err)
 			renderError(w, templates, err.Error())
 			return
 		}
 
-		passphrase := r.FormValue("passphrase")
-		if err := validatePassphrase(passphrase, cfg); err != nil {
+		key := secretKeyFromForm(r)
+		if err := key.validate(cfg); err != nil {
 			renderError(w, templates, err.Error())
 			return
 		}
@@ -223,62 +239,122 @@ func createSecretWeb(logger *slog.Logger, cfg *config.Config, memStore *memstore
 			return
 		}
 
-		id, storedItem, err := memStore.Store(data, filename, passphrase, calculateTTL(exp, cfg.MaxRetention))
+		id, token, storedItem, err := storeSecret(memStore, data, meta, key, calculateTTL(exp, cfg.MaxRetention))
 		if err != nil {
 			logger.Warn("failed to store", "error", err)
 			renderError(w, templates, "Failed to create secret")
 			return
 		}
 
-		logger.Info("created secret", "id", id, "filename", filename, "expires_at", storedItem.ExpiresAt.Format(time.RFC3339))
-		renderSuccess(w, templates, id, cfg)
+		logger.Info("created secret", "id", id, "expires_at", storedItem.ExpiresAt.Format(time.RFC3339))
+		renderSuccess(w, r, logger, templates, cfg, id, token, key, storedItem.ExpiresAt)
 	}
 }
 
 func createTextSecretWeb(logger *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore, templates *templateCache) http.HandlerFunc {
-	getData := func(r *http.Request) ([]byte, string, error) {
+	getData := func(r *http.Request) ([]byte, memstore.Metadata, error) {
 		if err := r.ParseForm(); err != nil {
-			return nil, "", fmt.Errorf("invalid form data")
+			return nil, memstore.Metadata{}, fmt.Errorf("invalid form data")
+		}
+		if r.FormValue("kind") == memstore.KindCredential {
+			return credentialContent(credentialFromForm(r), cfg)
 		}
 		secret := r.FormValue("secret")
 		if secret == "" {
-			return nil, "", fmt.Errorf("secret is required")
+			return nil, memstore.Metadata{}, fmt.Errorf("secret is required")
 		}
-		return []byte(secret), "", nil
+		return []byte(secret), memstore.TextMetadata(), nil
 	}
 	return createSecretWeb(logger, cfg, memStore, templates, getData)
 }
 
 func createFileSecretWeb(logger *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore, templates *templateCache) http.HandlerFunc {
-	getData := func(r *http.Request) ([]byte, string, error) {
-		if err := r.ParseMultipartForm(cfg.MaxFileSize + 10240); err != nil {
-			return nil, "", fmt.Errorf("invalid form data")
+	getData := func(r *http.Request) ([]byte, memstore.Metadata, error) {
+		files, err := readMultipartFiles(r, cfg.MaxFileSize)
+		switch {
+		case errors.Is(err, memstore.ErrTooLarge):
+			return nil, memstore.Metadata{}, fmt.Errorf("files exceed maximum size")
+		case errors.Is(err, errFileRequired):
+			return nil, memstore.Metadata{}, err
+		case err != nil:
+			return nil, memstore.Metadata{}, fmt.Errorf("failed to read file")
 		}
-		file, header, err := r.FormFile("file")
-		if err != nil {
-			return nil, "", fmt.Errorf("file is required")
-		}
-		defer file.Close()
-
-		fileData, err := io.ReadAll(file)
-		if err != nil {
-			return nil, "", fmt.Errorf("failed to read file")
-		}
-		return fileData, header.Filename, nil
+		data, meta := fileContent(files, r.FormValue("message"))
+		return data, meta, nil
 	}
 	return createSecretWeb(logger, cfg, memStore, templates, getData)
 }
 
-func renderSuccess(w http.ResponseWriter, templates *templateCache, id string, cfg *config.Config) {
+// shareTexts are ready-to-paste messages with a secret's link.
+type shareTexts struct {
+	Markdown string
+	Email    string
+	Reminder string // the passphrase note to send over another channel, empty without a passphrase
+}
+
+// newShareTexts writes the messages for a link. The passphrase itself is never part of
+// them: the reminder only tells the recipient it follows, so the sender adds it.
+func newShareTexts(link string, expiresAt time.Time, passphrase bool) shareTexts {
+	expires := expiresAt.UTC().Format("Jan 2, 2006 15:04 UTC")
+	email := "Subject: A secret for you\n\nHi,\n\nI shared a secret with you. Open it here:\n\n" + link +
+		"\n\nThe link works only once and expires on " + expires + "."
+	texts := shareTexts{Markdown: "[Open the secret](" + link + ") (works once, expires " + expires + ")"}
+	if passphrase {
+		email += " You need a passphrase to open it, which I'll send you separately."
+		texts.Reminder = "Here is the passphrase for the secret link I emailed you. Please don't keep it with the email:\n\n"
+	} else {
+		email += " Please don't forward this email: anyone with the link can open the secret."
+	}
+	texts.Email = email
+	return texts
+}
+
+// renderSuccess renders the share link with a QR code of it and ready-to-paste messages.
+// In link mode, token is added as the URL fragment, which browsers never send to the
+// server.
+func renderSuccess(w http.ResponseWriter, r *http.Request, logger *slog.Logger, templates *templateCache, cfg *config.Config, id, token string, key secretKey, expiresAt time.Time) {
+	link := secretLink(r, cfg, id, token)
+	form := map[string]any{
+		"recipient": key.recipient != "",
+		"token":     token,
+		"link":      link,
+		"texts":     newShareTexts(link, expiresAt, token == "" && key.recipient == ""),
+	}
+	if code, err := qrcode.Encode([]byte(link)); err == nil {
+		form["qr"] = template.HTML(code.SVG())
+	} else {
+		logger.Warn("can't encode QR code", "error", err)
+	}
 	if err := templates.renderFragment(w, "success", &templateData{
 		SecretID: id,
 		Config:   cfg,
+		Form:     form,
 	}); err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
 }
 
-func retrieveSecretWeb(logger *slog.Logger, memStore *memstore.MemoryStore, templates *templateCache) http.HandlerFunc {
+// passphraseStrengthWeb renders the strength meter shown under the passphrase fields.
+func passphraseStrengthWeb(logger *slog.Logger, cfg *config.Config, templates *templateCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		passphrase := r.FormValue("passphrase")
+		if passphrase == "" {
+			return
+		}
+		// too long passphrases are reported when the form is submitted
+		strength, err := passphraseStrength(passphrase, cfg)
+		if err != nil {
+			return
+		}
+		if err := templates.renderFragment(w, "strength", &templateData{
+			Form: strength,
+		}); err != nil {
+			logger.Error("failed to render strength meter", "error", err)
+		}
+	}
+}
+
+func retrieveSecretWeb(logger *slog.Logger, cfg *config.Config, memStore *memstore.MemoryStore, templates *templateCache, signers *signers) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := r.ParseForm(); err != nil {
 			logger.Warn("failed to parse form", "error", err)
@@ -286,30 +362,81 @@ func retrieveSecretWeb(logger *slog.Logger, memStore *memstore.MemoryStore, temp
 			return
 		}
 
-		id, passphrase := r.FormValue("id"), r.FormValue("passphrase")
-		if id == "" || passphrase == "" {
+		id, passphrase, token := r.FormValue("id"), r.FormValue("passphrase"), r.FormValue("token")
+		if id == "" || (passphrase == "" && token == "") {
 			renderError(w, templates, "ID and passphrase are required")
 			return
 		}
 
-		data, filename, err := memStore.Retrieve(id, passphrase)
-		if err != nil {
+		var data []byte
+		var meta memstore.Metadata
+		var err error
+		if token != "" {
+			data, meta, err = memStore.RetrieveWithKey(id, token)
+		} else {
+			data, meta, err = memStore.Retrieve(id, passphrase)
+		}
+		switch {
+		case errors.Is(err, crypto.ErrTampered):
+			logger.Error("secret failed integrity check, possible tampering", "id", id)
+		case errors.Is(err, crypto.ErrUnknownKeyVersion):
+			logger.Error("secret is wrapped with a master key the server doesn't have", "id", id)
+		case err != nil:
 			logger.Warn("secret retrieval failed", "id", id, "error", err)
+		}
+		if err != nil {
 			renderError(w, templates, "Secret not found or expired")
 			return
 		}
 
-		form := map[string]interface{}{"is_file": filename != ""}
-		if filename != "" {
-			form["filename"] = filename
+		form := map[string]interface{}{"is_file": meta.IsFile()}
+		switch {
+		case meta.IsFile():
+			form["filename"] = meta.Filename
+			form["content_type"] = meta.ContentType
 			form["file_data_b64"] = base64.StdEncoding.EncodeToString(data)
-		} else {
+		case meta.IsBundle():
+			message, files, err := meta.Bundle(data)
+			if err != nil {
+				logger.Error("failed to read bundle", "id", id, "error", err)
+				renderError(w, templates, "Failed to show secret")
+				return
+			}
+			attachments := make([]map[string]any, len(files))
+			for i, f := range files {
+				attachments[i] = map[string]any{
+					"filename":      f.Name,
+					"content_type":  f.ContentType,
+					"size":          f.Size,
+					"file_data_b64": base64.StdEncoding.EncodeToString(f.Data),
+				}
+			}
+			form["message"] = string(message)
+			form["attachments"] = attachments
+		case meta.IsCredential():
+			view, err := newCredentialView(data, time.Now())
+			if err != nil {
+				logger.Error("failed to decode credential", "id", id, "error", err)
+				renderError(w, templates, "Failed to show secret")
+				return
+			}
+			form["credential"] = view
+		default:
 			form["secret"] = string(data)
 		}
+		if meta.Share != nil {
+			form["share"] = meta.Share
+		}
+		form["content_sha256"] = crypto.ContentFingerprint(data)
+		if signature := signers.check(meta.Signature, data); signature != nil {
+			form["signature"] = signature
+		}
 
-		templates.renderFragment(w, "secret_result", &templateData{
+		if err := templates.renderPaddedFragment(w, "secret_result", &templateData{
 			SecretID: id,
 			Form:     form,
-		})
+		}, cfg.Padding); err != nil {
+			logger.Error("failed to render secret", "error", err)
+		}
 	}
 }
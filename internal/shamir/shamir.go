@@ -0,0 +1,200 @@
+// Package shamir implements Shamir's secret sharing over GF(256).
+//
+// Every share carries the ID of the split it belongs to, the threshold and the
+// share count, and the shared value includes a SHA-256 checksum of the secret,
+// so Combine fails closed on shares from different splits, duplicated or
+// corrupted shares, and shares that don't lie on the same polynomial.
+package shamir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	sharePrefix = "shhh-share1:"
+	groupSize   = 16
+	headerSize  = groupSize + 3 // group, threshold, total, x
+)
+
+// ErrInconsistentShares is returned when shares don't reconstruct a valid secret.
+var ErrInconsistentShares = errors.New("inconsistent shares")
+
+// Share is one share of a split secret.
+type Share struct {
+	Group     [groupSize]byte // random ID shared by all shares of one split
+	Threshold int             // number of shares needed to reconstruct
+	Total     int             // number of shares created
+	X         byte            // x coordinate, 1..Total
+	Y         []byte          // polynomial values at X, one per byte of secret and checksum
+}
+
+// Split divides secret into n shares, any k of which reconstruct it.
+func Split(secret []byte, n, k int) ([]Share, error) {
+	if k < 2 || k > n || n > 255 {
+		return nil, fmt.Errorf("invalid threshold %d of %d shares", k, n)
+	}
+
+	var group [groupSize]byte
+	if _, err := rand.Read(group[:]); err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(secret)
+	value := append(bytes.Clone(secret), sum[:]...)
+
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{Group: group, Threshold: k, Total: n, X: byte(i + 1), Y: make([]byte, len(value))}
+	}
+
+	coeffs := make([]byte, k)
+	for b, v := range value {
+		// random polynomial of degree k-1 with the secret byte as constant term
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		coeffs[0] = v
+		for i := range shares {
+			shares[i].Y[b] = evaluate(coeffs, shares[i].X)
+		}
+	}
+	clear(coeffs)
+	clear(value)
+	return shares, nil
+}
+
+// Combine reconstructs the secret from at least Threshold shares of one split.
+// Extra shares are checked against the polynomial defined by the others.
+func Combine(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares provided")
+	}
+	first := shares[0]
+	seen := make(map[byte]bool, len(shares))
+	for _, s := range shares {
+		if s.Group != first.Group || s.Threshold != first.Threshold || s.Total != first.Total || len(s.Y) != len(first.Y) {
+			return nil, ErrInconsistentShares
+		}
+		if !s.valid() || seen[s.X] {
+			return nil, ErrInconsistentShares
+		}
+		seen[s.X] = true
+	}
+	if len(first.Y) < sha256.Size {
+		return nil, ErrInconsistentShares
+	}
+	if len(shares) < first.Threshold {
+		return nil, fmt.Errorf("need %d shares, got %d", first.Threshold, len(shares))
+	}
+
+	basis, extra := shares[:first.Threshold], shares[first.Threshold:]
+	value := interpolate(basis, 0)
+	for _, s := range extra {
+		if subtle.ConstantTimeCompare(interpolate(basis, s.X), s.Y) != 1 {
+			return nil, ErrInconsistentShares
+		}
+	}
+
+	secret, sum := value[:len(value)-sha256.Size], value[len(value)-sha256.Size:]
+	want := sha256.Sum256(secret)
+	if subtle.ConstantTimeCompare(sum, want[:]) != 1 {
+		return nil, ErrInconsistentShares
+	}
+	return secret, nil
+}
+
+// String encodes the share as text.
+func (s Share) String() string {
+	b := make([]byte, 0, headerSize+len(s.Y))
+	b = append(b, s.Group[:]...)
+	b = append(b, byte(s.Threshold), byte(s.Total), s.X)
+	b = append(b, s.Y...)
+	return sharePrefix + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Parse decodes a share encoded by Share.String.
+func Parse(text string) (Share, error) {
+	var s Share
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, sharePrefix) {
+		return s, errors.New("invalid share: missing " + sharePrefix + " prefix")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(text[len(sharePrefix):])
+	if err != nil || len(b) <= headerSize {
+		return s, errors.New("invalid share encoding")
+	}
+	copy(s.Group[:], b)
+	s.Threshold, s.Total, s.X = int(b[groupSize]), int(b[groupSize+1]), b[groupSize+2]
+	s.Y = b[headerSize:]
+	if !s.valid() {
+		return Share{}, errors.New("invalid share: threshold or index out of range")
+	}
+	return s, nil
+}
+
+// valid reports whether the share's threshold and x coordinate are in the ranges
+// Split creates: 2 <= Threshold <= Total and 1 <= X <= Total.
+func (s Share) valid() bool {
+	return s.Threshold >= 2 && s.Threshold <= s.Total && s.X >= 1 && int(s.X) <= s.Total
+}
+
+// evaluate computes the polynomial with the given coefficients at x using Horner's method.
+func evaluate(coeffs []byte, x byte) byte {
+	var y byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y = mul(y, x) ^ coeffs[i]
+	}
+	return y
+}
+
+// interpolate evaluates the polynomial through the shares at x, byte by byte, using Lagrange interpolation.
+func interpolate(shares []Share, x byte) []byte {
+	out := make([]byte, len(shares[0].Y))
+	for i, si := range shares {
+		// basis polynomial l_i(x) = prod_{j != i} (x - x_j) / (x_i - x_j); subtraction is xor in GF(256)
+		num, den := byte(1), byte(1)
+		for j, sj := range shares {
+			if i == j {
+				continue
+			}
+			num = mul(num, x^sj.X)
+			den = mul(den, si.X^sj.X)
+		}
+		l := mul(num, inverse(den))
+		for b := range out {
+			out[b] ^= mul(si.Y[b], l)
+		}
+	}
+	return out
+}
+
+// mul multiplies in GF(256) with the AES polynomial x^8 + x^4 + x^3 + x + 1,
+// without data dependent branches or table lookups.
+func mul(a, b byte) byte {
+	var p byte
+	for range 8 {
+		p ^= a & -(b & 1)
+		carry := -(a >> 7)
+		a = a<<1 ^ 0x1b&carry
+		b >>= 1
+	}
+	return p
+}
+
+// inverse returns a^254, the multiplicative inverse of a in GF(256).
+func inverse(a byte) byte {
+	b := mul(a, a) // a^2
+	r := b
+	for range 6 {
+		b = mul(b, b) // a^4, a^8, ..., a^128
+		r = mul(r, b)
+	}
+	return r
+}
@@ -0,0 +1,110 @@
+package shamir
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("break-glass root credentials")
+
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var picked []Share
+		for _, i := range subset {
+			parsed, err := Parse(shares[i].String())
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			picked = append(picked, parsed)
+		}
+		got, err := Combine(picked)
+		if err != nil {
+			t.Fatalf("Combine(%v) failed: %v", subset, err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Errorf("Combine(%v) = %q, want %q", subset, got, secret)
+		}
+	}
+}
+
+func TestCombineTooFewShares(t *testing.T) {
+	shares, _ := Split([]byte("secret"), 3, 3)
+	if _, err := Combine(shares[:2]); err == nil {
+		t.Fatal("Combine should fail below the threshold")
+	}
+}
+
+func TestCombineFailsClosed(t *testing.T) {
+	shares, _ := Split([]byte("secret"), 4, 2)
+	other, _ := Split([]byte("secret"), 4, 2)
+
+	corrupted := append([]Share(nil), shares[:2]...)
+	corrupted[1].Y = bytes.Clone(corrupted[1].Y)
+	corrupted[1].Y[0] ^= 1
+
+	extraCorrupted := append([]Share(nil), shares[:3]...)
+	extraCorrupted[2].Y = bytes.Clone(extraCorrupted[2].Y)
+	extraCorrupted[2].Y[3] ^= 1
+
+	tests := map[string][]Share{
+		"mixed splits": {shares[0], other[1]},
+		"duplicate":    {shares[0], shares[0]},
+		"corrupted":    corrupted,
+		"extra share":  extraCorrupted,
+	}
+	for name, set := range tests {
+		if _, err := Combine(set); !errors.Is(err, ErrInconsistentShares) {
+			t.Errorf("%s: expected ErrInconsistentShares, got %v", name, err)
+		}
+	}
+}
+
+func TestCombineOutOfRange(t *testing.T) {
+	shares, _ := Split([]byte("secret"), 3, 2)
+	with := func(i int, edit func(*Share)) Share {
+		s := shares[i]
+		edit(&s)
+		return s
+	}
+
+	tests := map[string][]Share{
+		"threshold 0":       {with(0, func(s *Share) { s.Threshold = 0 }), with(1, func(s *Share) { s.Threshold = 0 })},
+		"threshold 1":       {with(0, func(s *Share) { s.Threshold = 1 })},
+		"threshold > total": {with(0, func(s *Share) { s.Threshold = 4 }), with(1, func(s *Share) { s.Threshold = 4 })},
+		"x 0":               {with(0, func(s *Share) { s.X = 0 }), shares[1]},
+		"x > total":         {with(0, func(s *Share) { s.X = 4 }), shares[1]},
+		"other threshold":   {shares[0], with(1, func(s *Share) { s.Threshold = 3 }), shares[2]},
+		"other total":       {shares[0], with(1, func(s *Share) { s.Total = 4 })},
+		"first threshold 0": {with(0, func(s *Share) { s.Threshold = 0 }), shares[1]},
+	}
+	for name, set := range tests {
+		if _, err := Combine(set); !errors.Is(err, ErrInconsistentShares) {
+			t.Errorf("%s: expected ErrInconsistentShares, got %v", name, err)
+		}
+		for _, s := range set {
+			if s.valid() {
+				continue
+			}
+			if _, err := Parse(s.String()); err == nil {
+				t.Errorf("%s: Parse accepted threshold %d of %d at x %d", name, s.Threshold, s.Total, s.X)
+			}
+		}
+	}
+}
+
+func TestFieldArithmetic(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := mul(byte(a), inverse(byte(a))); got != 1 {
+			t.Fatalf("%d * inverse(%d) = %d, want 1", a, a, got)
+		}
+	}
+	if mul(0x57, 0x83) != 0xc1 {
+		t.Errorf("mul(0x57, 0x83) = %#x, want 0xc1", mul(0x57, 0x83))
+	}
+}
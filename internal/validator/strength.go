@@ -0,0 +1,463 @@
+package validator
+
+import (
+	"bufio"
+	"embed"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Strength is an estimate of how hard a passphrase is to guess, in the style of zxcvbn:
+// the passphrase is split into the cheapest sequence of guessable patterns (dictionary
+// words, keyboard walks, repeats, sequences, years) and brute-forced characters.
+type Strength struct {
+	Entropy  float64  `json:"entropy"`            // log2 of the estimated number of guesses
+	Score    int      `json:"score"`              // 0 (very weak) to 4 (very strong)
+	Warnings []string `json:"warnings,omitempty"` // patterns that make the passphrase guessable
+}
+
+// Score thresholds in bits of entropy; scores below the first are 0.
+var scoreThresholds = []float64{25, 40, 55, 70}
+
+// Label returns a short description of the score.
+func (s Strength) Label() string {
+	return [...]string{"very weak", "weak", "fair", "strong", "very strong"}[s.Score]
+}
+
+// maxEstimateLength is how many characters of a passphrase are estimated. Longer
+// passphrases are rare and slow to estimate, and the rest can only add entropy.
+const maxEstimateLength = 128
+
+// PassphraseStrength estimates the strength of a passphrase.
+func PassphraseStrength(passphrase string) Strength {
+	p := []rune(passphrase)
+	bits, warnings := estimate(p[:min(len(p), maxEstimateLength)], map[string]float64{})
+	s := Strength{Entropy: math.Round(bits*10) / 10}
+	for _, t := range scoreThresholds {
+		if bits >= t {
+			s.Score++
+		}
+	}
+	// strong passphrases can contain words too, that's not worth a warning
+	if s.Score < 3 {
+		s.Warnings = warnings
+	}
+	return s
+}
+
+// MinEntropy returns true if the passphrase's estimated entropy is at least bits.
+func MinEntropy(value string, bits float64) bool {
+	return bits <= 0 || PassphraseStrength(value).Entropy >= bits
+}
+
+const (
+	warnCommonPassword = "this is a commonly used password"
+	warnCommonWord     = "common words and names are easy to guess"
+	warnRepeat         = "repeated characters and words are easy to guess"
+	warnSequence       = "sequences like abc or 6543 are easy to guess"
+	warnKeyboard       = "keyboard patterns are easy to guess"
+	warnYear           = "years are easy to guess"
+)
+
+// match is a guessable pattern covering runes [i, j) of the passphrase.
+type match struct {
+	i, j    int
+	bits    float64
+	warning string
+}
+
+// estimate returns the entropy of the cheapest way to guess p, and the warnings of the
+// patterns used. Repeated substrings are estimated recursively, memoized in memo.
+func estimate(p []rune, memo map[string]float64) (float64, []string) {
+	n := len(p)
+	if n == 0 {
+		return 0, nil
+	}
+	lower := make([]rune, n)
+	for i, r := range p {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	var matches []match
+	matches = append(matches, dictionaryMatches(p, lower)...)
+	matches = append(matches, repeatMatches(p, lower, memo)...)
+	matches = append(matches, sequenceMatches(lower)...)
+	matches = append(matches, keyboardMatches(p)...)
+	matches = append(matches, yearMatches(lower)...)
+
+	byStart := make([][]match, n)
+	for _, m := range matches {
+		byStart[m.i] = append(byStart[m.i], m)
+	}
+
+	// best[k] is the cheapest cover of p[:k]; every pattern costs one extra bit
+	// for the attacker having to guess which patterns are combined.
+	bf := bruteforceBits(p)
+	best := make([]float64, n+1)
+	prev := make([]*match, n+1)
+	for k := 1; k <= n; k++ {
+		best[k] = math.Inf(1)
+	}
+	for i := range n {
+		if b := best[i] + bf; b < best[i+1] {
+			best[i+1], prev[i+1] = b, nil
+		}
+		for _, m := range byStart[i] {
+			if b := best[i] + m.bits + 1; b < best[m.j] {
+				best[m.j], prev[m.j] = b, &m
+			}
+		}
+	}
+
+	var warnings []string
+	for k := n; k > 0; {
+		m := prev[k]
+		if m == nil {
+			k--
+			continue
+		}
+		if !slices.Contains(warnings, m.warning) {
+			warnings = append(warnings, m.warning)
+		}
+		k = m.i
+	}
+	slices.Reverse(warnings)
+	return best[n], warnings
+}
+
+// bruteforceBits returns the bits per character needed to brute-force p,
+// from the character classes it uses.
+func bruteforceBits(p []rune) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range p {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < 0x80:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	var cardinality float64
+	for _, c := range []struct {
+		used bool
+		size float64
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if c.used {
+			cardinality += c.size
+		}
+	}
+	return math.Log2(cardinality)
+}
+
+//go:embed wordlists/*.txt
+var wordlistFiles embed.FS
+
+type dictionary struct {
+	ranks   map[string]int
+	warning string
+}
+
+// dictionaries loads the embedded frequency ordered wordlists on first use.
+var dictionaries = sync.OnceValue(func() []dictionary {
+	load := func(name, warning string) dictionary {
+		f, err := wordlistFiles.Open("wordlists/" + name + ".txt")
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		d := dictionary{ranks: make(map[string]int), warning: warning}
+		sc := bufio.NewScanner(f)
+		for rank := 1; sc.Scan(); rank++ {
+			d.ranks[sc.Text()] = rank
+		}
+		return d
+	}
+	return []dictionary{
+		load("passwords", warnCommonPassword),
+		load("english", warnCommonWord),
+		load("names", warnCommonWord),
+		load("surnames", warnCommonWord),
+	}
+})
+
+// l33t substitutions, with an alternative table for characters that stand for two letters.
+var (
+	l33t    = map[rune]rune{'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '9': 'g', '1': 'i', '!': 'i', '|': 'i', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't', '2': 'z'}
+	l33tAlt = map[rune]rune{'1': 'l', '|': 'l', '7': 'l'}
+)
+
+const maxWordLength = 32
+
+// dictionaryMatches finds dictionary words of at least three letters, also reversed
+// or spelled with l33t substitutions.
+func dictionaryMatches(p, lower []rune) []match {
+	variants := [][]rune{lower, unleet(lower, nil), unleet(lower, l33tAlt)}
+
+	var matches []match
+	for i := range lower {
+		for j := i + 3; j <= min(len(lower), i+maxWordLength); j++ {
+			for v, variant := range variants {
+				subs := 0
+				if v > 0 {
+					for k := i; k < j; k++ {
+						if variant[k] != lower[k] {
+							subs++
+						}
+					}
+					if subs == 0 {
+						continue // same as the plain lowercase variant
+					}
+				}
+				word := variant[i:j]
+				extra := caseBits(p[i:j]) + float64(subs)
+				if m, ok := lookup(string(word), i, j, extra); ok {
+					matches = append(matches, m)
+				}
+				if m, ok := lookup(reverse(word), i, j, extra+1); ok {
+					matches = append(matches, m)
+				}
+			}
+		}
+	}
+	return matches
+}
+
+func lookup(word string, i, j int, extra float64) (match, bool) {
+	for _, d := range dictionaries() {
+		if rank, ok := d.ranks[word]; ok {
+			return match{i: i, j: j, bits: math.Log2(float64(rank)) + extra, warning: d.warning}, true
+		}
+	}
+	return match{}, false
+}
+
+func unleet(s []rune, alt map[rune]rune) []rune {
+	out := make([]rune, len(s))
+	for i, r := range s {
+		out[i] = r
+		if a, ok := alt[r]; ok {
+			out[i] = a
+		} else if l, ok := l33t[r]; ok {
+			out[i] = l
+		}
+	}
+	return out
+}
+
+func reverse(s []rune) string {
+	r := make([]rune, len(s))
+	for i, c := range s {
+		r[len(s)-1-i] = c
+	}
+	return string(r)
+}
+
+// caseBits returns the bits added by the capitalization of a word: one bit for common
+// variants like a capitalized first or last letter, more for mixed case.
+func caseBits(word []rune) float64 {
+	var upper, lower int
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			upper++
+		} else if unicode.IsLower(r) {
+			lower++
+		}
+	}
+	switch {
+	case upper == 0:
+		return 0
+	case lower == 0, upper == 1 && (unicode.IsUpper(word[0]) || unicode.IsUpper(word[len(word)-1])):
+		return 1
+	}
+	var variants float64
+	for k := 1; k <= min(upper, lower); k++ {
+		variants += binomial(upper+lower, k)
+	}
+	return math.Log2(variants)
+}
+
+func binomial(n, k int) float64 {
+	r := 1.0
+	for i := 1; i <= k; i++ {
+		r = r * float64(n-k+i) / float64(i)
+	}
+	return r
+}
+
+// repeatMatches finds runs of a repeated character or substring, like "aaa" or "abcabc".
+// They cost as much as the repeated part plus the repeat count.
+func repeatMatches(p, lower []rune, memo map[string]float64) []match {
+	var matches []match
+	for i := range lower {
+		var runs []struct{ period, end int } // the runs found starting at i
+	periods:
+		for period := 1; i+2*period <= len(lower); period++ {
+			// a multiple of a shorter period that repeats at least twice within that
+			// run ends where it does, at no lower cost. Skipping them keeps long runs
+			// like "aaaa…" from taking cubic time.
+			for _, r := range runs {
+				if period%r.period == 0 && i+2*period <= r.end {
+					continue periods
+				}
+			}
+			end := i + period
+			for end < len(lower) && lower[end] == lower[end-period] {
+				end++
+			}
+			if end-i < 2*period || end-i < 3 {
+				continue
+			}
+			runs = append(runs, struct{ period, end int }{period, end})
+			base := string(p[i : i+period])
+			bits, ok := memo[base]
+			if !ok {
+				bits, _ = estimate(p[i:i+period], memo)
+				memo[base] = bits
+			}
+			count := float64(end-i) / float64(period)
+			matches = append(matches, match{i: i, j: end, bits: bits + math.Log2(count), warning: warnRepeat})
+		}
+	}
+	return matches
+}
+
+// sequenceMatches finds runs of at least three characters with a constant step of
+// one or two, like "abc", "9753" or "xvt".
+func sequenceMatches(lower []rune) []match {
+	var matches []match
+	for i := 0; i+2 < len(lower); {
+		step := lower[i+1] - lower[i]
+		if step == 0 || step < -2 || step > 2 {
+			i++
+			continue
+		}
+		j := i + 2
+		for j < len(lower) && lower[j]-lower[j-1] == step {
+			j++
+		}
+		if j-i < 3 {
+			i++
+			continue
+		}
+
+		var bits float64
+		switch first := lower[i]; {
+		case strings.ContainsRune("a1z90", first):
+			bits = 1
+		case unicode.IsDigit(first):
+			bits = math.Log2(10)
+		case unicode.IsLetter(first):
+			bits = math.Log2(26)
+		default:
+			bits = math.Log2(100)
+		}
+		bits += math.Log2(float64(j - i))
+		if step < 0 {
+			bits++
+		}
+		if step == 2 || step == -2 {
+			bits++
+		}
+		matches = append(matches, match{i: i, j: j, bits: bits, warning: warnSequence})
+		i = j - 1
+	}
+	return matches
+}
+
+// QWERTY layout, with the shifted characters of each key. Every row is offset half a
+// key to the right of the one above.
+var (
+	keyboardRows = []string{"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./"}
+	shiftedRows  = []string{"~!@#$%^&*()_+", "QWERTYUIOP{}|", "ASDFGHJKL:\"", "ZXCVBNM<>?"}
+)
+
+type keyPos struct{ row, col int }
+
+var keyboard = sync.OnceValue(func() map[rune]keyPos {
+	keys := make(map[rune]keyPos)
+	for _, rows := range [][]string{keyboardRows, shiftedRows} {
+		for row, line := range rows {
+			for col, k := range []rune(line) {
+				keys[k] = keyPos{row, col}
+			}
+		}
+	}
+	return keys
+})
+
+// keyDirection returns which of the six neighbors of a is b, or -1 if they aren't adjacent.
+func keyDirection(a, b keyPos) int {
+	for d, off := range []keyPos{{0, -1}, {0, 1}, {-1, 0}, {-1, 1}, {1, -1}, {1, 0}} {
+		if a.row+off.row == b.row && a.col+off.col == b.col {
+			return d
+		}
+	}
+	return -1
+}
+
+// keyboardMatches finds walks of at least three adjacent keys, like "qwerty" or "zaq1".
+// They cost the starting key, the length, and every change of direction.
+func keyboardMatches(p []rune) []match {
+	keys := keyboard()
+	var matches []match
+	for i := 0; i+2 < len(p); {
+		j, turns, dir := i+1, 0, -1
+		for ; j < len(p); j++ {
+			a, okA := keys[p[j-1]]
+			b, okB := keys[p[j]]
+			d := keyDirection(a, b)
+			if !okA || !okB || d < 0 {
+				break
+			}
+			if dir >= 0 && d != dir {
+				turns++
+			}
+			dir = d
+		}
+		if j-i < 3 {
+			i++
+			continue
+		}
+
+		bits := math.Log2(47) + math.Log2(float64(j-i)) + float64(turns)*math.Log2(4.6)
+		for _, row := range shiftedRows {
+			if strings.ContainsAny(row, string(p[i:j])) {
+				bits++ // shift key used
+				break
+			}
+		}
+		matches = append(matches, match{i: i, j: j, bits: bits, warning: warnKeyboard})
+		i = j - 1
+	}
+	return matches
+}
+
+// yearMatches finds years from 1900 to 2049.
+func yearMatches(lower []rune) []match {
+	var matches []match
+	for i := 0; i+4 <= len(lower); i++ {
+		s := string(lower[i : i+4])
+		if (strings.HasPrefix(s, "19") || strings.HasPrefix(s, "20") && s[2] < '5') && isDigits(s) {
+			matches = append(matches, match{i: i, j: i + 4, bits: math.Log2(150), warning: warnYear})
+		}
+	}
+	return matches
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
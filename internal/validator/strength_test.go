@@ -0,0 +1,77 @@
+package validator
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPassphraseStrength(t *testing.T) {
+	tests := []struct {
+		passphrase string
+		maxScore   int
+		minScore   int
+		warning    string
+	}{
+		{"aaaaa", 0, 0, warnRepeat},
+		{"password", 0, 0, warnCommonPassword},
+		{"P@ssw0rd", 0, 0, warnCommonPassword},
+		{"drowssap", 0, 0, warnCommonPassword},
+		{"abcdefgh", 0, 0, warnSequence},
+		{"zxcvfdsa", 0, 0, warnKeyboard},
+		{"jennifer1987", 0, 0, warnYear},
+		{"abcabcabcabc", 0, 0, warnRepeat},
+		{"xK9#mQ2$vL7!", 4, 4, ""},
+		{"correct-horse-battery-staple-orbit-mango", 4, 4, ""},
+	}
+	for _, tt := range tests {
+		s := PassphraseStrength(tt.passphrase)
+		if s.Score < tt.minScore || s.Score > tt.maxScore {
+			t.Errorf("%q: score %d (%.1f bits), want %d-%d", tt.passphrase, s.Score, s.Entropy, tt.minScore, tt.maxScore)
+		}
+		if tt.warning != "" && !slices.Contains(s.Warnings, tt.warning) {
+			t.Errorf("%q: warnings %v, want %q", tt.passphrase, s.Warnings, tt.warning)
+		}
+	}
+}
+
+func TestPassphraseStrength_RandomBeatsPatterns(t *testing.T) {
+	if PassphraseStrength("q7Rv2mXp").Entropy <= PassphraseStrength("Password1").Entropy {
+		t.Error("random characters should be stronger than a capitalized common password")
+	}
+	if PassphraseStrength(strings.Repeat("ab", 64)).Entropy > 20 {
+		t.Error("a long repeat should stay weak")
+	}
+}
+
+func TestPassphraseStrength_LongInput(t *testing.T) {
+	// a Fibonacci word repeats many different substrings
+	fib, prev := "ab", "a"
+	for len(fib) < 1024 {
+		fib, prev = fib+prev, fib
+	}
+	for name, p := range map[string]string{
+		"one character": strings.Repeat("a", 1024),
+		"words":         strings.Repeat("correct-horse-", 1024/14),
+		"fibonacci":     fib,
+	} {
+		start := time.Now()
+		PassphraseStrength(p)
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s: took %v", name, d)
+		}
+	}
+}
+
+func TestMinEntropy(t *testing.T) {
+	if !MinEntropy("aaaaa", 0) {
+		t.Error("a zero minimum should accept anything")
+	}
+	if MinEntropy("aaaaa", 20) {
+		t.Error("aaaaa should not have 20 bits of entropy")
+	}
+	if !MinEntropy("lamp-orbit-velvet-cactus", 40) {
+		t.Error("four words should have 40 bits of entropy")
+	}
+}
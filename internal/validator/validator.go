@@ -2,7 +2,9 @@
 package validator
 
 import (
+	"encoding/base32"
 	"encoding/json"
+	"net/url"
 	"regexp"
 	"slices"
 	"strconv"
@@ -82,6 +84,20 @@ func Matches(value string, pattern *regexp.Regexp) bool {
 	return pattern.MatchString(value)
 }
 
+// IsURL returns true if the string is an absolute http or https URL with a host.
+func IsURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// IsBase32 returns true if the string is non-empty base32, ignoring case, spaces and
+// padding, the way authenticator apps accept TOTP seeds.
+func IsBase32(value string) bool {
+	value = strings.TrimRight(strings.ToUpper(strings.Join(strings.Fields(value), "")), "=")
+	_, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(value)
+	return value != "" && err == nil
+}
+
 /////////////////////////
 // Numeric Validators
 /////////////////////////
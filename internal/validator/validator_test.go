@@ -0,0 +1,42 @@
+package validator
+
+import "testing"
+
+func TestIsURL(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"https://example.com/login", true},
+		{"http://localhost:8080", true},
+		{"example.com", false},
+		{"ftp://example.com", false},
+		{"javascript:alert(1)", false},
+		{"https://", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := IsURL(tt.value); got != tt.want {
+			t.Errorf("IsURL(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestIsBase32(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"JBSWY3DPEHPK3PXP", true},
+		{"jbsw y3dp ehpk 3pxp", true},
+		{"JBSWY3DPEHPK3PXP====", true},
+		{"JBSWY3DPEHPK3PX1", false},
+		{"JBSW!", false},
+		{"  ", false},
+	}
+	for _, tt := range tests {
+		if got := IsBase32(tt.value); got != tt.want {
+			t.Errorf("IsBase32(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -15,10 +15,10 @@ const getMimeType = (filename) => {
   return mimeTypes[filename?.toLowerCase().split('.').pop()] || 'application/octet-stream';
 };
 
-const downloadFile = (fileDataB64, filename) => {
+const downloadFile = (fileDataB64, filename, contentType) => {
   try {
     const bytes = Uint8Array.from(atob(fileDataB64), c => c.charCodeAt(0));
-    const blob = new Blob([bytes], { type: getMimeType(filename) });
+    const blob = new Blob([bytes], { type: contentType || getMimeType(filename) });
     const url = URL.createObjectURL(blob);
     const a = Object.assign(document.createElement('a'), { href: url, download: filename || 'download', style: 'display:none' });
     document.body.appendChild(a).click();
@@ -30,6 +30,143 @@ const downloadFile = (fileDataB64, filename) => {
   }
 };
 
+const crcTable = Array.from({ length: 256 }, (_, n) => {
+  let c = n;
+  for (let k = 0; k < 8; k++) c = c & 1 ? 0xedb88320 ^ (c >>> 1) : c >>> 1;
+  return c >>> 0;
+});
+
+const crc32 = (bytes) => {
+  let crc = 0xffffffff;
+  for (const b of bytes) crc = crcTable[(crc ^ b) & 0xff] ^ (crc >>> 8);
+  return (crc ^ 0xffffffff) >>> 0;
+};
+
+// Builds a zip archive of uncompressed entries, like the server's Metadata.BundleZip, so
+// the attachments of a one-time secret can be saved together without a second request.
+const buildZip = (entries) => {
+  const parts = [], central = [];
+  let offset = 0;
+  for (const { name, data } of entries) {
+    const nameBytes = new TextEncoder().encode(name);
+    const crc = crc32(data);
+    const header = (size, sig) => {
+      const v = new DataView(new ArrayBuffer(size));
+      v.setUint32(0, sig, true);
+      return v;
+    };
+    const local = header(30, 0x04034b50);
+    local.setUint16(4, 20, true);
+    local.setUint16(6, 0x0800, true); // UTF-8 names
+    local.setUint16(12, 0x21, true); // 1980-01-01
+    local.setUint32(14, crc, true);
+    local.setUint32(18, data.length, true);
+    local.setUint32(22, data.length, true);
+    local.setUint16(26, nameBytes.length, true);
+    const dir = header(46, 0x02014b50);
+    dir.setUint16(4, 20, true);
+    dir.setUint16(6, 20, true);
+    dir.setUint16(8, 0x0800, true);
+    dir.setUint16(14, 0x21, true);
+    dir.setUint32(16, crc, true);
+    dir.setUint32(20, data.length, true);
+    dir.setUint32(24, data.length, true);
+    dir.setUint16(28, nameBytes.length, true);
+    dir.setUint32(42, offset, true);
+    parts.push(local, nameBytes, data);
+    central.push(dir, nameBytes);
+    offset += 30 + nameBytes.length + data.length;
+  }
+  const size = central.reduce((n, p) => n + p.byteLength, 0);
+  const end = new DataView(new ArrayBuffer(22));
+  end.setUint32(0, 0x06054b50, true);
+  end.setUint16(8, entries.length, true);
+  end.setUint16(10, entries.length, true);
+  end.setUint32(12, size, true);
+  end.setUint32(16, offset, true);
+  return new Blob([...parts, ...central, end], { type: 'application/zip' });
+};
+
+// Saves a bundle's message and attachments as one zip, with the message as message.txt.
+const downloadZip = (btn) => {
+  const bundle = btn.closest('.bundle-display');
+  const entries = [];
+  const message = bundle.querySelector('#bundle-message')?.textContent;
+  if (message) entries.push({ name: 'message.txt', data: new TextEncoder().encode(message) });
+  for (const el of bundle.querySelectorAll('.download-btn[data-file-data]')) {
+    const data = Uint8Array.from(atob(el.getAttribute('data-file-data')), c => c.charCodeAt(0));
+    entries.push({ name: el.getAttribute('data-filename'), data });
+  }
+  const url = URL.createObjectURL(buildZip(entries));
+  const a = Object.assign(document.createElement('a'), { href: url, download: btn.getAttribute('data-filename'), style: 'display:none' });
+  document.body.appendChild(a).click();
+  document.body.removeChild(a);
+  URL.revokeObjectURL(url);
+};
+
+// Fills a passphrase field with a generated diceware passphrase and shows it, so it can be copied.
+const generatePassphrase = async (btn) => {
+  const input = document.querySelector(btn.getAttribute('data-target'));
+  if (!input) return;
+  try {
+    const res = await fetch('/api/v1/passphrase', { cache: 'no-store' });
+    const body = await res.json();
+    if (!res.ok) throw new Error(body.error?.message || res.statusText);
+    input.type = 'text';
+    input.value = body.passphrase;
+    input.dispatchEvent(new Event('input', { bubbles: true }));
+  } catch (err) {
+    console.error('Generate error:', err);
+    alert('Failed to generate passphrase: ' + err.message);
+  }
+};
+
+// Decodes unpadded upper case base32, the form TOTP keys are given to the page in.
+const base32Decode = (s) => {
+  const alphabet = 'ABCDEFGHIJKLMNOPQRSTUVWXYZ234567';
+  const bytes = [];
+  let bits = 0, value = 0;
+  for (const c of s) {
+    value = (value << 5) | alphabet.indexOf(c);
+    bits += 5;
+    if (bits >= 8) {
+      bytes.push((value >>> (bits - 8)) & 0xff);
+      bits -= 8;
+    }
+  }
+  return new Uint8Array(bytes);
+};
+
+// Computes the RFC 6238 code of key at a unix time, like the server's crypto.TOTP:
+// six digits from HMAC-SHA1 over 30-second steps.
+const totpCode = async (key, unix) => {
+  const counter = new DataView(new ArrayBuffer(8));
+  counter.setUint32(4, Math.floor(unix / 30));
+  const hmacKey = await crypto.subtle.importKey('raw', key, { name: 'HMAC', hash: 'SHA-1' }, false, ['sign']);
+  const sum = new DataView(await crypto.subtle.sign('HMAC', hmacKey, counter.buffer));
+  const code = sum.getUint32(sum.getUint8(19) & 0x0f) & 0x7fffffff;
+  return String(code % 1000000).padStart(6, '0');
+};
+
+// Keeps one-time codes current. WebCrypto is only available on secure origins; elsewhere
+// the code rendered by the server is shown until it expires.
+const updateTOTP = async () => {
+  const unix = Date.now() / 1000;
+  for (const el of document.querySelectorAll('[data-totp-key]')) {
+    const remaining = el.parentElement.querySelector('.totp-remaining');
+    if (window.crypto?.subtle) {
+      el.textContent = await totpCode(base32Decode(el.dataset.totpKey), unix);
+      if (remaining) remaining.textContent = `${30 - Math.floor(unix % 30)}s`;
+    } else if (unix >= Number(el.dataset.totpExpires)) {
+      el.textContent = '------';
+      if (remaining) remaining.textContent = 'expired, add the seed to your authenticator app';
+    } else if (remaining) {
+      remaining.textContent = `${Math.ceil(Number(el.dataset.totpExpires) - unix)}s`;
+    }
+  }
+};
+setInterval(updateTOTP, 1000);
+
 document.addEventListener('click', (e) => {
   if (e.target.matches('.copy-btn[data-copy-text]')) {
     copyToClipboard(e.target.getAttribute('data-copy-text'));
@@ -38,12 +175,18 @@ document.addEventListener('click', (e) => {
     const el = document.querySelector(e.target.getAttribute('data-copy-selector'));
     if (el) copyToClipboard(el.textContent);
     e.preventDefault();
+  } else if (e.target.matches('.zip-btn')) {
+    downloadZip(e.target);
+    e.preventDefault();
+  } else if (e.target.matches('.generate-btn')) {
+    generatePassphrase(e.target);
+    e.preventDefault();
   } else {
     const btn = e.target.closest('.download-btn[data-file-data]');
     if (btn) {
       e.preventDefault();
       const data = btn.getAttribute('data-file-data');
-      if (data) downloadFile(data, btn.getAttribute('data-filename'));
+      if (data) downloadFile(data, btn.getAttribute('data-filename'), btn.getAttribute('data-content-type'));
       else alert('File data not available');
     }
   }
@@ -57,3 +200,53 @@ document.addEventListener('change', (e) => {
     }
   }
 });
+
+// The text form holds either free text or a login's fields. The hidden kind's fields
+// are disabled, so they are neither required nor sent.
+const updateKind = (form) => {
+  const kind = form?.querySelector('input[name="kind"]:checked')?.value;
+  if (!kind) return;
+  for (const group of form.querySelectorAll('[data-kind]')) {
+    const shown = group.getAttribute('data-kind') === kind;
+    group.hidden = !shown;
+    for (const el of group.querySelectorAll('input, textarea')) el.disabled = !shown;
+  }
+};
+
+document.addEventListener('change', (e) => {
+  if (e.target.matches('input[name="kind"]')) updateKind(e.target.form);
+});
+
+// A passphrase is only needed when the secret isn't encrypted to a recipient or a link key.
+const updatePassphrase = (form) => {
+  const passphrase = form?.querySelector('input[name="passphrase"]');
+  if (!passphrase) return;
+  const recipient = form.querySelector('textarea[name="recipient"]')?.value.trim() ?? '';
+  const linkMode = form.querySelector('input[name="mode"]')?.checked ?? false;
+  passphrase.disabled = linkMode;
+  passphrase.required = recipient === '' && !linkMode;
+  for (const el of form.querySelectorAll('[data-passphrase-only]')) {
+    el.disabled = linkMode || recipient !== '';
+  }
+};
+
+document.addEventListener('input', (e) => {
+  if (e.target.matches('textarea[name="recipient"], input[name="mode"]')) {
+    updatePassphrase(e.target.form);
+  }
+});
+
+// Link mode keys are in the URL fragment, which is never sent to the server. The key is
+// moved into the form and dropped from the address bar; the secret is only fetched when
+// the user clicks reveal, so link previewers can't consume it.
+document.addEventListener('DOMContentLoaded', () => {
+  const form = document.querySelector('form[data-retrieve]');
+  const token = window.location.hash.slice(1);
+  if (!form || !token) return;
+
+  form.querySelector('input[name="token"]').value = token;
+  form.querySelector('.passphrase-group')?.remove();
+  form.querySelector('.reveal-note').hidden = false;
+  form.querySelector('button[type="submit"]').firstChild.textContent = 'Click to Reveal Secret ';
+  history.replaceState(null, '', window.location.pathname + window.location.search);
+});